@@ -3,8 +3,7 @@ package app
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -16,12 +15,7 @@ import (
 	"github.com/hironobu-s/swiftfs/config"
 	"github.com/hironobu-s/swiftfs/fs"
 	"github.com/hironobu-s/swiftfs/mapper"
-)
-
-const (
-	DAEMONIZE_STARTING = iota
-	DAEMONIZE_SUCCESS
-	DAEMONIZE_FAIL
+	"github.com/hironobu-s/swiftfs/openstack"
 )
 
 func Run() {
@@ -33,15 +27,41 @@ func Run() {
 	app.HideHelp = true
 	app.Author = "Hironobu Saitoh"
 	app.Email = "hiro@hironobu.org"
-	app.ArgsUsage = "container-name mountpoint"
+	app.ArgsUsage = "container-name mountpoint (optional with --mount)"
 
 	conf := config.NewConfig()
-	defer conf.Logfile.Close()
+	exitStatus := EXIT_OK
 
 	app.Flags = conf.GetFlags()
+	app.Commands = commands()
+
+	// In daemonizing process, "--child" flag wil be used to recognize myelf as child process.
+	// Remove this flag before the Apps parsing the arguments.
+	args := make([]string, 0, len(os.Args))
+	for _, p := range os.Args {
+		if p == "--child" {
+			conf.ChildProcess = true
+		} else {
+			args = append(args, p)
+		}
+	}
+
+	// mount(8) runs "mount.swiftfs CONTAINER MOUNTPOINT -o OPTIONS" for the entries of /etc/fstab.
+	// The daemon process gets the converted arguments.
+	if !conf.ChildProcess && filepath.Base(args[0]) == config.MOUNT_HELPER {
+		helperArgs, fake, err := config.MountHelperArgs(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		} else if fake {
+			os.Exit(0)
+		}
+		args = append(args[:1], helperArgs...)
+	}
 
 	app.Action = func(c *cli.Context) {
-		if c.Bool("help") || len(c.Args()) < 2 {
+		// The container and mountpoint may be given by the mount section of the config file.
+		if c.Bool("help") || (len(c.Args()) < 2 && c.String("mount") == "") {
 			cli.ShowAppHelp(c)
 			return
 		}
@@ -51,67 +71,118 @@ func Run() {
 			Usage: "internal use only",
 		})
 
+		// The daemon process reports the error to the parent, that prints it. See daemonize().
+		fail := func(err error) {
+			if !conf.ChildProcess || conf.Logfile != nil {
+				log.Warnf("%v", err)
+			}
+			if conf.ChildProcess {
+				afterDaemonize(err)
+			}
+			exitStatus = EXIT_ERROR
+		}
+
 		var err error
 		if err = conf.SetConfigFromContext(c); err != nil {
-			log.Warnf("%v", err)
+			fail(err)
+			return
+		}
+
+		// The credential of the child process is sent by the parent. See daemonize().
+		if conf.ChildProcess {
+			err = conf.ReadCredential(os.NewFile(uintptr(4), "credential"))
+		} else {
+			err = conf.ResolveCredential()
+		}
+		if err != nil {
+			fail(err)
 			return
 		}
 
 		if !conf.ChildProcess {
-			if err = daemonize(c, conf); err != nil {
-				log.Warnf("%v", err)
+			if err = daemonize(args[1:], conf); err != nil {
+				fail(err)
 				return
 			}
 		}
 
+		log.Debug("Authenticate")
+		swift := openstack.NewSwift(conf)
+		if err = swift.Auth(); err != nil {
+			fail(fmt.Errorf("Authentication failed. %v", err))
+			return
+		}
+
 		log.Debug("Create mapper")
-		mapper, err := mapper.NewObjectMapper(conf)
+		mapper, err := mapper.NewObjectMapper(conf, swift)
 		if err != nil {
-			log.Warnf("%v", err)
-			afterDaemonize(err)
+			fail(err)
+			return
+		}
+		// The pending uploads are given up after the timeout, so that the process does not hang on exit.
+		closeTimeout := conf.ShutdownTimeout
+		defer func() {
+			if abandoned := mapper.Close(closeTimeout); len(abandoned) > 0 {
+				log.Warnf("%d files were not uploaded. They are uploaded on the next mount: %v", len(abandoned), abandoned)
+				exitStatus = EXIT_UNSYNCED
+			}
+		}()
+
+		if err = writePidFile(conf.PidFile); err != nil {
+			fail(err)
 			return
 		}
+		defer removePidFile(conf.PidFile)
 
 		log.Debug("Create filesystem")
 		objectFs := fs.NewObjectFileSystem(conf, mapper)
 
 		log.Debug("Mount filesystem")
-		server, err := mount(objectFs, conf.MountPoint)
+		server, err := mount(objectFs, conf)
 		if err != nil {
-			log.Warnf("%v", err)
-			afterDaemonize(err)
+			fail(fmt.Errorf("Can't mount on %s. %v", conf.MountPoint, err))
 			return
 		}
 
+		// "swiftfs status" and "swiftfs umount" talk to the process by the control socket.
+		ctl, err := listenControl(conf, objectFs, mapper, server)
+		if err != nil {
+			log.Warnf("Can't listen on the control socket. %v", err)
+		}
+		defer ctl.close()
+
+		// SIGTERM and SIGINT unmount after uploading the local changes.
+		sd := handleShutdown(conf, objectFs, mapper, server)
+
+		// SIGHUP reloads the tunables and opens the logfile again.
+		handleReload(c, conf, swift, objectFs)
+
 		if conf.ChildProcess {
 			afterDaemonize(nil)
 		}
+		notifyReady(conf, objectFs, mapper)
 
 		// main loop
 		log.Debugf("Swiftfs process with pid %d started", syscall.Getpid())
-		server.Serve()
+		sd.serve(server)
 
 		log.Debug("Shutdown")
-	}
-
-	// In daemonizing process, "--child" flag wil be used to recognize myelf as child process.
-	// Remove this flag before the Apps parsing the arguments.
-	args := make([]string, 0, len(os.Args))
-	for _, p := range os.Args {
-		if p == "--child" {
-			conf.ChildProcess = true
-		} else {
-			args = append(args, p)
+		if !sd.synced() {
+			exitStatus = EXIT_UNSYNCED
 		}
+		closeTimeout = sd.remaining(conf.ShutdownTimeout)
 	}
 
-	if err := app.Run(args); err != nil {
+	err := app.Run(args)
+	conf.Logfile.Close()
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(EXIT_ERROR)
 	}
+	os.Exit(exitStatus)
 }
 
-func mount(fs pathfs.FileSystem, mountpoint string) (server *fuse.Server, err error) {
+func mount(fs pathfs.FileSystem, conf *config.Config) (server *fuse.Server, err error) {
 	path := pathfs.NewPathNodeFs(fs, nil)
 	con := nodefs.NewFileSystemConnector(path.Root(), &nodefs.Options{
 		EntryTimeout:    time.Second,
@@ -120,104 +191,22 @@ func mount(fs pathfs.FileSystem, mountpoint string) (server *fuse.Server, err er
 	})
 
 	opts := &fuse.MountOptions{
-		Name:   config.APP_NAME,
-		FsName: config.APP_NAME,
+		Name:       config.APP_NAME,
+		FsName:     conf.ContainerName,
+		AllowOther: conf.AllowOther,
 	}
-
-	server, err = fuse.NewServer(con.RawFS(), mountpoint, opts)
-	if err != nil {
-		return nil, err
+	if conf.ReadOnly {
+		opts.Options = append(opts.Options, "ro")
 	}
-
-	return server, nil
-}
-
-// Spawn a child process and waiting for completing the launch.
-func daemonize(c *cli.Context, conf *config.Config) (err error) {
-	if conf.NoDaemon {
-		// child process
-		return nil
+	if conf.AllowOther {
+		// The kernel checks the permissions of uid, gid and umask for other users.
+		opts.Options = append(opts.Options, "default_permissions")
 	}
 
-	// Spawn a daemon process
-	log.Debug("Spawn a daemon process")
-
-	args := []string{"--child"}
-	args = append(args, os.Args[1:]...)
-
-	// Used in IPC
-	r, w, err := os.Pipe()
+	server, err = fuse.NewServer(con.RawFS(), conf.MountPoint, opts)
 	if err != nil {
-		return err
-	}
-
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.ExtraFiles = []*os.File{w}
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Start()
-
-	// Wait 30 seconds for lunching a child process.
-	status := DAEMONIZE_STARTING
-	go func() {
-		buf := make([]byte, 1)
-		r.Read(buf)
-
-		if int(buf[0]) == DAEMONIZE_SUCCESS {
-			status = int(buf[0])
-		} else {
-			status = DAEMONIZE_FAIL
-		}
-	}()
-
-	i := 0
-	for i < 60 {
-		if status != DAEMONIZE_STARTING {
-			break
-		}
-		time.Sleep(500 * time.Millisecond)
-		i++
-
-		log.Debug("Wait starting a child process")
+		return nil, err
 	}
 
-	// Exit parent process
-	if status == DAEMONIZE_SUCCESS {
-		log.Debug("swiftfs started successfuly")
-		os.Exit(0)
-	} else {
-		log.Warn("swiftfs failed to start")
-		os.Exit(1)
-	}
-	return nil
-}
-
-func afterDaemonize(err error) {
-	// Ignore SIGCHLD signal
-	signal.Ignore(syscall.SIGCHLD)
-
-	// Close STDOUT, STDIN, STDERR
-	syscall.Close(0)
-	syscall.Close(1)
-	syscall.Close(2)
-
-	// Become the process group leader
-	syscall.Setsid()
-
-	// // Clear umask
-	syscall.Umask(022)
-
-	// // chdir for root directory
-	syscall.Chdir("/")
-
-	// Notify that the child process started successfuly
-	pipe := os.NewFile(uintptr(3), "pipe")
-	if pipe != nil {
-		defer pipe.Close()
-		if err == nil {
-			pipe.Write([]byte{DAEMONIZE_SUCCESS})
-		} else {
-			pipe.Write([]byte{DAEMONIZE_FAIL})
-		}
-	}
+	return server, nil
 }
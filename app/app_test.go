@@ -1,6 +1,10 @@
 package app
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestMain(m *testing.M) {
+	os.Exit(m.Run())
 }
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// Exit codes of the commands
+const (
+	EXIT_OK              = 0
+	EXIT_ERROR           = 1
+	EXIT_NOT_MOUNTED     = 2 // no swiftfs process on the mountpoint
+	EXIT_PENDING_UPLOADS = 3 // not unmounted because uploads were not finished
+	EXIT_UNSYNCED        = 4 // shut down by a signal before uploads were finished
+)
+
+const DEFAULT_UMOUNT_TIMEOUT = time.Minute
+
+func commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:      "umount",
+			Usage:     "Upload the pending changes and unmount",
+			ArgsUsage: "mountpoint",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "timeout",
+					Usage: "The time(sec) to wait for the pending uploads.",
+					Value: int(DEFAULT_UMOUNT_TIMEOUT / time.Second),
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Unmount even if uploads are pending. The daemon process keeps uploading them before exit.",
+				},
+			},
+			Action: func(c *cli.Context) {
+				os.Exit(umountCommand(c))
+			},
+		},
+		{
+			Name:      "status",
+			Usage:     "Show the swiftfs mounts of the user",
+			ArgsUsage: "[mountpoint]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output in JSON",
+				},
+			},
+			Action: func(c *cli.Context) {
+				os.Exit(statusCommand(c))
+			},
+		},
+	}
+}
+
+// exitCode prints the error, and returns the exit code for it.
+func exitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	fmt.Fprintln(os.Stderr, err)
+	if _, ok := err.(*errNotMounted); ok {
+		return EXIT_NOT_MOUNTED
+	}
+	return EXIT_ERROR
+}
+
+func umountCommand(c *cli.Context) int {
+	if len(c.Args()) != 1 {
+		cli.ShowCommandHelp(c, "umount")
+		return EXIT_ERROR
+	}
+
+	mountpoint, err := filepath.Abs(c.Args()[0])
+	if err != nil {
+		return exitCode(err)
+	}
+
+	req := &controlRequest{
+		Command: CONTROL_UMOUNT,
+		Timeout: time.Duration(c.Int("timeout")) * time.Second,
+		Force:   c.Bool("force"),
+	}
+	res, err := sendControl(controlSocketPath(mountpoint), req)
+	if _, ok := err.(*errNotMounted); ok {
+		return exitCode(&errNotMounted{path: mountpoint})
+	} else if err != nil {
+		return exitCode(err)
+	}
+
+	if res.Error != "" {
+		fmt.Fprintln(os.Stderr, res.Error)
+		for _, path := range res.Pending {
+			fmt.Fprintf(os.Stderr, "  %s\n", path)
+		}
+		if len(res.Pending) > 0 && !req.Force {
+			return EXIT_PENDING_UPLOADS
+		}
+		return EXIT_ERROR
+	}
+	return EXIT_OK
+}
+
+func statusCommand(c *cli.Context) int {
+	var mounts []*MountStatus
+	if len(c.Args()) > 0 {
+		mountpoint, err := filepath.Abs(c.Args()[0])
+		if err != nil {
+			return exitCode(err)
+		}
+		status, err := mountStatus(mountpoint)
+		if err != nil {
+			return exitCode(err)
+		}
+		mounts = append(mounts, status)
+
+	} else {
+		var err error
+		if mounts, err = listMounts(); err != nil {
+			return exitCode(err)
+		}
+	}
+
+	if c.Bool("json") {
+		if mounts == nil {
+			mounts = []*MountStatus{}
+		}
+		json.NewEncoder(os.Stdout).Encode(mounts)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "MOUNTPOINT\tCONTAINER\tPID\tCACHE(MB)\tFILES\tPENDING\tUNRECOVERABLE")
+		for _, m := range mounts {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n",
+				m.MountPoint, m.Container, m.Pid, m.CacheBytes/1024/1024, m.CacheFiles, m.PendingUploads, m.UnrecoverableUploads)
+		}
+		w.Flush()
+	}
+
+	if len(mounts) == 0 {
+		return EXIT_NOT_MOUNTED
+	}
+	return EXIT_OK
+}
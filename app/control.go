@@ -0,0 +1,266 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/mapper"
+)
+
+// Commands of the control socket
+const (
+	CONTROL_STATUS = "status"
+	CONTROL_UMOUNT = "umount"
+)
+
+// The time to wait for the response except draining uploads.
+const CONTROL_TIMEOUT = 10 * time.Second
+
+type controlRequest struct {
+	Command string        `json:"command"`
+	Timeout time.Duration `json:"timeout,omitempty"` // CONTROL_UMOUNT only
+	Force   bool          `json:"force,omitempty"`   // CONTROL_UMOUNT only
+}
+
+type controlResponse struct {
+	Status  *MountStatus `json:"status,omitempty"`
+	Pending []string     `json:"pending,omitempty"` // uploads that were not finished by CONTROL_UMOUNT
+	Error   string       `json:"error,omitempty"`
+}
+
+// MountStatus is the state of a running swiftfs process.
+type MountStatus struct {
+	MountPoint           string `json:"mountpoint"`
+	Container            string `json:"container"`
+	Pid                  int    `json:"pid"`
+	CacheDirectory       string `json:"cache_directory"`
+	CacheBytes           int64  `json:"cache_bytes"`
+	CacheFiles           int    `json:"cache_files"`
+	PendingUploads       int    `json:"pending_uploads"`
+	UnrecoverableUploads int    `json:"unrecoverable_uploads"`
+}
+
+// controlDirectory returns the directory of the control sockets of the user.
+func controlDirectory() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", config.APP_NAME, os.Getuid()))
+}
+
+// controlSocketPath returns the path of the control socket for the mountpoint.
+func controlSocketPath(mountpoint string) string {
+	sum := sha1.Sum([]byte(mountpoint))
+	return filepath.Join(controlDirectory(), hex.EncodeToString(sum[:])[:16]+".sock")
+}
+
+// controlServer answers the requests of "swiftfs status" and "swiftfs umount" to the daemon process.
+type controlServer struct {
+	conf     *config.Config
+	fs       fileSystem
+	mapper   *mapper.ObjectMapper
+	server   *fuse.Server
+	listener net.Listener
+	wg       sync.WaitGroup // requests in progress
+}
+
+func listenControl(conf *config.Config, fs fileSystem, m *mapper.ObjectMapper, server *fuse.Server) (*controlServer, error) {
+	if err := os.MkdirAll(controlDirectory(), 0700); err != nil {
+		return nil, err
+	}
+
+	path := controlSocketPath(conf.MountPoint)
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("Another swiftfs process is listening on %s", path)
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &controlServer{
+		conf:     conf,
+		fs:       fs,
+		mapper:   m,
+		server:   server,
+		listener: l,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// close stops listening, and waits for the responses in progress, e.g. the response of CONTROL_UMOUNT.
+func (s *controlServer) close() {
+	if s == nil {
+		return
+	}
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *controlServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *controlServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	var req controlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Warnf("[control] Invalid request %v", err)
+		return
+	}
+	log.Debugf("[control] %s", req.Command)
+
+	res := &controlResponse{}
+	switch req.Command {
+	case CONTROL_STATUS:
+		res.Status = s.status()
+
+	case CONTROL_UMOUNT:
+		res.Pending, res.Error = s.umount(req)
+
+	default:
+		res.Error = fmt.Sprintf("Unknown command %s", req.Command)
+	}
+
+	json.NewEncoder(conn).Encode(res)
+}
+
+// umount unmounts only after the local changes were uploaded, same as the shutdown on SIGTERM.
+// New files are refused while uploading, and accepted again if the unmount was refused or failed.
+func (s *controlServer) umount(req controlRequest) (pending []string, errmsg string) {
+	deadline := time.Now().Add(req.Timeout)
+	released := s.fs.Shutdown(req.Timeout)
+	pending = s.mapper.DrainUploads(deadline.Sub(time.Now()))
+
+	if !req.Force && len(pending) > 0 {
+		errmsg = fmt.Sprintf("%d uploads are pending", len(pending))
+	} else if !req.Force && !released {
+		errmsg = "Some files are still uploading on release"
+	} else if err := s.server.Unmount(); err != nil {
+		errmsg = err.Error()
+	}
+
+	if errmsg != "" {
+		s.fs.Resume()
+	}
+	return pending, errmsg
+}
+
+func (s *controlServer) status() *MountStatus {
+	bytes, files := s.mapper.CacheUsage()
+	return &MountStatus{
+		MountPoint:           s.conf.MountPoint,
+		Container:            s.conf.ContainerName,
+		Pid:                  os.Getpid(),
+		CacheDirectory:       s.conf.MountCacheDirectory(),
+		CacheBytes:           bytes,
+		CacheFiles:           files,
+		PendingUploads:       len(s.mapper.PendingUploads()),
+		UnrecoverableUploads: len(s.mapper.UnrecoverableUploads()),
+	}
+}
+
+// errNotMounted means that no swiftfs process answers on the socket.
+type errNotMounted struct {
+	path string
+}
+
+func (e *errNotMounted) Error() string {
+	return fmt.Sprintf("%s is not mounted by swiftfs", e.path)
+}
+
+// sendControl sends the request to the process that listens on the socket.
+func sendControl(path string, req *controlRequest) (*controlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, CONTROL_TIMEOUT)
+	if err != nil {
+		return nil, &errNotMounted{path: path}
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(req.Timeout + CONTROL_TIMEOUT))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	res := &controlResponse{}
+	if err = json.NewDecoder(conn).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// mountStatus returns the status of the swiftfs process of the mountpoint.
+func mountStatus(mountpoint string) (*MountStatus, error) {
+	res, err := sendControl(controlSocketPath(mountpoint), &controlRequest{Command: CONTROL_STATUS})
+	if err != nil {
+		if _, ok := err.(*errNotMounted); ok {
+			return nil, &errNotMounted{path: mountpoint}
+		}
+		return nil, err
+	} else if res.Error != "" {
+		return nil, fmt.Errorf("%s", res.Error)
+	}
+	return res.Status, nil
+}
+
+// listMounts returns the status of all swiftfs processes of the user.
+// Sockets of the processes that exited are removed.
+func listMounts() ([]*MountStatus, error) {
+	infos, err := ioutil.ReadDir(controlDirectory())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	mounts := []*MountStatus{}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".sock") {
+			continue
+		}
+
+		path := filepath.Join(controlDirectory(), info.Name())
+		res, err := sendControl(path, &controlRequest{Command: CONTROL_STATUS})
+		if _, ok := err.(*errNotMounted); ok {
+			log.Debugf("[control] Remove the stale socket %s", path)
+			os.Remove(path)
+			continue
+		} else if err != nil || res.Status == nil {
+			log.Warnf("[control] No status from %s. %v", path, err)
+			continue
+		}
+		mounts = append(mounts, res.Status)
+	}
+
+	sort.Sort(byMountPoint(mounts))
+	return mounts, nil
+}
+
+type byMountPoint []*MountStatus
+
+func (s byMountPoint) Len() int           { return len(s) }
+func (s byMountPoint) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byMountPoint) Less(i, j int) bool { return s[i].MountPoint < s[j].MountPoint }
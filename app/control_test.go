@@ -0,0 +1,130 @@
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/mapper"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
+)
+
+// testFileSystem records the calls from the control server.
+type testFileSystem struct {
+	shutdown bool
+	resumed  bool
+	hung     bool // Probe() fails
+	lock     sync.Mutex
+}
+
+func (f *testFileSystem) Shutdown(timeout time.Duration) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.shutdown = true
+	return true
+}
+
+func (f *testFileSystem) Resume() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.resumed = true
+}
+
+func (f *testFileSystem) Reconfigure(c *config.Config) {}
+
+func (f *testFileSystem) Probe(timeout time.Duration) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return !f.hung
+}
+
+func TestControl(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-control")
+	defer os.RemoveAll(dir)
+
+	tmpdir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", tmpdir)
+
+	c := config.NewConfig()
+	c.ContainerName = "control-test"
+	c.CreateContainer = true
+	c.MountPoint = filepath.Join(dir, "mnt")
+	c.CacheDirectory = filepath.Join(dir, "cache")
+	c.UploadWorkers = 1
+	c.UploadDelay = time.Hour
+	c.UploadRetries = 0
+
+	storage := fakeswift.New(c.ContainerName)
+	m, err := mapper.NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer m.Close(time.Second)
+
+	fs := &testFileSystem{}
+	ctl, err := listenControl(c, fs, m, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ctl.close()
+
+	// An object waiting for uploading
+	obj, err := m.Create("pending")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f, err := obj.Open(os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.WriteString("data")
+	f.Close()
+	obj.Commit()
+
+	status, err := mountStatus(c.MountPoint)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if status.MountPoint != c.MountPoint || status.Container != c.ContainerName || status.Pid != os.Getpid() {
+		t.Errorf("Invalid status %+v", status)
+	}
+	if status.PendingUploads != 1 {
+		t.Errorf("Invalid pending uploads %d", status.PendingUploads)
+	}
+
+	mounts, err := listMounts()
+	if err != nil || len(mounts) != 1 || mounts[0].MountPoint != c.MountPoint {
+		t.Errorf("Invalid mounts %v %v", mounts, err)
+	}
+
+	// Not unmounted because the upload fails.
+	storage.SetError(fakeswift.OP_UPLOAD, errors.New("upload error"))
+	req := &controlRequest{Command: CONTROL_UMOUNT, Timeout: 100 * time.Millisecond}
+	res, err := sendControl(controlSocketPath(c.MountPoint), req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if res.Error == "" || len(res.Pending) != 1 || res.Pending[0] != "pending" {
+		t.Errorf("Invalid response %+v", res)
+	}
+
+	// New files are refused while uploading, and accepted again after the unmount was refused.
+	fs.lock.Lock()
+	if !fs.shutdown || !fs.resumed {
+		t.Errorf("File system was not shut down and resumed")
+	}
+	fs.lock.Unlock()
+	storage.SetError(fakeswift.OP_UPLOAD, nil)
+
+	if _, err = mountStatus(filepath.Join(dir, "other")); err == nil {
+		t.Errorf("No error for the mountpoint that is not mounted")
+	} else if _, ok := err.(*errNotMounted); !ok {
+		t.Errorf("Invalid error %v", err)
+	}
+}
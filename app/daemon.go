@@ -0,0 +1,218 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hironobu-s/swiftfs/config"
+)
+
+// daemonResult is sent from the daemon process to the parent by the pipe on fd 3,
+// when the container was mounted or failed to mount.
+type daemonResult struct {
+	Pid   int    `json:"pid"`
+	Error string `json:"error,omitempty"`
+}
+
+// daemonize spawns the daemon process, and waits for it to mount up to conf.StartupTimeout.
+// The parent process exits if the daemon process mounted, or returns the reason of the failure.
+// args are the arguments of the parent process, without the program name.
+func daemonize(args []string, conf *config.Config) error {
+	if conf.NoDaemon {
+		return nil
+	}
+
+	log.Debug("Spawn a daemon process")
+
+	// Secrets are sent by the pipe, so that they don't appear in the command-line of the daemon.
+	args = append([]string{"--child"}, removeOptions(args, config.SECRET_OPTIONS)...)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	credr, credw, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.ExtraFiles = []*os.File{w, credr}
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	err = cmd.Start()
+
+	// The pipes are closed when the daemon process exits, since only it has the write ends.
+	w.Close()
+	credr.Close()
+	if err != nil {
+		credw.Close()
+		return fmt.Errorf("Can't start the daemon process. %v", err)
+	}
+
+	err = conf.WriteCredential(credw)
+	credw.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	if err = waitDaemon(cmd, r, conf.StartupTimeout); err != nil {
+		return err
+	}
+
+	log.Debugf("swiftfs started successfully with pid %d", cmd.Process.Pid)
+	os.Exit(EXIT_OK)
+	return nil
+}
+
+// waitDaemon reads the result of the daemon process from r up to timeout.
+// The daemon process is terminated if it doesn't mount in time.
+func waitDaemon(cmd *exec.Cmd, r io.Reader, timeout time.Duration) error {
+	results := make(chan error, 1)
+	go func() {
+		var res daemonResult
+		if err := json.NewDecoder(r).Decode(&res); err != nil {
+			// The pipe is closed without the result if the daemon process exited, e.g. by panic.
+			if werr := cmd.Wait(); werr != nil {
+				err = werr
+			}
+			results <- fmt.Errorf("The daemon process exited before mounting. %v", err)
+		} else if res.Error != "" {
+			results <- fmt.Errorf("%s", res.Error)
+		} else {
+			results <- nil
+		}
+	}()
+
+	select {
+	case err := <-results:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Signal(syscall.SIGTERM)
+		return fmt.Errorf("The daemon process didn't mount within %v", timeout)
+	}
+}
+
+// removeOptions returns args without the options of names and their values.
+// Both "--name=value" and "--name value" forms are removed.
+func removeOptions(args []string, names []string) []string {
+	result := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(result, args[i:]...)
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+
+		removed := false
+		for _, n := range names {
+			if strings.HasPrefix(arg, "-") && name == n {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			result = append(result, arg)
+		} else if !hasValue {
+			i++ // skip the value
+		}
+	}
+	return result
+}
+
+// afterDaemonize detaches the daemon process from the terminal, and reports the result of mounting to the parent.
+func afterDaemonize(err error) {
+	// Ignore SIGCHLD signal
+	signal.Ignore(syscall.SIGCHLD)
+
+	// Redirect STDIN, STDOUT, STDERR to /dev/null.
+	// They are not closed, otherwise the files opened later (e.g. the journal) reuse the descriptors,
+	// and writes to STDERR corrupt them.
+	if null, nerr := os.OpenFile(os.DevNull, os.O_RDWR, 0); nerr == nil {
+		for fd := 0; fd <= 2; fd++ {
+			syscall.Dup2(int(null.Fd()), fd)
+		}
+		null.Close()
+	}
+
+	// Become the process group leader
+	syscall.Setsid()
+
+	// // Clear umask
+	syscall.Umask(022)
+
+	// // chdir for root directory
+	syscall.Chdir("/")
+
+	res := daemonResult{Pid: os.Getpid()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	pipe := os.NewFile(uintptr(3), "pipe")
+	defer pipe.Close()
+	if err = json.NewEncoder(pipe).Encode(res); err != nil {
+		log.Warnf("Can't report to the parent process. %v", err)
+	}
+}
+
+// writePidFile writes the pid of the process to the file, if it is given.
+// The file is replaced by rename(2), so that the readers never see a partial pid.
+func writePidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Can't write the pidfile. %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write the pidfile. %v", err)
+	}
+	return nil
+}
+
+// removePidFile removes the pidfile, unless another process replaced it.
+func removePidFile(path string) {
+	if path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(path)
+}
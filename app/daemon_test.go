@@ -0,0 +1,133 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitDaemon(t *testing.T) {
+	tests := []struct {
+		command string
+		result  string
+		err     string
+		waited  bool // waitDaemon waits for the process
+	}{
+		{"sleep 1", `{"pid":1}`, "", false},
+		{"sleep 1", `{"pid":1,"error":"Container \"c\" not found"}`, `Container "c" not found`, false},
+		{"exit 3", "", "exited before mounting. exit status 3", true},
+		{"sleep 1", "", "didn't mount within", true},
+	}
+
+	for _, test := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		cmd := exec.Command("/bin/sh", "-c", test.command)
+		if err = cmd.Start(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if test.result != "" {
+			w.WriteString(test.result + "\n")
+		}
+		if strings.HasPrefix(test.command, "exit") {
+			w.Close()
+		}
+
+		err = waitDaemon(cmd, r, 100*time.Millisecond)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.command, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: Invalid error %v", test.command, err)
+		}
+
+		w.Close()
+		r.Close()
+		cmd.Process.Kill()
+		if !test.waited {
+			cmd.Wait()
+		}
+	}
+}
+
+// TestAfterDaemonize runs TestAfterDaemonizeHelper in other process, that detaches itself like the daemon.
+func TestAfterDaemonize(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestAfterDaemonizeHelper")
+	cmd.Env = append(os.Environ(), "SWIFTFS_TEST_DAEMONIZE=1")
+	cmd.ExtraFiles = []*os.File{w}
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	w.Close()
+
+	if data, _ := ioutil.ReadAll(r); !strings.Contains(string(data), `"pid"`) {
+		t.Errorf("Invalid result %s", data)
+	}
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("Files opened after daemonizing use the standard descriptors %v", err)
+	}
+}
+
+func TestAfterDaemonizeHelper(t *testing.T) {
+	if os.Getenv("SWIFTFS_TEST_DAEMONIZE") == "" {
+		return
+	}
+
+	afterDaemonize(nil)
+
+	f, err := ioutil.TempFile("", "swiftfs-daemonize")
+	if err != nil {
+		os.Exit(1)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if f.Fd() <= 2 {
+		os.Exit(2)
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-pidfile")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "swiftfs.pid")
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("%v", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("Invalid pidfile %s", data)
+	}
+
+	// The pidfile of another process is kept.
+	ioutil.WriteFile(path, []byte("1\n"), 0644)
+	removePidFile(path)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("The pidfile of another process was removed")
+	}
+
+	writePidFile(path)
+	removePidFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("The pidfile was not removed")
+	}
+
+	// No temporary files are left.
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Errorf("%d files are left", len(infos))
+	}
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/openstack"
+)
+
+// handleReload reloads the config on SIGHUP, and applies the tunables to the running mount.
+// The logfile is opened again, so that logrotate can rotate it.
+func handleReload(ctx *cli.Context, conf *config.Config, swift *openstack.Swift, fs fileSystem) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for s := range sig {
+			log.Debugf("Received %v, reload the config", s)
+			sdNotify("RELOADING=1")
+			if err := conf.Reload(ctx); err != nil {
+				log.Warnf("Can't reload the config, the current one is kept. %v", err)
+			} else {
+				swift.SetRetryPolicy(conf.RetryAttempts, conf.RetryDeadline)
+				fs.Reconfigure(conf)
+				log.Debugf("The config was reloaded")
+			}
+			sdNotify("READY=1")
+		}
+	}()
+}
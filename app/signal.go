@@ -0,0 +1,140 @@
+package app
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/mapper"
+)
+
+// The interval to try unmounting again while the mountpoint is busy.
+const UNMOUNT_RETRY_INTERVAL = time.Second
+
+// fileSystem is the part of the file system that is controlled by the signals, the control socket and the watchdog.
+type fileSystem interface {
+	Shutdown(timeout time.Duration) bool
+	Resume()
+	Reconfigure(c *config.Config)
+
+	// Probe returns false if the file system does not serve requests within timeout.
+	Probe(timeout time.Duration) bool
+}
+
+type shutdown struct {
+	unmounted chan struct{} // closed after unmounting
+	unsynced  bool          // some of the local changes were not uploaded before unmounting
+	deadline  time.Time     // deadline of the shutdown by the signal
+	lock      sync.Mutex
+}
+
+// synced returns false if the shutdown gave up uploading the local changes.
+func (sd *shutdown) synced() bool {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	return !sd.unsynced
+}
+
+// remaining returns the time left until the deadline of the shutdown, or timeout if no signal was received.
+func (sd *shutdown) remaining(timeout time.Duration) time.Duration {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+
+	if sd.deadline.IsZero() {
+		return timeout
+	} else if d := sd.deadline.Sub(time.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// handleShutdown unmounts gracefully on SIGTERM and SIGINT.
+// New files are refused, and the local changes are uploaded up to conf.ShutdownTimeout before unmounting.
+func handleShutdown(conf *config.Config, fs fileSystem, m *mapper.ObjectMapper, server *fuse.Server) *shutdown {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	sd := &shutdown{
+		unmounted: make(chan struct{}),
+	}
+	go func() {
+		s := <-sig
+		log.Warnf("Received %v, shutting down", s)
+		sdNotify("STOPPING=1")
+
+		// The following signals are ignored while shutting down.
+		go func() {
+			for s := range sig {
+				log.Warnf("Received %v, shutdown is in progress", s)
+			}
+		}()
+
+		deadline := time.Now().Add(conf.ShutdownTimeout)
+		sd.lock.Lock()
+		sd.deadline = deadline
+		sd.lock.Unlock()
+
+		ok := fs.Shutdown(conf.ShutdownTimeout)
+		if !ok {
+			log.Warnf("Some files are still uploading on release")
+		}
+
+		if pending := m.DrainUploads(deadline.Sub(time.Now())); len(pending) > 0 {
+			log.Warnf("%d uploads are still pending: %v", len(pending), pending)
+			ok = false
+		}
+		sd.lock.Lock()
+		sd.unsynced = !ok
+		sd.lock.Unlock()
+
+		unmount(conf.MountPoint, server, deadline)
+		close(sd.unmounted)
+	}()
+	return sd
+}
+
+// serve runs the server until it is unmounted.
+func (sd *shutdown) serve(server *fuse.Server) {
+	served := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(served)
+	}()
+
+	select {
+	case <-served:
+	case <-sd.unmounted:
+		// The server may not stop after the lazy unmount while the files are opened.
+		select {
+		case <-served:
+		case <-time.After(UNMOUNT_RETRY_INTERVAL):
+		}
+	}
+}
+
+// unmount unmounts the server. The mountpoint is unmounted lazily if it is still busy at the deadline,
+// so that it is not left as "Transport endpoint is not connected".
+func unmount(mountpoint string, server *fuse.Server, deadline time.Time) {
+	for {
+		err := server.Unmount()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Warnf("Can't unmount %s, unmount lazily. %v", mountpoint, err)
+			break
+		}
+		log.Debugf("Unmount error, try again. %v", err)
+		time.Sleep(UNMOUNT_RETRY_INTERVAL)
+	}
+
+	if out, err := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput(); err != nil {
+		log.Warnf("fusermount -u -z %s: %v %s", mountpoint, err, out)
+	}
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/mapper"
+)
+
+// The interval to check the health of Swift and update STATUS=.
+const NOTIFY_STATUS_INTERVAL = 30 * time.Second
+
+// sdNotify sends the state to systemd by the socket of $NOTIFY_SOCKET (sd_notify(3)).
+// It does nothing when the process is not started by systemd.
+func sdNotify(state string) error {
+	path := os.Getenv(config.ENV_NOTIFY_SOCKET)
+	if path == "" {
+		return nil
+	}
+
+	// "@" means the abstract namespace.
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval to send WATCHDOG=1, that is half of $WATCHDOG_USEC.
+// It returns 0 if the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyReady tells systemd that the container was mounted, then updates the status with the pending uploads
+// and the health of Swift. If the watchdog is enabled, WATCHDOG=1 is sent after the file system passed the probe,
+// so that systemd restarts the process if it is deadlocked. The probe does not access Swift,
+// since a slow Swift must not make systemd kill the mount without uploading the local changes.
+func notifyReady(conf *config.Config, fs fileSystem, m *mapper.ObjectMapper) {
+	if os.Getenv(config.ENV_NOTIFY_SOCKET) == "" {
+		return
+	}
+
+	if err := sdNotify("READY=1\nSTATUS=" + notifyStatus(conf, m, nil)); err != nil {
+		log.Warnf("Can't notify systemd. %v", err)
+		return
+	}
+
+	if interval := watchdogInterval(); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				if !fs.Probe(interval / 2) {
+					log.Warnf("The file system does not respond in %v, skip the watchdog ping", interval/2)
+					continue
+				}
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					log.Warnf("Can't notify systemd. %v", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for range time.Tick(NOTIFY_STATUS_INTERVAL) {
+			_, err := m.Stat()
+			if err != nil {
+				log.Warnf("Health check of Swift failed. %v", err)
+			}
+			if err = sdNotify("STATUS=" + notifyStatus(conf, m, err)); err != nil {
+				log.Warnf("Can't notify systemd. %v", err)
+			}
+		}
+	}()
+}
+
+// notifyStatus returns the status that "systemctl status" shows.
+func notifyStatus(conf *config.Config, m *mapper.ObjectMapper, health error) string {
+	status := fmt.Sprintf("Mounted %s on %s, %d uploads pending", conf.ContainerName, conf.MountPoint, len(m.PendingUploads()))
+	if health != nil {
+		status += ", Swift is not available"
+	}
+	return status
+}
@@ -0,0 +1,209 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/mapper"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
+)
+
+const TEST_UNIT_FILE = "../build/systemd/swiftfs@.service"
+
+func TestNotify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-notify")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	// Nothing is sent without systemd.
+	os.Unsetenv(config.ENV_NOTIFY_SOCKET)
+	if err = sdNotify("READY=1"); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	os.Setenv(config.ENV_NOTIFY_SOCKET, path)
+	defer os.Unsetenv(config.ENV_NOTIFY_SOCKET)
+	if err = sdNotify("READY=1"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Invalid state %s", buf[:n])
+	}
+}
+
+func TestNotifyWatchdog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-notify")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+
+	c := config.NewConfig()
+	c.ContainerName = "watchdog-test"
+	c.CreateContainer = true
+	c.CacheDirectory = filepath.Join(dir, "cache")
+
+	storage := fakeswift.New(c.ContainerName)
+	m, err := mapper.NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer m.Close(time.Second)
+
+	os.Setenv(config.ENV_NOTIFY_SOCKET, path)
+	os.Setenv("WATCHDOG_USEC", "100000")
+	defer os.Unsetenv(config.ENV_NOTIFY_SOCKET)
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	// WATCHDOG=1 is sent while Swift is not available.
+	storage.SetError(fakeswift.OP_GET_CONTAINER, errors.New("unavailable"))
+	fs := &testFileSystem{}
+	notifyReady(c, fs, m)
+
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{"READY=1", "WATCHDOG=1"} {
+		n, err := l.Read(buf)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !strings.HasPrefix(string(buf[:n]), expected) {
+			t.Errorf("Invalid state %s, expected %s", buf[:n], expected)
+		}
+	}
+
+	// WATCHDOG=1 is not sent while the file system does not respond.
+	fs.lock.Lock()
+	fs.hung = true
+	fs.lock.Unlock()
+
+	// Discard the pings sent before.
+	time.Sleep(60 * time.Millisecond)
+	l.SetReadDeadline(time.Now())
+	for {
+		if _, err := l.Read(buf); err != nil {
+			break
+		}
+	}
+
+	l.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		n, err := l.Read(buf)
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(string(buf[:n]), "WATCHDOG=1") {
+			t.Errorf("WATCHDOG=1 was sent while the file system does not respond")
+			break
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "120000000")
+	if d := watchdogInterval(); d != time.Minute {
+		t.Errorf("Invalid interval %v", d)
+	}
+
+	// The watchdog of another process
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d := watchdogInterval(); d != 0 {
+		t.Errorf("Invalid interval %v", d)
+	}
+
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if d := watchdogInterval(); d != 0 {
+		t.Errorf("Invalid interval %v", d)
+	}
+}
+
+// The sample unit file must match the options and the behavior of swiftfs.
+func TestUnitFile(t *testing.T) {
+	f, err := os.Open(TEST_UNIT_FILE)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+
+	unit := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("Invalid line %s", line)
+		}
+		unit[kv[0]] = kv[1]
+	}
+
+	if unit["Type"] != "notify" {
+		t.Errorf("Type must be notify")
+	}
+	if unit["ExecReload"] != "/bin/kill -HUP $MAINPID" {
+		t.Errorf("ExecReload must send SIGHUP")
+	}
+	if unit["WatchdogSec"] == "" {
+		t.Errorf("WatchdogSec is not set")
+	}
+
+	// The mount must be stopped after uploading the local changes.
+	stop, err := strconv.Atoi(unit["TimeoutStopSec"])
+	if err != nil || time.Duration(stop)*time.Second <= config.DEFAULT_SHUTDOWN_TIMEOUT {
+		t.Errorf("TimeoutStopSec must be longer than the shutdown timeout")
+	}
+
+	names := map[string]bool{}
+	for _, f := range config.NewConfig().GetFlags() {
+		var name string
+		switch f := f.(type) {
+		case cli.StringFlag:
+			name = f.Name
+		case cli.IntFlag:
+			name = f.Name
+		case cli.BoolFlag:
+			name = f.Name
+		}
+		for _, n := range strings.Split(name, ",") {
+			names[strings.TrimSpace(n)] = true
+		}
+	}
+	for _, arg := range strings.Fields(unit["ExecStart"]) {
+		if strings.HasPrefix(arg, "--") && !names[strings.TrimPrefix(arg, "--")] {
+			t.Errorf("Unknown option %s in ExecStart", arg)
+		}
+	}
+}
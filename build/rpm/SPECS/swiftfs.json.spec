@@ -19,9 +19,12 @@ chmod +x swiftfs
 %install
 mkdir -p $RPM_BUILD_ROOT/usr/bin
 cp $RPM_BUILD_DIR/swiftfs $RPM_BUILD_ROOT/usr/bin/swiftfs
+mkdir -p $RPM_BUILD_ROOT/sbin
+ln -s /usr/bin/swiftfs $RPM_BUILD_ROOT/sbin/mount.swiftfs
 
 %clean
 rm -rf $RPM_BUILD_ROOT
 
 %files
 /usr/bin/swiftfs
+/sbin/mount.swiftfs
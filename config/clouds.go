@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CLOUDS_YAML = "clouds.yaml"
+	SECURE_YAML = "secure.yaml" // secrets of clouds.yaml in a separate file
+)
+
+// Cloud is an entry of clouds.yaml (os-client-config).
+type Cloud struct {
+	AuthType  string    `yaml:"auth_type"`
+	Auth      CloudAuth `yaml:"auth"`
+	Region    string    `yaml:"region_name"`
+	Interface string    `yaml:"interface"`
+}
+
+type CloudAuth struct {
+	AuthURL    string `yaml:"auth_url"`
+	UserID     string `yaml:"user_id"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	TenantID   string `yaml:"project_id"`
+	TenantName string `yaml:"project_name"`
+
+	UserDomainID      string `yaml:"user_domain_id"`
+	UserDomainName    string `yaml:"user_domain_name"`
+	ProjectDomainID   string `yaml:"project_domain_id"`
+	ProjectDomainName string `yaml:"project_domain_name"`
+
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	Token                       string `yaml:"token"`
+}
+
+type cloudsFile struct {
+	Clouds map[string]Cloud `yaml:"clouds"`
+}
+
+// cloudsFilePath returns the first existing file in the standard search paths of os-client-config.
+// The environment variable overrides them.
+func cloudsFilePath(name string, env string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+
+	dirs := []string{"."}
+	if home := os.Getenv("HOME"); home != "" {
+		dirs = append(dirs, filepath.Join(home, ".config", "openstack"))
+	}
+	dirs = append(dirs, "/etc/openstack")
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func readCloudsFile(path string) (*cloudsFile, error) {
+	f := &cloudsFile{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("Can't read %s. %v", path, err)
+	}
+	return f, nil
+}
+
+// LoadCloud reads the named cloud from clouds.yaml. Values in secure.yaml are merged into it.
+func LoadCloud(name string) (cloud Cloud, err error) {
+	path := cloudsFilePath(CLOUDS_YAML, "OS_CLIENT_CONFIG_FILE")
+	if path == "" {
+		return cloud, fmt.Errorf("%s was not found", CLOUDS_YAML)
+	}
+	log.Debugf("Read the cloud %s from %s", name, path)
+
+	clouds, err := readCloudsFile(path)
+	if err != nil {
+		return cloud, err
+	}
+	cloud, ok := clouds.Clouds[name]
+	if !ok {
+		return cloud, fmt.Errorf("The cloud %s was not found in %s", name, path)
+	}
+
+	if path = cloudsFilePath(SECURE_YAML, "OS_CLIENT_SECURE_FILE"); path != "" {
+		secure, err := readCloudsFile(path)
+		if err != nil {
+			return cloud, err
+		}
+		if s, ok := secure.Clouds[name]; ok {
+			log.Debugf("Read the secrets of the cloud %s from %s", name, path)
+			cloud.merge(s)
+		}
+	}
+	return cloud, nil
+}
+
+// merge overwrites the values with the non-empty values of other.
+func (cloud *Cloud) merge(other Cloud) {
+	merge := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+
+	merge(&cloud.AuthType, other.AuthType)
+	merge(&cloud.Region, other.Region)
+	merge(&cloud.Interface, other.Interface)
+
+	a, o := &cloud.Auth, other.Auth
+	merge(&a.AuthURL, o.AuthURL)
+	merge(&a.UserID, o.UserID)
+	merge(&a.Username, o.Username)
+	merge(&a.Password, o.Password)
+	merge(&a.TenantID, o.TenantID)
+	merge(&a.TenantName, o.TenantName)
+	merge(&a.UserDomainID, o.UserDomainID)
+	merge(&a.UserDomainName, o.UserDomainName)
+	merge(&a.ProjectDomainID, o.ProjectDomainID)
+	merge(&a.ProjectDomainName, o.ProjectDomainName)
+	merge(&a.ApplicationCredentialID, o.ApplicationCredentialID)
+	merge(&a.ApplicationCredentialSecret, o.ApplicationCredentialSecret)
+	merge(&a.Token, o.Token)
+}
+
+// ApplyCloud sets the credential of the cloud to the config.
+func (c *Config) ApplyCloud(cloud Cloud) {
+	a := cloud.Auth
+	c.IdentityEndpoint = a.AuthURL
+	c.UserID = a.UserID
+	c.Username = a.Username
+	c.Password = a.Password
+	c.TenantID = a.TenantID
+	c.TenantName = a.TenantName
+	c.UserDomainID = a.UserDomainID
+	c.UserDomainName = a.UserDomainName
+	c.ProjectDomainID = a.ProjectDomainID
+	c.ProjectDomainName = a.ProjectDomainName
+	c.ApplicationCredentialID = a.ApplicationCredentialID
+	c.ApplicationCredentialSecret = a.ApplicationCredentialSecret
+	c.Token = a.Token
+	c.RegionName = cloud.Region
+	c.EndpointInterface = cloud.Interface
+
+	// Other auth types of Keystone are detected from the credential.
+	if cloud.AuthType == "v1password" {
+		c.AuthType = AUTH_TEMPAUTH
+	}
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const TEST_CLOUDS_YAML = `
+clouds:
+  mycloud:
+    auth:
+      auth_url: https://keystone.example.com/v3
+      username: user
+      project_name: project
+      user_domain_name: Default
+      project_domain_name: Default
+    region_name: RegionOne
+    interface: internal
+  saio:
+    auth_type: v1password
+    auth:
+      auth_url: http://saio:8080/auth/v1.0
+      username: test:tester
+      password: testing
+`
+
+const TEST_SECURE_YAML = `
+clouds:
+  mycloud:
+    auth:
+      password: secret
+`
+
+func TestLoadCloud(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-clouds")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, CLOUDS_YAML), []byte(TEST_CLOUDS_YAML), 0600)
+	ioutil.WriteFile(filepath.Join(dir, SECURE_YAML), []byte(TEST_SECURE_YAML), 0600)
+	os.Setenv("OS_CLIENT_CONFIG_FILE", filepath.Join(dir, CLOUDS_YAML))
+	os.Setenv("OS_CLIENT_SECURE_FILE", filepath.Join(dir, SECURE_YAML))
+	defer os.Unsetenv("OS_CLIENT_CONFIG_FILE")
+	defer os.Unsetenv("OS_CLIENT_SECURE_FILE")
+
+	cloud, err := LoadCloud("mycloud")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c := NewConfig()
+	c.ApplyCloud(cloud)
+	if c.IdentityEndpoint != "https://keystone.example.com/v3" || c.Username != "user" || c.TenantName != "project" {
+		t.Errorf("Invalid credential %+v", c)
+	}
+	if c.UserDomainName != "Default" || c.ProjectDomainName != "Default" {
+		t.Errorf("Invalid domains %s %s", c.UserDomainName, c.ProjectDomainName)
+	}
+	if c.RegionName != "RegionOne" || c.EndpointInterface != "internal" {
+		t.Errorf("Invalid endpoint %s %s", c.RegionName, c.EndpointInterface)
+	}
+	if c.Password != "secret" {
+		t.Errorf("Password in %s was not merged", SECURE_YAML)
+	}
+	if c.AuthStrategy() != AUTH_KEYSTONE {
+		t.Errorf("Invalid auth strategy %s", c.AuthStrategy())
+	}
+
+	cloud, err = LoadCloud("saio")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c = NewConfig()
+	c.ApplyCloud(cloud)
+	if c.AuthStrategy() != AUTH_TEMPAUTH {
+		t.Errorf("Invalid auth strategy %s", c.AuthStrategy())
+	}
+
+	if _, err = LoadCloud("unknown"); err == nil {
+		t.Errorf("LoadCloud() should fail with unknown cloud")
+	}
+}
@@ -1,10 +1,15 @@
 package config
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -13,25 +18,102 @@ import (
 const (
 	APP_VERSION = "0.2.1"
 	APP_NAME    = "swiftfs"
+
+	DEFAULT_SEGMENT_SIZE        = 1024 * 1024 * 1024 // 1GB
+	DEFAULT_SEGMENT_CONCURRENCY = 4
+
+	DEFAULT_READ_AHEAD           = 32 * 1024 * 1024 // 32MB
+	DEFAULT_DOWNLOAD_CONCURRENCY = 4
+
+	DEFAULT_UPLOAD_WORKERS = 4
+	DEFAULT_UPLOAD_DELAY   = time.Second
+	DEFAULT_UPLOAD_RETRIES = 3
+
+	DEFAULT_RETRY_ATTEMPTS = 5
+	DEFAULT_RETRY_DEADLINE = time.Minute
+
+	DEFAULT_SHUTDOWN_TIMEOUT = time.Minute
+	DEFAULT_STARTUP_TIMEOUT  = 30 * time.Second
+
+	DEFAULT_UMASK = "022"
+
+	DEFAULT_CACHE_DIR   = "/tmp/swiftfs"
+	DEFAULT_CACHE_SIZE  = 1024 * 1024 * 1024 // 1GB
+	DEFAULT_CACHE_FILES = 10000
+)
+
+// The environment variable of the socket that systemd waits for the notification on. See Type=notify of systemd.service(5).
+const ENV_NOTIFY_SOCKET = "NOTIFY_SOCKET"
+
+// Authentication strategies
+const (
+	AUTH_KEYSTONE    = "keystone"    // Keystone v2 or v3
+	AUTH_TEMPAUTH    = "tempauth"    // Swift TempAuth (v1.0)
+	AUTH_STORAGE_URL = "storage-url" // Pre-authorized storage URL and token without the identity service
 )
 
 type Config struct {
 	Debug           bool
 	NoDaemon        bool
+	PidFile         string
 	Logfile         *os.File // Need close() after use
+	LogfileName     string
 	MountPoint      string
 	CreateContainer bool
-	TempDirectory   string
+
+	// Mount options. Uid and Gid are the owner of the files, and empty means the user of the process.
+	// Umask(octal) masks the permissions of the files, and empty means "022".
+	ReadOnly   bool
+	AllowOther bool
+	Uid        string
+	Gid        string
+	Umask      string
+
+	// The time that the parent process waits for the daemon process to mount.
+	StartupTimeout time.Duration
+
+	// The config file and the mount section in it. See LoadMountFile().
+	ConfigFile string
+	MountName  string
+
+	// Relative paths in the options are resolved from the working directory at startup,
+	// also when they are reloaded after the daemon process changed it.
+	WorkingDirectory string
+
+	// The directory for local files. Each mount uses its own subdirectory. See MountCacheDirectory().
+	CacheDirectory string
+
+	// Authentication strategy. AuthStrategy() detects it if empty.
+	AuthType string
 
 	// OpenStack credential
 	IdentityEndpoint string
 	UserID           string
 	Username         string
 	Password         string
-	TenantID         string
+	TenantID         string // also known as the project of Keystone v3
 	TenantName       string
 	RegionName       string
 
+	// The interface of the endpoint in the service catalog, public(default), internal or admin.
+	EndpointInterface string
+
+	// Keystone v3 credential
+	UserDomainID                string
+	UserDomainName              string
+	ProjectDomainID             string
+	ProjectDomainName           string
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+	Token                       string // pre-issued token
+
+	// The URL of the Swift account to use with Token (AUTH_STORAGE_URL)
+	StorageURL string
+
+	// Sources of the secrets that the options don't have. See ResolveCredential().
+	PasswordFile     string
+	CredentialHelper string
+
 	// Container
 	ContainerName string
 
@@ -42,6 +124,40 @@ type Config struct {
 	// Time(sec) for internal slice
 	ObjectCacheTime int
 
+	// Files larger than SegmentSize(bytes) are uploaded as Static Large Objects.
+	// Their segments are stored in SegmentContainer. 0 disables segmentation.
+	SegmentSize        int64
+	SegmentContainer   string
+	SegmentConcurrency int
+
+	// The maximum size(bytes) of read-ahead for sequential reads. 0 disables read-ahead.
+	ReadAhead int64
+
+	// The number of range requests that are sent in parallel to download an object.
+	DownloadConcurrency int
+
+	// Local changes are uploaded in background by UploadWorkers workers. 0 means they are uploaded on close.
+	// Changes of the same file within UploadDelay are coalesced into one upload.
+	UploadWorkers int
+	UploadDelay   time.Duration
+	UploadRetries int
+
+	// Requests to Swift that failed with transient errors are sent again up to RetryAttempts times
+	// within RetryDeadline. 0 deadline means no limit.
+	RetryAttempts int
+	RetryDeadline time.Duration
+
+	// Upload local changes on close(2) and fsync(2), and return the errors of uploading to them.
+	SyncUpload bool
+
+	// The time to wait for uploading the local changes on SIGTERM and SIGINT before unmounting.
+	ShutdownTimeout time.Duration
+
+	// Budget of the local files in CacheDirectory. The least recently used files are evicted over it.
+	// 0 means unlimited.
+	CacheSize  int64
+	CacheFiles int
+
 	// This option intend that current process is child process.
 	// See daemonize() function in app/app.go.
 	ChildProcess bool
@@ -49,12 +165,28 @@ type Config struct {
 
 func NewConfig() *Config {
 	config := &Config{
-		ObjectListSize: 1000,
-		TempDirectory:  "/tmp/swiftfs",
-	}
+		ObjectListSize:     1000,
+		Umask:              DEFAULT_UMASK,
+		CacheDirectory:     DEFAULT_CACHE_DIR,
+		SegmentSize:        DEFAULT_SEGMENT_SIZE,
+		SegmentConcurrency: DEFAULT_SEGMENT_CONCURRENCY,
+
+		ReadAhead:           DEFAULT_READ_AHEAD,
+		DownloadConcurrency: DEFAULT_DOWNLOAD_CONCURRENCY,
 
-	os.RemoveAll(config.TempDirectory)
-	os.Mkdir(config.TempDirectory, 0755)
+		UploadWorkers: DEFAULT_UPLOAD_WORKERS,
+		UploadDelay:   DEFAULT_UPLOAD_DELAY,
+		UploadRetries: DEFAULT_UPLOAD_RETRIES,
+
+		RetryAttempts: DEFAULT_RETRY_ATTEMPTS,
+		RetryDeadline: DEFAULT_RETRY_DEADLINE,
+
+		ShutdownTimeout: DEFAULT_SHUTDOWN_TIMEOUT,
+		StartupTimeout:  DEFAULT_STARTUP_TIMEOUT,
+
+		CacheSize:  DEFAULT_CACHE_SIZE,
+		CacheFiles: DEFAULT_CACHE_FILES,
+	}
 
 	return config
 }
@@ -66,6 +198,17 @@ func (c *Config) GetFlags() []cli.Flag {
 	fs := []cli.Flag{
 		cli.HelpFlag,
 
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "The config file (YAML). The options on the command-line take precedence over it",
+			EnvVar: "SWIFTFS_CONFIG",
+		},
+
+		cli.StringFlag{
+			Name:  "mount, m",
+			Usage: "The mount section in the config file. The container and mountpoint arguments may be omitted with it",
+		},
+
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Output debug information",
@@ -76,6 +219,17 @@ func (c *Config) GetFlags() []cli.Flag {
 			Usage: "Start an swiftfs process as a foreground (for debugging)",
 		},
 
+		cli.StringFlag{
+			Name:  "pidfile",
+			Usage: "The file to write the pid of the swiftfs process",
+		},
+
+		cli.IntFlag{
+			Name:  "startup-timeout",
+			Usage: "The time(sec) to wait for the daemon process to mount.",
+			Value: int(DEFAULT_STARTUP_TIMEOUT / time.Second),
+		},
+
 		cli.StringFlag{
 			Name:  "logfile, l",
 			Usage: "The logfile name that appends some information instead of stdout/stderr",
@@ -86,12 +240,132 @@ func (c *Config) GetFlags() []cli.Flag {
 			Usage: "Create a container if is not exist",
 		},
 
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "Mount the container read-only",
+		},
+
+		cli.BoolFlag{
+			Name:  "allow-other",
+			Usage: "Allow other users to access the files. The permissions are checked by uid, gid and umask",
+		},
+
+		cli.StringFlag{
+			Name:  "uid",
+			Usage: "The owner of the files. default is the user of the process.",
+		},
+
+		cli.StringFlag{
+			Name:  "gid",
+			Usage: "The group of the files. default is the group of the process.",
+		},
+
+		cli.StringFlag{
+			Name:  "umask",
+			Usage: "The umask(octal) of the permissions of the files.",
+			Value: DEFAULT_UMASK,
+		},
+
 		cli.IntFlag{
 			Name:  "object-cache-time",
 			Usage: "The time(sec) that how long is internal object-list cached. default is -1, it will not be cached.",
 			Value: -1,
 		},
 
+		cli.IntFlag{
+			Name:  "segment-size",
+			Usage: "The size(MB) of segments. Files larger than this are uploaded as Static Large Objects. 0 disables it.",
+			Value: DEFAULT_SEGMENT_SIZE / 1024 / 1024,
+		},
+
+		cli.StringFlag{
+			Name:  "segment-container",
+			Usage: "The container to store segments of large objects. default is \"CONTAINER-NAME_segments\".",
+		},
+
+		cli.IntFlag{
+			Name:  "segment-concurrency",
+			Usage: "The number of segments that are uploaded in parallel.",
+			Value: DEFAULT_SEGMENT_CONCURRENCY,
+		},
+
+		cli.IntFlag{
+			Name:  "read-ahead",
+			Usage: "The maximum size(MB) of read-ahead for sequential reads. 0 disables it.",
+			Value: DEFAULT_READ_AHEAD / 1024 / 1024,
+		},
+
+		cli.IntFlag{
+			Name:  "download-concurrency",
+			Usage: "The number of range requests that are sent in parallel to download an object.",
+			Value: DEFAULT_DOWNLOAD_CONCURRENCY,
+		},
+
+		cli.IntFlag{
+			Name:  "upload-workers",
+			Usage: "The number of workers that upload local changes in background. 0 means they are uploaded on close.",
+			Value: DEFAULT_UPLOAD_WORKERS,
+		},
+
+		cli.IntFlag{
+			Name:  "upload-delay",
+			Usage: "The delay(ms) before uploading. Changes of the same file within it are coalesced into one upload.",
+			Value: int(DEFAULT_UPLOAD_DELAY / time.Millisecond),
+		},
+
+		cli.IntFlag{
+			Name:  "upload-retries",
+			Usage: "The number of retries when uploading failed.",
+			Value: DEFAULT_UPLOAD_RETRIES,
+		},
+
+		cli.IntFlag{
+			Name:  "retry-attempts",
+			Usage: "The number of attempts of a request to Swift that failed with transient errors.",
+			Value: DEFAULT_RETRY_ATTEMPTS,
+		},
+
+		cli.IntFlag{
+			Name:  "retry-deadline",
+			Usage: "The time limit(sec) of retrying a request. 0 means no limit.",
+			Value: int(DEFAULT_RETRY_DEADLINE / time.Second),
+		},
+
+		cli.BoolFlag{
+			Name:  "sync-upload",
+			Usage: "Upload local changes on close and fsync, and return the errors of uploading to them.",
+		},
+
+		cli.IntFlag{
+			Name:  "shutdown-timeout",
+			Usage: "The time(sec) to wait for uploading local changes on SIGTERM and SIGINT before unmounting.",
+			Value: int(DEFAULT_SHUTDOWN_TIMEOUT / time.Second),
+		},
+
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "The directory for local files. Each mount uses its own subdirectory in it.",
+			Value: DEFAULT_CACHE_DIR,
+		},
+
+		cli.IntFlag{
+			Name:  "cache-size",
+			Usage: "The maximum size(MB) of the local cache. The least recently used files are evicted over it. 0 means unlimited.",
+			Value: DEFAULT_CACHE_SIZE / 1024 / 1024,
+		},
+
+		cli.IntFlag{
+			Name:  "cache-files",
+			Usage: "The maximum number of files in the local cache. 0 means unlimited.",
+			Value: DEFAULT_CACHE_FILES,
+		},
+
+		cli.StringFlag{
+			Name:   "os-cloud",
+			Value:  "",
+			Usage:  "(OpenStack) The cloud in clouds.yaml. Other options take precedence over it",
+			EnvVar: "OS_CLOUD",
+		},
 		cli.StringFlag{
 			Name:   "os-user-id",
 			Value:  "",
@@ -110,6 +384,18 @@ func (c *Config) GetFlags() []cli.Flag {
 			Usage:  "(OpenStack) Password",
 			EnvVar: "OS_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "os-password-file",
+			Value:  "",
+			Usage:  "(OpenStack) The file that has the password in the first line",
+			EnvVar: "OS_PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "credential-helper",
+			Value:  "",
+			Usage:  "(OpenStack) The command that writes the credential to stdout, e.g. \"password=secret\"",
+			EnvVar: "SWIFTFS_CREDENTIAL_HELPER",
+		},
 		cli.StringFlag{
 			Name:   "os-tenant-id",
 			Value:  "",
@@ -122,6 +408,72 @@ func (c *Config) GetFlags() []cli.Flag {
 			Usage:  "(OpenStack) Tenant Name",
 			EnvVar: "OS_TENANT_NAME",
 		},
+		cli.StringFlag{
+			Name:   "os-project-id",
+			Value:  "",
+			Usage:  "(OpenStack) Project Id (same as os-tenant-id)",
+			EnvVar: "OS_PROJECT_ID",
+		},
+		cli.StringFlag{
+			Name:   "os-project-name",
+			Value:  "",
+			Usage:  "(OpenStack) Project Name (same as os-tenant-name)",
+			EnvVar: "OS_PROJECT_NAME",
+		},
+		cli.StringFlag{
+			Name:   "os-user-domain-id",
+			Value:  "",
+			Usage:  "(OpenStack) Domain Id of the user (Keystone v3)",
+			EnvVar: "OS_USER_DOMAIN_ID",
+		},
+		cli.StringFlag{
+			Name:   "os-user-domain-name",
+			Value:  "",
+			Usage:  "(OpenStack) Domain Name of the user (Keystone v3)",
+			EnvVar: "OS_USER_DOMAIN_NAME",
+		},
+		cli.StringFlag{
+			Name:   "os-project-domain-id",
+			Value:  "",
+			Usage:  "(OpenStack) Domain Id of the project (Keystone v3)",
+			EnvVar: "OS_PROJECT_DOMAIN_ID",
+		},
+		cli.StringFlag{
+			Name:   "os-project-domain-name",
+			Value:  "",
+			Usage:  "(OpenStack) Domain Name of the project (Keystone v3)",
+			EnvVar: "OS_PROJECT_DOMAIN_NAME",
+		},
+		cli.StringFlag{
+			Name:   "os-application-credential-id",
+			Value:  "",
+			Usage:  "(OpenStack) Application Credential Id (Keystone v3)",
+			EnvVar: "OS_APPLICATION_CREDENTIAL_ID",
+		},
+		cli.StringFlag{
+			Name:   "os-application-credential-secret",
+			Value:  "",
+			Usage:  "(OpenStack) Application Credential Secret (Keystone v3)",
+			EnvVar: "OS_APPLICATION_CREDENTIAL_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "os-token",
+			Value:  "",
+			Usage:  "(OpenStack) Pre-issued token",
+			EnvVar: "OS_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "os-storage-url",
+			Value:  "",
+			Usage:  "(OpenStack) Pre-authorized storage URL to use with os-token",
+			EnvVar: "OS_STORAGE_URL",
+		},
+		cli.StringFlag{
+			Name:   "os-auth-type",
+			Value:  "",
+			Usage:  "(OpenStack) Authentication strategy, keystone, tempauth or storage-url (detected by default)",
+			EnvVar: "OS_AUTH_TYPE",
+		},
 		cli.StringFlag{
 			Name:   "os-auth-url",
 			Value:  "",
@@ -134,6 +486,12 @@ func (c *Config) GetFlags() []cli.Flag {
 			Usage:  "(OpenStack) Region Name",
 			EnvVar: "OS_REGION_NAME",
 		},
+		cli.StringFlag{
+			Name:   "os-interface",
+			Value:  "",
+			Usage:  "(OpenStack) Interface of the endpoint, public, internal or admin",
+			EnvVar: "OS_INTERFACE",
+		},
 	}
 	flags = append(flags, fs...)
 
@@ -141,34 +499,39 @@ func (c *Config) GetFlags() []cli.Flag {
 }
 
 func (c *Config) SetConfigFromContext(ctx *cli.Context) (err error) {
-	// Debug mode
-	c.Debug = ctx.Bool("debug")
-	if c.Debug {
-		log.SetLevel(log.DebugLevel)
+	if err = c.parseContext(ctx); err != nil {
+		return err
+	}
 
-		// Set LogTransport
+	// Set LogTransport
+	if c.Debug {
 		http.DefaultTransport = &DebugTransport{
 			Transport: http.DefaultTransport,
 		}
+	}
+	return c.SetupLog()
+}
 
-	} else {
-		log.SetLevel(log.WarnLevel)
+// SetupLog sets the level and the output of the log. The logfile is opened again,
+// so that the log is written to the new file after it was rotated.
+func (c *Config) SetupLog() error {
+	// Nothing is changed if the logfile can't be opened.
+	var f *os.File
+	if c.LogfileName != "" {
+		var err error
+		if f, err = os.OpenFile(c.LogfileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+			return err
+		}
 	}
 
-	// No daemon mode
 	if c.Debug {
-		c.NoDaemon = true
+		log.SetLevel(log.DebugLevel)
 	} else {
-		c.NoDaemon = ctx.Bool("no-daemon")
+		log.SetLevel(log.WarnLevel)
 	}
 
-	// logfile
-	var logfile = ctx.String("logfile")
-	if logfile != "" {
-		f, err := os.OpenFile(logfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
+	old := c.Logfile
+	if f != nil {
 		c.Logfile = f
 
 		log.SetFormatter(&LogfileFormatter{})
@@ -181,41 +544,264 @@ func (c *Config) SetConfigFromContext(ctx *cli.Context) (err error) {
 			DisableTimestamp: false,
 			TimestampFormat:  "Jan 02 15:04:05",
 		})
+		log.SetOutput(os.Stderr)
+	}
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// parseContext sets the config from the options without side effects, e.g. the log output.
+func (c *Config) parseContext(ctx *cli.Context) (err error) {
+	if c.WorkingDirectory == "" {
+		if c.WorkingDirectory, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+
+	// Config file
+	// The options in the file are overridden by the command-line options and the environment variables.
+	c.ConfigFile = ctx.String("config")
+	c.MountName = ctx.String("mount")
+
+	var values map[string]string
+	if c.ConfigFile != "" {
+		c.ConfigFile = c.abs(c.ConfigFile)
+		if values, err = LoadMountFile(c.ConfigFile, c.MountName); err != nil {
+			return err
+		}
+	} else if c.MountName != "" {
+		return fmt.Errorf("You must provide config with mount")
+	}
+
+	o, err := newOptions(ctx, c.GetFlags(), values)
+	if err != nil {
+		return err
+	}
+
+	// Debug mode
+	c.Debug = o.Bool("debug")
+
+	// No daemon mode
+	// systemd waits for the notification from the main process instead of its exit.
+	if c.Debug || os.Getenv(ENV_NOTIFY_SOCKET) != "" {
+		c.NoDaemon = true
+	} else {
+		c.NoDaemon = o.Bool("no-daemon")
+	}
+	c.PidFile = o.String("pidfile")
+	if c.PidFile != "" {
+		c.PidFile = c.abs(c.PidFile)
+	}
+	c.StartupTimeout = time.Duration(o.Int("startup-timeout")) * time.Second
+	if c.StartupTimeout <= 0 {
+		return fmt.Errorf("startup-timeout must be greater than 0")
+	}
+
+	// logfile
+	c.LogfileName = o.String("logfile")
+	if c.LogfileName != "" {
+		c.LogfileName = c.abs(c.LogfileName)
 	}
 
 	// Create Container
-	c.CreateContainer = ctx.Bool("create-container")
+	c.CreateContainer = o.Bool("create-container")
+
+	// Mount options
+	c.ReadOnly = o.Bool("read-only")
+	c.AllowOther = o.Bool("allow-other")
+	c.Uid = o.String("uid")
+	c.Gid = o.String("gid")
+	c.Umask = o.String("umask")
+	for name, base := range map[string]int{"uid": 10, "gid": 10, "umask": 8} {
+		if v := o.String(name); v != "" {
+			if _, err = strconv.ParseUint(v, base, 32); err != nil {
+				return fmt.Errorf("Invalid %s %s", name, v)
+			}
+		}
+	}
 
 	// Mountpoint
-	c.MountPoint = ctx.Args()[1]
-	if c.MountPoint, err = filepath.Abs(c.MountPoint); err != nil {
-		return err
+	c.MountPoint = o.Arg(1, MOUNT_MOUNTPOINT)
+	if c.MountPoint == "" {
+		return fmt.Errorf("Mount point was not provided.")
 	}
+	c.MountPoint = c.abs(c.MountPoint)
 	log.Debugf("Mount point: %s", c.MountPoint)
 
 	// OpenStack
-	c.IdentityEndpoint = ctx.String("os-auth-url")
-	if c.IdentityEndpoint == "" {
-		return fmt.Errorf("You must provide os-auth-url")
+	// The credential in clouds.yaml is overridden by the options (including OS_* environment variables).
+	if name := o.String("os-cloud"); name != "" {
+		cloud, err := LoadCloud(name)
+		if err != nil {
+			return err
+		}
+		c.ApplyCloud(cloud)
+	}
+
+	setString := func(dst *string, name string) {
+		if v := o.String(name); v != "" {
+			*dst = v
+		}
+	}
+	setString(&c.IdentityEndpoint, "os-auth-url")
+	setString(&c.StorageURL, "os-storage-url")
+	setString(&c.AuthType, "os-auth-type")
+	setString(&c.UserID, "os-user-id")
+	setString(&c.Username, "os-username")
+	setString(&c.Password, "os-password")
+	setString(&c.TenantID, "os-tenant-id")
+	setString(&c.TenantName, "os-tenant-name")
+	setString(&c.RegionName, "os-region-name")
+	setString(&c.EndpointInterface, "os-interface")
+
+	// Keystone v3
+	setString(&c.TenantID, "os-project-id")
+	setString(&c.TenantName, "os-project-name")
+	setString(&c.UserDomainID, "os-user-domain-id")
+	setString(&c.UserDomainName, "os-user-domain-name")
+	setString(&c.ProjectDomainID, "os-project-domain-id")
+	setString(&c.ProjectDomainName, "os-project-domain-name")
+	setString(&c.ApplicationCredentialID, "os-application-credential-id")
+	setString(&c.ApplicationCredentialSecret, "os-application-credential-secret")
+	setString(&c.Token, "os-token")
+
+	// Secrets
+	c.PasswordFile = o.String("os-password-file")
+	if c.PasswordFile != "" {
+		c.PasswordFile = c.abs(c.PasswordFile)
+	}
+	c.CredentialHelper = o.String("credential-helper")
+
+	switch c.EndpointInterface {
+	case "", "public", "internal", "admin":
+	default:
+		return fmt.Errorf("os-interface must be public, internal or admin")
 	}
 
-	c.UserID = ctx.String("os-user-id")
-	c.Username = ctx.String("os-username")
-	c.Password = ctx.String("os-password")
-	c.TenantID = ctx.String("os-tenant-id")
-	c.TenantName = ctx.String("os-tenant-name")
-	c.RegionName = ctx.String("os-region-name")
+	// The secrets are checked by ResolveCredential() and ReadCredential().
+	switch c.AuthStrategy() {
+	case AUTH_KEYSTONE, AUTH_TEMPAUTH:
+		if c.IdentityEndpoint == "" {
+			return fmt.Errorf("You must provide os-auth-url")
+		}
+	case AUTH_STORAGE_URL:
+		if c.StorageURL == "" {
+			return fmt.Errorf("You must provide os-storage-url")
+		}
+	default:
+		return fmt.Errorf("Unknown os-auth-type %s", c.AuthType)
+	}
 
-	c.ContainerName = ctx.Args()[0]
+	c.ContainerName = o.Arg(0, MOUNT_CONTAINER)
 	if c.ContainerName == "" {
 		return fmt.Errorf("Container name was not provided.")
 	}
 
 	// Object cache time
-	c.ObjectCacheTime = ctx.Int("object-cache-time")
+	c.ObjectCacheTime = o.Int("object-cache-time")
 
 	// Default 1000
 	c.ObjectListSize = 1000
 
+	// Large objects
+	c.SegmentSize = int64(o.Int("segment-size")) * 1024 * 1024
+	c.SegmentContainer = o.String("segment-container")
+	if c.SegmentContainer == "" {
+		c.SegmentContainer = c.ContainerName + "_segments"
+	}
+	c.SegmentConcurrency = o.Int("segment-concurrency")
+	if c.SegmentConcurrency < 1 {
+		return fmt.Errorf("segment-concurrency must be greater than 0")
+	}
+
+	// Downloading
+	c.ReadAhead = int64(o.Int("read-ahead")) * 1024 * 1024
+	if c.ReadAhead < 0 {
+		return fmt.Errorf("read-ahead must not be negative")
+	}
+	c.DownloadConcurrency = o.Int("download-concurrency")
+	if c.DownloadConcurrency < 1 {
+		return fmt.Errorf("download-concurrency must be greater than 0")
+	}
+
+	// Write-back
+	c.UploadWorkers = o.Int("upload-workers")
+	c.UploadDelay = time.Duration(o.Int("upload-delay")) * time.Millisecond
+	c.UploadRetries = o.Int("upload-retries")
+	if c.UploadWorkers < 0 || c.UploadDelay < 0 || c.UploadRetries < 0 {
+		return fmt.Errorf("upload-workers, upload-delay and upload-retries must not be negative")
+	}
+	c.SyncUpload = o.Bool("sync-upload")
+	c.ShutdownTimeout = time.Duration(o.Int("shutdown-timeout")) * time.Second
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown-timeout must not be negative")
+	}
+
+	// Retry
+	c.RetryAttempts = o.Int("retry-attempts")
+	c.RetryDeadline = time.Duration(o.Int("retry-deadline")) * time.Second
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("retry-attempts must be greater than 0")
+	}
+	if c.RetryDeadline < 0 {
+		return fmt.Errorf("retry-deadline must not be negative")
+	}
+
+	// Local cache
+	c.CacheDirectory = o.String("cache-dir")
+	if c.CacheDirectory == "" {
+		c.CacheDirectory = DEFAULT_CACHE_DIR
+	}
+	c.CacheDirectory = c.abs(c.CacheDirectory)
+	c.CacheSize = int64(o.Int("cache-size")) * 1024 * 1024
+	c.CacheFiles = o.Int("cache-files")
+	if c.CacheSize < 0 || c.CacheFiles < 0 {
+		return fmt.Errorf("cache-size and cache-files must not be negative")
+	}
+
 	return nil
 }
+
+// abs returns the absolute path of the path from WorkingDirectory.
+func (c *Config) abs(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(c.WorkingDirectory, path)
+}
+
+// AuthStrategy returns AuthType, or the strategy detected from the options if it is empty.
+// The storage URL means AUTH_STORAGE_URL, and the auth URL ending with "/v1.0" means AUTH_TEMPAUTH.
+func (c *Config) AuthStrategy() string {
+	switch {
+	case c.AuthType != "":
+		return c.AuthType
+	case c.StorageURL != "":
+		return AUTH_STORAGE_URL
+	case strings.HasSuffix(strings.TrimSuffix(c.IdentityEndpoint, "/"), "/v1.0"):
+		return AUTH_TEMPAUTH
+	}
+	return AUTH_KEYSTONE
+}
+
+// MountCacheDirectory returns the subdirectory of CacheDirectory for this mount.
+// It is keyed by the auth URL, tenant and container, so that mounts of different containers never share local files.
+func (c *Config) MountCacheDirectory() string {
+	parts := []string{c.IdentityEndpoint, c.TenantID, c.TenantName, c.ContainerName}
+
+	// There is no auth URL with the pre-authorized storage URL.
+	if c.StorageURL != "" {
+		parts = append(parts, c.StorageURL)
+	}
+
+	// Projects of the same name in different domains
+	if c.ProjectDomainID != "" || c.ProjectDomainName != "" {
+		parts = append(parts, c.ProjectDomainID, c.ProjectDomainName)
+	}
+	key := strings.Join(parts, "\x00")
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.CacheDirectory, hex.EncodeToString(sum[:])[:16])
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/codegangsta/cli"
 )
@@ -52,12 +53,16 @@ func TestSetConfigFromContext(t *testing.T) {
 		"--logfile=log.txt",
 		"--create-container",
 		"--object-cache-time=10",
+		"--cache-dir=testcache",
+		"--retry-attempts=3",
+		"--retry-deadline=10",
 		"testcontainer",
 		"testmountpoint",
 	}
 	defer os.Remove("log.txt")
 
 	set.Parse(testargs)
+	wd, _ := os.Getwd()
 	c := cli.NewContext(nil, set, nil)
 	if err := config.SetConfigFromContext(c); err != nil {
 		t.Errorf("%v", err)
@@ -90,4 +95,55 @@ func TestSetConfigFromContext(t *testing.T) {
 	if filepath.Base(config.MountPoint) != "testmountpoint" {
 		t.Errorf("The config parameter \"MountPoint\" is incorrect [%s]", filepath.Base(config.MountPoint))
 	}
+
+	if config.CacheDirectory != filepath.Join(wd, "testcache") {
+		t.Errorf("The config parameter \"CacheDirectory\" is incorrect [%s]", config.CacheDirectory)
+	}
+
+	if config.RetryAttempts != 3 || config.RetryDeadline != 10*time.Second {
+		t.Errorf("The config parameters of retry are incorrect [%d, %v]", config.RetryAttempts, config.RetryDeadline)
+	}
+}
+
+func TestMountCacheDirectory(t *testing.T) {
+	c1 := &Config{CacheDirectory: "/cache", IdentityEndpoint: "http://keystone/v2.0", TenantName: "t", ContainerName: "c"}
+	c2 := &Config{CacheDirectory: "/cache", IdentityEndpoint: "http://keystone/v2.0", TenantName: "t", ContainerName: "c"}
+
+	if filepath.Dir(c1.MountCacheDirectory()) != "/cache" {
+		t.Errorf("Mount cache directory %s is not in CacheDirectory", c1.MountCacheDirectory())
+	}
+	if c1.MountCacheDirectory() != c2.MountCacheDirectory() {
+		t.Errorf("Mount cache directory of the same mount is not stable")
+	}
+
+	for _, c := range []*Config{
+		{CacheDirectory: "/cache", IdentityEndpoint: "http://keystone/v2.0", TenantName: "t", ContainerName: "other"},
+		{CacheDirectory: "/cache", IdentityEndpoint: "http://keystone/v2.0", TenantName: "other", ContainerName: "c"},
+		{CacheDirectory: "/cache", IdentityEndpoint: "http://other/v2.0", TenantName: "t", ContainerName: "c"},
+		{CacheDirectory: "/cache", IdentityEndpoint: "http://keystone/v2.0", TenantName: "t", ContainerName: "c", ProjectDomainName: "other"},
+		{CacheDirectory: "/cache", StorageURL: "http://swift/v1/AUTH_t", ContainerName: "c"},
+	} {
+		if c.MountCacheDirectory() == c1.MountCacheDirectory() {
+			t.Errorf("Mount cache directory collided %+v", c)
+		}
+	}
+}
+
+func TestAuthStrategy(t *testing.T) {
+	tests := []struct {
+		c        *Config
+		strategy string
+	}{
+		{&Config{IdentityEndpoint: "http://keystone/v2.0"}, AUTH_KEYSTONE},
+		{&Config{IdentityEndpoint: "http://keystone/v3"}, AUTH_KEYSTONE},
+		{&Config{IdentityEndpoint: "http://saio:8080/auth/v1.0"}, AUTH_TEMPAUTH},
+		{&Config{StorageURL: "http://saio:8080/v1/AUTH_test", Token: "token"}, AUTH_STORAGE_URL},
+		{&Config{IdentityEndpoint: "http://saio:8080/auth", AuthType: AUTH_TEMPAUTH}, AUTH_TEMPAUTH},
+	}
+
+	for _, test := range tests {
+		if s := test.c.AuthStrategy(); s != test.strategy {
+			t.Errorf("AuthStrategy() of %+v = %s", test.c, s)
+		}
+	}
 }
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Options that have secrets. They are not passed to the daemon process by the command-line. See Credential.
+var SECRET_OPTIONS = []string{
+	"os-password",
+	"os-application-credential-secret",
+	"os-token",
+}
+
+// Credential is the part of the config that is sent to the daemon process by the pipe instead of the command-line.
+type Credential struct {
+	UserID                      string `json:"user_id,omitempty"`
+	Username                    string `json:"username,omitempty"`
+	Password                    string `json:"password,omitempty"`
+	ApplicationCredentialID     string `json:"application_credential_id,omitempty"`
+	ApplicationCredentialSecret string `json:"application_credential_secret,omitempty"`
+	Token                       string `json:"token,omitempty"`
+}
+
+func (c *Config) Credential() Credential {
+	return Credential{
+		UserID:                      c.UserID,
+		Username:                    c.Username,
+		Password:                    c.Password,
+		ApplicationCredentialID:     c.ApplicationCredentialID,
+		ApplicationCredentialSecret: c.ApplicationCredentialSecret,
+		Token:                       c.Token,
+	}
+}
+
+func (c *Config) SetCredential(cred Credential) {
+	c.UserID = cred.UserID
+	c.Username = cred.Username
+	c.Password = cred.Password
+	c.ApplicationCredentialID = cred.ApplicationCredentialID
+	c.ApplicationCredentialSecret = cred.ApplicationCredentialSecret
+	c.Token = cred.Token
+}
+
+// WriteCredential sends the credential to the daemon process.
+func (c *Config) WriteCredential(w io.Writer) error {
+	return json.NewEncoder(w).Encode(c.Credential())
+}
+
+// ReadCredential receives the credential from the parent process.
+func (c *Config) ReadCredential(r io.Reader) error {
+	var cred Credential
+	if err := json.NewDecoder(r).Decode(&cred); err != nil {
+		return fmt.Errorf("Can't read the credential from the parent process. %v", err)
+	}
+	c.SetCredential(cred)
+	return c.checkCredential()
+}
+
+// ResolveCredential reads the secrets that the options don't have,
+// from the password file, the credential helper, then the terminal.
+func (c *Config) ResolveCredential() error {
+	if c.PasswordFile != "" {
+		data, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+		// Only the first line, without the newline
+		c.Password = strings.SplitN(string(data), "\n", 2)[0]
+		c.Password = strings.TrimSuffix(c.Password, "\r")
+	}
+
+	if c.CredentialHelper != "" {
+		if err := c.runCredentialHelper(); err != nil {
+			return err
+		}
+	}
+
+	if c.needPassword() && isTerminal(os.Stdin) {
+		password, err := promptPassword(fmt.Sprintf("Password for %s%s: ", c.Username, c.UserID))
+		if err != nil {
+			return err
+		}
+		c.Password = password
+	}
+	return c.checkCredential()
+}
+
+func (c *Config) checkCredential() error {
+	if c.ApplicationCredentialID != "" && c.ApplicationCredentialSecret == "" {
+		return fmt.Errorf("You must provide os-application-credential-secret with os-application-credential-id")
+	}
+	if c.AuthStrategy() == AUTH_STORAGE_URL && c.Token == "" {
+		return fmt.Errorf("You must provide os-token with os-storage-url")
+	}
+	return nil
+}
+
+// needPassword returns true if the auth strategy uses the password and it is not given.
+func (c *Config) needPassword() bool {
+	if c.Password != "" {
+		return false
+	}
+
+	switch c.AuthStrategy() {
+	case AUTH_TEMPAUTH:
+		return true
+	case AUTH_KEYSTONE:
+		return c.ApplicationCredentialID == "" && c.Token == ""
+	}
+	return false
+}
+
+// runCredentialHelper runs the command by the shell, like the credential helper of git.
+// The command reads "key=value" lines of the auth URL and user from stdin,
+// and writes the lines of the credential to stdout. Only the values that the options don't have are used.
+//
+//	username=user
+//	password=secret
+func (c *Config) runCredentialHelper() error {
+	log.Debugf("Run the credential helper: %s", c.CredentialHelper)
+
+	var input bytes.Buffer
+	for _, kv := range [][2]string{
+		{"auth_url", c.IdentityEndpoint},
+		{"storage_url", c.StorageURL},
+		{"user_id", c.UserID},
+		{"username", c.Username},
+		{"project_id", c.TenantID},
+		{"project_name", c.TenantName},
+		{"application_credential_id", c.ApplicationCredentialID},
+	} {
+		if kv[1] != "" {
+			fmt.Fprintf(&input, "%s=%s\n", kv[0], kv[1])
+		}
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", c.CredentialHelper)
+	cmd.Stdin = &input
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("The credential helper failed. %v", err)
+	}
+
+	values := map[string]*string{
+		"user_id":                       &c.UserID,
+		"username":                      &c.Username,
+		"password":                      &c.Password,
+		"application_credential_id":     &c.ApplicationCredentialID,
+		"application_credential_secret": &c.ApplicationCredentialSecret,
+		"token":                         &c.Token,
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if dst, ok := values[kv[0]]; ok && *dst == "" {
+			*dst = kv[1]
+		}
+	}
+	return scanner.Err()
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// promptPassword reads a line from the terminal without echo.
+func promptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return "", err
+	}
+	defer stty("echo")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
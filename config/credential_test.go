@@ -0,0 +1,79 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-credential")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "password")
+	ioutil.WriteFile(path, []byte("secret\nignored\n"), 0600)
+
+	c := NewConfig()
+	c.IdentityEndpoint = "https://keystone.example.com/v3"
+	c.Username = "user"
+	c.PasswordFile = path
+	if err := c.ResolveCredential(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.Password != "secret" {
+		t.Errorf("Invalid password %s", c.Password)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	c := NewConfig()
+	c.IdentityEndpoint = "https://keystone.example.com/v3"
+	c.Username = "user"
+
+	// The helper gets the user, and the values of the options are not overwritten.
+	c.CredentialHelper = `grep -q "^username=user$" && printf 'username=other\npassword=secret\nunknown=1\n'`
+	if err := c.ResolveCredential(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.Username != "user" || c.Password != "secret" {
+		t.Errorf("Invalid credential %s %s", c.Username, c.Password)
+	}
+
+	c.Password = ""
+	c.CredentialHelper = "exit 1"
+	if err := c.ResolveCredential(); err == nil {
+		t.Errorf("The failure of the credential helper is ignored")
+	}
+
+	// The secret of the application credential is required.
+	c = NewConfig()
+	c.IdentityEndpoint = "https://keystone.example.com/v3"
+	c.ApplicationCredentialID = "app-cred-id"
+	c.CredentialHelper = "true"
+	if err := c.ResolveCredential(); err == nil {
+		t.Errorf("No error without the secret of the application credential")
+	}
+}
+
+func TestWriteCredential(t *testing.T) {
+	c := NewConfig()
+	c.Username = "user"
+	c.Password = "secret"
+	c.Token = "token"
+
+	var buf bytes.Buffer
+	if err := c.WriteCredential(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	child := NewConfig()
+	child.IdentityEndpoint = "https://keystone.example.com/v3"
+	if err := child.ReadCredential(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if child.Credential() != c.Credential() {
+		t.Errorf("Invalid credential %+v", child.Credential())
+	}
+}
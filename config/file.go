@@ -0,0 +1,202 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// Keys of the mount section that are given as the arguments on the command-line.
+const (
+	MOUNT_CONTAINER  = "container"
+	MOUNT_MOUNTPOINT = "mountpoint"
+)
+
+// The config file is YAML. The top-level keys are the options without "--", and they apply to all mounts.
+// Each section of "mounts" has the options, the container and the mountpoint of a mount.
+//
+//	cache-dir: /var/cache/swiftfs
+//	os-cloud: mycloud
+//	mounts:
+//	  media:
+//	    container: media
+//	    mountpoint: /mnt/media
+//	    cache-size: 4096
+type mountFile struct {
+	Options map[string]interface{}            `yaml:",inline"`
+	Mounts  map[string]map[string]interface{} `yaml:"mounts"`
+}
+
+// LoadMountFile reads the config file, and returns the values of the mount section merged into the top-level values.
+// Only the top-level values are returned if mount is empty.
+func LoadMountFile(path string, mount string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &mountFile{}
+	if err = yaml.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("Can't read %s. %v", path, err)
+	}
+
+	values := map[string]string{}
+	set := func(options map[string]interface{}) error {
+		for k, v := range options {
+			switch v.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("The value of %s in %s must be a scalar", k, path)
+			case nil:
+				continue
+			}
+			values[k] = fmt.Sprint(v)
+		}
+		return nil
+	}
+
+	if err = set(f.Options); err != nil {
+		return nil, err
+	}
+	delete(values, MOUNT_CONTAINER)
+	delete(values, MOUNT_MOUNTPOINT)
+
+	if mount != "" {
+		section, ok := f.Mounts[mount]
+		if !ok {
+			return nil, fmt.Errorf("The mount %s was not found in %s", mount, path)
+		}
+		if err = set(section); err != nil {
+			return nil, err
+		}
+	}
+
+	// Secrets should not be readable by other users.
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Warnf("%s is accessible by other users. Use mode 0600 if it has credentials", path)
+	}
+	return values, nil
+}
+
+// options reads the values of the options from the command-line, the environment variables and the config file,
+// in that order of precedence.
+type options struct {
+	ctx    *cli.Context
+	values map[string]string // from the config file
+
+	names   map[string][]string // all names of each option, e.g. "logfile" and "l"
+	envVars map[string]string
+}
+
+func newOptions(ctx *cli.Context, flags []cli.Flag, values map[string]string) (*options, error) {
+	o := &options{
+		ctx:     ctx,
+		values:  values,
+		names:   map[string][]string{},
+		envVars: map[string]string{},
+	}
+
+	kinds := map[string]string{
+		MOUNT_CONTAINER:  "string",
+		MOUNT_MOUNTPOINT: "string",
+	}
+	for _, f := range flags {
+		var name, env, kind string
+		switch f := f.(type) {
+		case cli.StringFlag:
+			name, env, kind = f.Name, f.EnvVar, "string"
+		case cli.IntFlag:
+			name, env, kind = f.Name, f.EnvVar, "int"
+		case cli.BoolFlag:
+			name, env, kind = f.Name, f.EnvVar, "bool"
+		default:
+			continue
+		}
+
+		names := strings.Split(name, ",")
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+		}
+		o.names[names[0]] = names
+		o.envVars[names[0]] = env
+		kinds[names[0]] = kind
+	}
+
+	// The config file can't select another config file.
+	delete(kinds, "config")
+	delete(kinds, "mount")
+
+	for k, v := range values {
+		var err error
+		switch kinds[k] {
+		case "string":
+		case "int":
+			_, err = strconv.Atoi(v)
+		case "bool":
+			_, err = strconv.ParseBool(v)
+		default:
+			return nil, fmt.Errorf("Unknown option %s in the config file", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of %s in the config file. %v", k, err)
+		}
+	}
+	return o, nil
+}
+
+// isSet returns true if the option is given on the command-line or by the environment variable.
+func (o *options) isSet(name string) bool {
+	for _, n := range o.names[name] {
+		if o.ctx.IsSet(n) {
+			return true
+		}
+	}
+	if env := o.envVars[name]; env != "" && os.Getenv(env) != "" {
+		return true
+	}
+	return false
+}
+
+func (o *options) fromFile(name string) (string, bool) {
+	if o.isSet(name) {
+		return "", false
+	}
+	v, ok := o.values[name]
+	return v, ok
+}
+
+func (o *options) String(name string) string {
+	if v, ok := o.fromFile(name); ok {
+		return v
+	}
+	return o.ctx.String(name)
+}
+
+func (o *options) Int(name string) int {
+	if v, ok := o.fromFile(name); ok {
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return o.ctx.Int(name)
+}
+
+func (o *options) Bool(name string) bool {
+	if v, ok := o.fromFile(name); ok {
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return o.ctx.Bool(name)
+}
+
+// Arg returns the i-th argument, or the value of key in the mount section if it is not given.
+func (o *options) Arg(i int, key string) string {
+	if args := o.ctx.Args(); len(args) > i {
+		return args[i]
+	}
+	return o.values[key]
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codegangsta/cli"
+)
+
+const TEST_MOUNT_FILE = `
+cache-dir: /var/cache/swiftfs
+os-auth-url: https://keystone.example.com/v3
+upload-workers: 2
+mounts:
+  media:
+    container: media
+    mountpoint: /mnt/media
+    os-password: secret
+    upload-workers: 8
+    sync-upload: true
+  backup:
+    container: backup
+    mountpoint: /mnt/backup
+`
+
+func TestLoadMountFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-config")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "swiftfs.yaml")
+	ioutil.WriteFile(path, []byte(TEST_MOUNT_FILE), 0600)
+
+	values, err := LoadMountFile(path, "media")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	expected := map[string]string{
+		"cache-dir":      "/var/cache/swiftfs",
+		"os-auth-url":    "https://keystone.example.com/v3",
+		"upload-workers": "8",
+		"sync-upload":    "true",
+		"os-password":    "secret",
+		MOUNT_CONTAINER:  "media",
+		MOUNT_MOUNTPOINT: "/mnt/media",
+	}
+	if len(values) != len(expected) {
+		t.Errorf("Invalid values %v", values)
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Errorf("%s is %s, expected %s", k, values[k], v)
+		}
+	}
+
+	// Only the top-level values without the mount
+	values, err = LoadMountFile(path, "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if values["upload-workers"] != "2" || values[MOUNT_CONTAINER] != "" || values["os-password"] != "" {
+		t.Errorf("Invalid values %v", values)
+	}
+
+	if _, err = LoadMountFile(path, "unknown"); err == nil {
+		t.Errorf("Unknown mount section was loaded")
+	}
+}
+
+func TestMountFileOptions(t *testing.T) {
+	config := NewConfig()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	ctx := cli.NewContext(nil, set, nil)
+
+	invalid := []map[string]string{
+		{"unknown-option": "1"},
+		{"upload-workers": "many"},
+		{"sync-upload": "maybe"},
+		{"config": "/etc/swiftfs.yaml"},
+	}
+	for _, values := range invalid {
+		if _, err := newOptions(ctx, config.GetFlags(), values); err == nil {
+			t.Errorf("Invalid values %v are accepted", values)
+		}
+	}
+
+	values := map[string]string{
+		"upload-workers": "8",
+		"sync-upload":    "true",
+		"os-password":    "secret",
+		MOUNT_CONTAINER:  "media",
+	}
+	if _, err := newOptions(ctx, config.GetFlags(), values); err != nil {
+		t.Errorf("%v", err)
+	}
+}
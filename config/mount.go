@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The name of the mount helper that mount(8) runs for the type "swiftfs". It is a link to swiftfs.
+const MOUNT_HELPER = "mount.swiftfs"
+
+// Mount options that are not passed to swiftfs.
+var IGNORED_MOUNT_OPTIONS = []string{
+	"defaults", "rw", "auto", "noauto", "user", "nouser", "users", "owner", "group", "_netdev", "nofail",
+	"exec", "noexec", "suid", "nosuid", "dev", "nodev", "async", "atime", "noatime", "relatime", "strictatime",
+	"diratime", "nodiratime",
+}
+
+// MountHelperArgs converts the arguments of the mount helper to the arguments of swiftfs.
+//
+//	mount.swiftfs CONTAINER MOUNTPOINT [-sfnv] [-o OPTIONS] [-t TYPE]
+//
+// OPTIONS are separated by commas. "ro", "allow_other", "uid", "gid", "umask", "sync" and
+// the options of swiftfs("config=/etc/swiftfs.yaml" or "cache_size=4096") are passed as the options of swiftfs.
+// fake is true if mount(8) asks not to mount with -f.
+func MountHelperArgs(args []string) (result []string, fake bool, err error) {
+	var options []string
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" || arg == "-t":
+			if i+1 >= len(args) {
+				return nil, false, fmt.Errorf("%s requires a value", arg)
+			}
+			if arg == "-o" {
+				options = append(options, strings.Split(args[i+1], ",")...)
+			}
+			i++
+
+		case strings.HasPrefix(arg, "-o"):
+			options = append(options, strings.Split(arg[2:], ",")...)
+
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// -s(sloppy), -n(no mtab) and -v(verbose) don't change swiftfs.
+			if strings.Contains(arg, "f") {
+				fake = true
+			}
+
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) != 2 {
+		return nil, false, fmt.Errorf("Usage: %s CONTAINER MOUNTPOINT [-o OPTIONS]", MOUNT_HELPER)
+	}
+
+	for _, option := range options {
+		if option == "" || isIgnoredMountOption(option) {
+			continue
+		}
+
+		kv := strings.SplitN(option, "=", 2)
+		name := strings.Replace(kv[0], "_", "-", -1)
+		switch name {
+		case "ro":
+			name = "read-only"
+		case "sync":
+			name = "sync-upload"
+		}
+
+		if len(kv) == 2 {
+			result = append(result, fmt.Sprintf("--%s=%s", name, kv[1]))
+		} else {
+			result = append(result, "--"+name)
+		}
+	}
+
+	return append(result, positional...), fake, nil
+}
+
+func isIgnoredMountOption(option string) bool {
+	// "x-systemd.automount" and "comment=..." are for other programs.
+	if strings.HasPrefix(option, "x-") || strings.HasPrefix(option, "comment=") {
+		return true
+	}
+	for _, o := range IGNORED_MOUNT_OPTIONS {
+		if option == o {
+			return true
+		}
+	}
+	return false
+}
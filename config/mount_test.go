@@ -0,0 +1,50 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMountHelperArgs(t *testing.T) {
+	args := []string{
+		"mycontainer", "/mnt/data",
+		"-o", "rw,_netdev,config=/etc/swiftfs.yaml,allow_other,uid=1000,gid=1000,umask=027,x-systemd.automount",
+		"-n",
+		"-oro,cache_size=4096",
+	}
+	result, fake, err := MountHelperArgs(args)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fake {
+		t.Errorf("fake is true without -f")
+	}
+
+	expected := []string{
+		"--config=/etc/swiftfs.yaml",
+		"--allow-other",
+		"--uid=1000",
+		"--gid=1000",
+		"--umask=027",
+		"--read-only",
+		"--cache-size=4096",
+		"mycontainer",
+		"/mnt/data",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Invalid args %v", result)
+	}
+
+	if _, fake, _ = MountHelperArgs([]string{"-sf", "mycontainer", "/mnt/data"}); !fake {
+		t.Errorf("fake is false with -f")
+	}
+
+	for _, invalid := range [][]string{
+		{"mycontainer"},
+		{"mycontainer", "/mnt/data", "-o"},
+	} {
+		if _, _, err = MountHelperArgs(invalid); err == nil {
+			t.Errorf("No error for %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// Reload reads the options again from the command-line, the environment variables and the config file,
+// and applies the tunables that can be changed while mounted. They are the object cache time, the log,
+// the retry policy, the write-back, the budget of the local cache, read-ahead and the download concurrency.
+// Changes of the other options are ignored with warnings, since they need remounting.
+func (c *Config) Reload(ctx *cli.Context) error {
+	n := NewConfig()
+	n.WorkingDirectory = c.WorkingDirectory
+	if err := n.parseContext(ctx); err != nil {
+		return err
+	}
+
+	for _, name := range c.fixedChanges(n) {
+		log.Warnf("%s was changed, but it is not applied until remounting", name)
+	}
+
+	// Files are uploaded on close without the workers. It can't be switched while mounted.
+	if (c.UploadWorkers == 0) != (n.UploadWorkers == 0) {
+		log.Warnf("upload-workers was changed from or to 0, but it is not applied until remounting")
+		n.UploadWorkers = c.UploadWorkers
+	}
+
+	// The new values are applied after the logfile was opened, the current config is kept if it failed.
+	n.Logfile = c.Logfile
+	if err := n.SetupLog(); err != nil {
+		return err
+	}
+	c.Logfile = n.Logfile
+
+	c.Debug = n.Debug
+	c.LogfileName = n.LogfileName
+	c.ObjectCacheTime = n.ObjectCacheTime
+	c.RetryAttempts = n.RetryAttempts
+	c.RetryDeadline = n.RetryDeadline
+	c.UploadWorkers = n.UploadWorkers
+	c.UploadDelay = n.UploadDelay
+	c.UploadRetries = n.UploadRetries
+	c.CacheSize = n.CacheSize
+	c.CacheFiles = n.CacheFiles
+	c.ReadAhead = n.ReadAhead
+	c.DownloadConcurrency = n.DownloadConcurrency
+	return nil
+}
+
+// fixedChanges returns the names of the options that are changed in n, and can't be changed while mounted.
+// The credential is not compared, since the secrets of the daemon process are not in its options.
+func (c *Config) fixedChanges(n *Config) []string {
+	fixed := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"container", c.ContainerName, n.ContainerName},
+		{"mountpoint", c.MountPoint, n.MountPoint},
+		{"os-auth-url", c.IdentityEndpoint, n.IdentityEndpoint},
+		{"os-storage-url", c.StorageURL, n.StorageURL},
+		{"os-region-name", c.RegionName, n.RegionName},
+		{"os-interface", c.EndpointInterface, n.EndpointInterface},
+		{"create-container", c.CreateContainer, n.CreateContainer},
+		{"read-only", c.ReadOnly, n.ReadOnly},
+		{"allow-other", c.AllowOther, n.AllowOther},
+		{"uid", c.Uid, n.Uid},
+		{"gid", c.Gid, n.Gid},
+		{"umask", c.Umask, n.Umask},
+		{"segment-size", c.SegmentSize, n.SegmentSize},
+		{"segment-container", c.SegmentContainer, n.SegmentContainer},
+		{"segment-concurrency", c.SegmentConcurrency, n.SegmentConcurrency},
+		{"sync-upload", c.SyncUpload, n.SyncUpload},
+		{"shutdown-timeout", c.ShutdownTimeout, n.ShutdownTimeout},
+		{"pidfile", c.PidFile, n.PidFile},
+		{"cache-dir", c.CacheDirectory, n.CacheDirectory},
+	}
+
+	names := []string{}
+	for _, f := range fixed {
+		if f.old != f.new {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/codegangsta/cli"
+)
+
+func TestSetupLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-log")
+	defer os.RemoveAll(dir)
+
+	c := NewConfig()
+	c.LogfileName = filepath.Join(dir, "swiftfs.log")
+	if err := c.SetupLog(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer c.SetupLog()
+	defer func() { c.LogfileName = "" }()
+
+	// The logfile is opened again after it was rotated.
+	os.Rename(c.LogfileName, c.LogfileName+".1")
+	if err := c.SetupLog(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	opened, err := c.Logfile.Stat()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	created, err := os.Stat(c.LogfileName)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !os.SameFile(opened, created) {
+		t.Errorf("The log is not written to the new file")
+	}
+}
+
+func TestFixedChanges(t *testing.T) {
+	c := NewConfig()
+	c.ContainerName = "container"
+	c.MountPoint = "/mnt/swift"
+
+	n := NewConfig()
+	n.ContainerName = "container"
+	n.MountPoint = "/mnt/other"
+	n.ReadOnly = true
+	n.ObjectCacheTime = 10
+	n.CacheSize = 1
+
+	if names := c.fixedChanges(n); !reflect.DeepEqual(names, []string{"mountpoint", "read-only"}) {
+		t.Errorf("Invalid changes %v", names)
+	}
+}
+
+func TestReloadLogfileError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-log")
+	defer os.RemoveAll(dir)
+
+	c := NewConfig()
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range c.GetFlags() {
+		f.Apply(set)
+	}
+	set.Parse([]string{
+		"--object-cache-time=10",
+		"--logfile=" + filepath.Join(dir, "not-exist", "swiftfs.log"),
+		"testcontainer",
+		"testmountpoint",
+	})
+
+	// Nothing is applied if the logfile can't be opened.
+	if err := c.Reload(cli.NewContext(nil, set, nil)); err == nil {
+		t.Fatalf("Reload should fail when the logfile can't be opened")
+	}
+	if c.ObjectCacheTime == 10 || c.LogfileName != "" {
+		t.Errorf("New values were applied %d %s", c.ObjectCacheTime, c.LogfileName)
+	}
+}
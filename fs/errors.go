@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hironobu-s/swiftfs/openstack"
+)
+
+// uploadStatus converts the error of uploading to the status returned to applications.
+func uploadStatus(err error) fuse.Status {
+	if err == nil {
+		return fuse.OK
+	}
+
+	switch openstack.StatusCode(err) {
+	case http.StatusRequestEntityTooLarge:
+		// The quota of the account or container is exceeded.
+		return fuse.Status(syscall.EDQUOT)
+	case 507:
+		// Insufficient Storage
+		return fuse.Status(syscall.ENOSPC)
+	}
+
+	// Errors of the local file
+	switch err.(type) {
+	case syscall.Errno, *os.PathError, *os.SyscallError:
+		return fuse.ToStatus(err)
+	}
+	return fuse.EIO
+}
@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rackspace/gophercloud"
+)
+
+func TestUploadStatus(t *testing.T) {
+	httpError := func(code int) error {
+		return &gophercloud.UnexpectedResponseCodeError{Method: "PUT", Expected: []int{201}, Actual: code}
+	}
+
+	tests := []struct {
+		err    error
+		status fuse.Status
+	}{
+		{nil, fuse.OK},
+		{httpError(413), fuse.Status(syscall.EDQUOT)},
+		{httpError(507), fuse.Status(syscall.ENOSPC)},
+		{httpError(500), fuse.EIO},
+		{errors.New("connection reset"), fuse.EIO},
+		{&os.PathError{Op: "open", Path: "file", Err: syscall.ENOSPC}, fuse.Status(syscall.ENOSPC)},
+	}
+
+	for _, test := range tests {
+		if status := uploadStatus(test.err); status != test.status {
+			t.Errorf("uploadStatus(%v) = %v, want %v", test.err, status, test.status)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"os/user"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -21,9 +22,21 @@ const (
 type objectFileSystem struct {
 	containerName   string
 	createContainer bool
+	readAhead       int64
+	syncUpload      bool
+	readOnly        bool
+
+	// Attributes of the files
+	owner    fuse.Owner
+	fileMode uint32
+	dirMode  uint32
 
 	mapper *mapper.ObjectMapper
 
+	// New files are refused after Shutdown(). releases counts the files uploading on release.
+	shutdown bool
+	releases *inflight
+
 	lock sync.Mutex
 
 	pathfs.FileSystem
@@ -33,14 +46,45 @@ func NewObjectFileSystem(c *config.Config, mapper *mapper.ObjectMapper) *objectF
 	fs := &objectFileSystem{
 		containerName:   c.ContainerName,
 		createContainer: c.CreateContainer,
+		readAhead:       c.ReadAhead,
+		syncUpload:      c.SyncUpload,
+		readOnly:        c.ReadOnly,
 		mapper:          mapper,
+		releases:        newInflight(),
 		lock:            sync.Mutex{},
 
 		FileSystem: pathfs.NewDefaultFileSystem(),
 	}
+
+	// The values were validated by config.
+	fs.owner = fs.getCurrentUser()
+	if uid, err := strconv.ParseUint(c.Uid, 10, 32); err == nil {
+		fs.owner.Uid = uint32(uid)
+	}
+	if gid, err := strconv.ParseUint(c.Gid, 10, 32); err == nil {
+		fs.owner.Gid = uint32(gid)
+	}
+
+	umask, err := strconv.ParseUint(c.Umask, 8, 32)
+	if err != nil {
+		umask, _ = strconv.ParseUint(config.DEFAULT_UMASK, 8, 32)
+	}
+	fs.fileMode = 0666 &^ uint32(umask)
+	fs.dirMode = 0777 &^ uint32(umask)
+
 	return fs
 }
 
+// Reconfigure applies the tunables of the reloaded config to the file system and the mapper.
+// Files that are already opened keep the read-ahead window.
+func (fs *objectFileSystem) Reconfigure(c *config.Config) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.readAhead = c.ReadAhead
+	fs.mapper.Reconfigure(c)
+}
+
 // ------------------------
 
 func (fs *objectFileSystem) String() string {
@@ -75,7 +119,7 @@ func (fs *objectFileSystem) getCurrentUser() fuse.Owner {
 
 func (fs *objectFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	var attr *fuse.Attr
-	var owner = fs.getCurrentUser()
+	var owner = fs.owner
 
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
@@ -85,7 +129,7 @@ func (fs *objectFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.A
 
 		attr = &fuse.Attr{
 			Owner: owner,
-			Mode:  fuse.S_IFDIR | 0755,
+			Mode:  fuse.S_IFDIR | fs.dirMode,
 			Size:  4096,
 		}
 		return attr, fuse.OK
@@ -97,31 +141,51 @@ func (fs *objectFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.A
 		return nil, fuse.ENOENT
 	}
 
+	size, mtime := obj.Attr()
 	switch obj.Type {
 	case mapper.FILE:
-		log.Debugf("GetAttr: %s(File) size:%d", obj.Name, obj.Size)
+		log.Debugf("GetAttr: %s(File) size:%d", obj.Name, size)
 
 		attr = &fuse.Attr{
 			Owner:  owner,
-			Mode:   fuse.S_IFREG | 0644,
-			Size:   obj.Size,
-			Blocks: obj.Size / BLCOK_SIZE,
-			Mtime:  uint64(obj.Mtime.Unix()),
+			Mode:   fuse.S_IFREG | fs.fileMode,
+			Size:   size,
+			Blocks: size / BLCOK_SIZE,
+			Mtime:  uint64(mtime.Unix()),
 		}
 
 	case mapper.DIRECTORY:
-		log.Debugf("GetAttr: %s(Directory) size:%d", obj.Name, obj.Size)
+		log.Debugf("GetAttr: %s(Directory) size:%d", obj.Name, size)
 		attr = &fuse.Attr{
 			Owner:  owner,
-			Mode:   fuse.S_IFDIR | 0755,
-			Size:   obj.Size,
-			Blocks: obj.Size / BLCOK_SIZE,
-			Mtime:  uint64(obj.Mtime.Unix()),
+			Mode:   fuse.S_IFDIR | fs.dirMode,
+			Size:   size,
+			Blocks: size / BLCOK_SIZE,
+			Mtime:  uint64(mtime.Unix()),
 		}
 	}
 	return attr, fuse.OK
 }
 
+// Probe checks that the file system still serves requests, e.g. for the watchdog of systemd.
+// It returns false if GetAttr of the root and the pending uploads of the mapper are not returned within timeout.
+// The object storage is not accessed.
+func (fs *objectFileSystem) Probe(timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		_, st := fs.GetAttr("", nil)
+		fs.mapper.PendingUploads()
+		done <- st.Ok()
+	}()
+
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (fs *objectFileSystem) OpenDir(dirname string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
 	log.Debugf("OpenDir: %s", dirname)
 
@@ -150,9 +214,17 @@ func (fs *objectFileSystem) OpenDir(dirname string, context *fuse.Context) (c []
 func (fs *objectFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	log.Debugf("Create: %s, flags: %d", name, flags)
 
+	if fs.readOnly {
+		return nil, fuse.EROFS
+	}
+
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
+	if fs.shutdown {
+		return nil, fuse.EBUSY
+	}
+
 	// Add to mapper
 	obj, err := fs.mapper.Create(name)
 	if err != nil {
@@ -161,6 +233,9 @@ func (fs *objectFileSystem) Create(name string, flags uint32, mode uint32, conte
 	}
 
 	file := NewObjectFile(name, obj)
+	file.readAhead = newReadAhead(fs.readAhead)
+	file.syncUpload = fs.syncUpload
+	file.releases = fs.releases
 	if err := file.OpenLocalFile(flags, mode); err != nil {
 		log.Warnf("Create: OpenLocalFile() error %v", err)
 		return file, fuse.EIO
@@ -172,9 +247,17 @@ func (fs *objectFileSystem) Create(name string, flags uint32, mode uint32, conte
 func (fs *objectFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	log.Debugf("Open: %s, flags: %d", name, flags)
 
+	if fs.readOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, fuse.EROFS
+	}
+
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
+	if fs.shutdown {
+		return nil, fuse.EBUSY
+	}
+
 	obj, ok := fs.mapper.Get(name)
 	if !ok {
 		log.Warnf("Open: %s(no entry)", name)
@@ -186,6 +269,9 @@ func (fs *objectFileSystem) Open(name string, flags uint32, context *fuse.Contex
 	}
 
 	file := NewObjectFile(name, obj)
+	file.readAhead = newReadAhead(fs.readAhead)
+	file.syncUpload = fs.syncUpload
+	file.releases = fs.releases
 	if err := file.OpenLocalFile(flags, 0); err != nil {
 		log.Warnf("Open() error %v", err)
 		return file, fuse.EIO
@@ -197,6 +283,10 @@ func (fs *objectFileSystem) Open(name string, flags uint32, context *fuse.Contex
 func (fs *objectFileSystem) Unlink(name string, context *fuse.Context) (code fuse.Status) {
 	log.Debugf("Unlink: %s", name)
 
+	if fs.readOnly {
+		return fuse.EROFS
+	}
+
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
@@ -245,6 +335,10 @@ func (fs *objectFileSystem) Link(oldName string, newName string, context *fuse.C
 func (fs *objectFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
 	log.Debugf("Mkdir %s", name)
 
+	if fs.readOnly {
+		return fuse.EROFS
+	}
+
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 	_, err := fs.mapper.Mkdir(name)
@@ -258,6 +352,10 @@ func (fs *objectFileSystem) Mkdir(name string, mode uint32, context *fuse.Contex
 func (fs *objectFileSystem) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
 	log.Debugf("Rename from %s to %s", oldName, newName)
 
+	if fs.readOnly {
+		return fuse.EROFS
+	}
+
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
@@ -273,6 +371,10 @@ func (fs *objectFileSystem) Rename(oldName string, newName string, context *fuse
 func (fs *objectFileSystem) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
 	log.Debugf("Rmdir %s", name)
 
+	if fs.readOnly {
+		return fuse.EROFS
+	}
+
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
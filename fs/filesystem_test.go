@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -13,7 +14,7 @@ import (
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/hironobu-s/swiftfs/config"
 	"github.com/hironobu-s/swiftfs/mapper"
-	"github.com/hironobu-s/swiftfs/openstack"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
 )
 
 // --------------- utility funcs ---------------
@@ -57,6 +58,16 @@ func getContext() *fuse.Context {
 var fs *objectFileSystem
 var server *fuse.Server
 
+// Local files of the tests are in the temporary directory.
+var testDir string
+
+func TestMain(m *testing.M) {
+	testDir, _ = ioutil.TempDir("", "swiftfs-fs")
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
 func mount() error {
 	var err error
 
@@ -75,17 +86,14 @@ func mount() error {
 		CreateContainer: true,
 		Debug:           true,
 		NoDaemon:        true,
+		CacheDirectory:  filepath.Join(testDir, "mount"),
 	}
 
-	// swift
-	swift := openstack.NewSwift(config)
-	if err = swift.Auth(); err != nil {
-		return err
-	}
-	swift.DeleteContainer()
+	// storage
+	storage := fakeswift.New(TEST_CONTAINER_NAME)
 
 	// mapper
-	mapper, err := mapper.NewObjectMapper(config)
+	mapper, err := mapper.NewObjectMapper(config, storage)
 	if err != nil {
 		return err
 	}
@@ -119,17 +127,22 @@ func mount() error {
 // --------------- tests ---------------
 
 func TestNewObjectFileSystem(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-fs")
+	defer os.RemoveAll(dir)
+
 	config := &config.Config{
 		MountPoint:      TEST_MOUNTPOINT,
 		ContainerName:   TEST_CONTAINER_NAME,
 		CreateContainer: true,
+		CacheDirectory:  dir,
 	}
 
-	mapper, err := mapper.NewObjectMapper(config)
+	mapper, err := mapper.NewObjectMapper(config, fakeswift.New(TEST_CONTAINER_NAME))
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
+	defer mapper.Close(time.Second)
 	f := NewObjectFileSystem(config, mapper)
 
 	if f.containerName != TEST_CONTAINER_NAME {
@@ -141,6 +154,133 @@ func TestNewObjectFileSystem(t *testing.T) {
 	}
 }
 
+func TestReadOnly(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-fs")
+	defer os.RemoveAll(dir)
+
+	config := &config.Config{
+		MountPoint:      TEST_MOUNTPOINT,
+		ContainerName:   TEST_CONTAINER_NAME,
+		CreateContainer: true,
+		ReadOnly:        true,
+		Uid:             "1000",
+		Gid:             "2000",
+		Umask:           "027",
+		CacheDirectory:  dir,
+	}
+
+	mapper, err := mapper.NewObjectMapper(config, fakeswift.New(TEST_CONTAINER_NAME))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer mapper.Close(time.Second)
+	f := NewObjectFileSystem(config, mapper)
+
+	c := getContext()
+	if _, st := f.Create("readonly", 0, 0600, c); st != fuse.EROFS {
+		t.Errorf("Create returns %v", st)
+	}
+	if st := f.Mkdir("readonly", 0755, c); st != fuse.EROFS {
+		t.Errorf("Mkdir returns %v", st)
+	}
+	if _, st := f.Open("readonly", uint32(os.O_WRONLY), c); st != fuse.EROFS {
+		t.Errorf("Open for writing returns %v", st)
+	}
+
+	attr, st := f.GetAttr("", c)
+	if !st.Ok() {
+		t.Fatalf("GetAttr fail")
+	}
+	if attr.Owner.Uid != 1000 || attr.Owner.Gid != 2000 {
+		t.Errorf("Invalid owner %v", attr.Owner)
+	}
+	if attr.Mode != fuse.S_IFDIR|0750 {
+		t.Errorf("Invalid mode %o", attr.Mode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-fs")
+	defer os.RemoveAll(dir)
+
+	config := &config.Config{
+		MountPoint:      TEST_MOUNTPOINT,
+		ContainerName:   TEST_CONTAINER_NAME,
+		CreateContainer: true,
+		CacheDirectory:  dir,
+	}
+
+	mapper, err := mapper.NewObjectMapper(config, fakeswift.New(TEST_CONTAINER_NAME))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer mapper.Close(time.Second)
+	f := NewObjectFileSystem(config, mapper)
+
+	c := getContext()
+	file, st := f.Create("shutdown", 0, 0600, c)
+	if !st.Ok() {
+		t.Fatalf("Create returns %v", st)
+	}
+
+	// The file in release is waited for.
+	f.releases.begin()
+	if f.Shutdown(50 * time.Millisecond) {
+		t.Errorf("Shutdown should time out while releasing")
+	}
+	f.releases.end()
+	file.Release()
+	if !f.Shutdown(time.Second) {
+		t.Errorf("Shutdown timed out")
+	}
+
+	// New files are refused.
+	if _, st := f.Create("shutdown-new", 0, 0600, c); st != fuse.EBUSY {
+		t.Errorf("Create returns %v", st)
+	}
+	if _, st := f.Open("shutdown", uint32(os.O_RDONLY), c); st != fuse.EBUSY {
+		t.Errorf("Open returns %v", st)
+	}
+
+	// Files are accepted again after resuming.
+	f.Resume()
+	if file, st := f.Open("shutdown", uint32(os.O_RDONLY), c); !st.Ok() {
+		t.Errorf("Open returns %v after resuming", st)
+	} else {
+		file.Release()
+	}
+}
+
+func TestProbe(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-fs")
+	defer os.RemoveAll(dir)
+
+	config := &config.Config{
+		MountPoint:      TEST_MOUNTPOINT,
+		ContainerName:   TEST_CONTAINER_NAME,
+		CreateContainer: true,
+		CacheDirectory:  dir,
+	}
+
+	mapper, err := mapper.NewObjectMapper(config, fakeswift.New(TEST_CONTAINER_NAME))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer mapper.Close(time.Second)
+	f := NewObjectFileSystem(config, mapper)
+
+	if !f.Probe(time.Second) {
+		t.Errorf("Probe failed")
+	}
+
+	// The file system that does not serve requests, e.g. deadlocked.
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Probe(50 * time.Millisecond) {
+		t.Errorf("Probe should fail while the lock is held")
+	}
+}
+
 // Mount filesystem
 func TestBeforeAll(t *testing.T) {
 	mount()
@@ -20,6 +20,9 @@ type ObjectFile struct {
 	object     mapper.Object
 	localfile  *os.File
 	needUpload bool
+	readAhead  *readAhead
+	syncUpload bool
+	releases   *inflight // See objectFileSystem.Shutdown()
 
 	//mapper *mapper.ObjectMapper
 	lock sync.Mutex
@@ -33,6 +36,7 @@ func NewObjectFile(name string, obj mapper.Object) *ObjectFile {
 		object:     obj,
 		lock:       sync.Mutex{},
 		needUpload: false,
+		readAhead:  newReadAhead(0),
 
 		File: nodefs.NewDefaultFile(),
 	}
@@ -63,6 +67,16 @@ func (o *ObjectFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse
 	if off == 0 {
 	}
 
+	// Start read-ahead before fetching the blocks to read, they are downloaded concurrently.
+	if start, size := o.readAhead.next(off, int64(len(buf))); size > 0 {
+		go o.prefetch(start, size)
+	}
+
+	if err := o.object.Fetch(off, int64(len(buf))); err != nil {
+		log.Warnf("[objectfile] Fetch() error %s %v", o.name, err)
+		return nil, fuse.EIO
+	}
+
 	o.lock.Lock()
 	res = fuse.ReadResultFd(o.localfile.Fd(), off, len(buf))
 	o.lock.Unlock()
@@ -70,11 +84,23 @@ func (o *ObjectFile) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse
 	return res, fuse.OK
 }
 
+func (o *ObjectFile) prefetch(off int64, size int64) {
+	log.Debugf("[objectfile] Read ahead %s offset=%d bytes=%d", o.name, off, size)
+	if err := o.object.Fetch(off, size); err != nil {
+		log.Debugf("[objectfile] Read ahead error %s %v", o.name, err)
+	}
+}
+
 func (o *ObjectFile) Write(data []byte, off int64) (uint32, fuse.Status) {
 	log.Debugf("[objectfile] Write %s offset=%d, length=%d", o.name, off, len(data))
 	if off == 0 {
 	}
 
+	if err := o.object.FetchForWrite(off, int64(len(data))); err != nil {
+		log.Warnf("[objectfile] Fetch() error %s %v", o.name, err)
+		return 0, fuse.EIO
+	}
+
 	o.lock.Lock()
 	n, err := o.localfile.WriteAt(data, off)
 	o.needUpload = true
@@ -90,14 +116,23 @@ func (o *ObjectFile) Write(data []byte, off int64) (uint32, fuse.Status) {
 func (o *ObjectFile) Release() {
 	log.Debugf("[objectfile] Release %s", o.name)
 
-	if o.localfile != nil && o.needUpload {
-		o.lock.Lock()
-		if err := o.object.Upload(); err != nil {
-			log.Warnf("[objectfile] Upload() error %s %v", o.name, err)
-		}
+	o.releases.begin()
+	defer o.releases.end()
 
+	if o.localfile != nil {
+		o.lock.Lock()
 		o.localfile.Close()
+		needUpload := o.needUpload
+		o.needUpload = false
 		o.lock.Unlock()
+
+		// Uploading is done without the lock. It may be queued to upload in background.
+		if needUpload {
+			if err := o.object.Commit(); err != nil {
+				log.Warnf("[objectfile] Commit() error %s %v", o.name, err)
+			}
+		}
+		o.object.Release()
 	}
 }
 
@@ -109,11 +144,36 @@ func (o *ObjectFile) Flush() fuse.Status {
 			log.Warnf("[objectfile] Flush() error %s %v", o.name, err)
 			return fuse.ToStatus(err)
 		}
+		if o.syncUpload {
+			return o.upload()
+		}
 	}
 
 	return fuse.OK
 }
 
+// upload uploads the changes synchronously, so that the errors are returned to close(2) and fsync(2).
+// If it failed, the changes are committed again on release.
+func (o *ObjectFile) upload() fuse.Status {
+	o.lock.Lock()
+	needUpload := o.needUpload
+	o.needUpload = false
+	o.lock.Unlock()
+
+	if !needUpload {
+		return fuse.OK
+	}
+
+	if err := o.object.Sync(); err != nil {
+		log.Warnf("[objectfile] Sync() error %s %v", o.name, err)
+		o.lock.Lock()
+		o.needUpload = true
+		o.lock.Unlock()
+		return uploadStatus(err)
+	}
+	return fuse.OK
+}
+
 func (o *ObjectFile) Fsync(flags int) (code fuse.Status) {
 	log.Debugf("[objectfile] Fsync %s", o.name)
 
@@ -121,6 +181,12 @@ func (o *ObjectFile) Fsync(flags int) (code fuse.Status) {
 	r := fuse.ToStatus(syscall.Fsync(int(o.localfile.Fd())))
 	o.lock.Unlock()
 
+	if r == fuse.OK && o.syncUpload {
+		if err := o.object.Flush(); err != nil {
+			return fuse.ToStatus(err)
+		}
+		return o.upload()
+	}
 	return r
 }
 
@@ -132,6 +198,13 @@ func (o *ObjectFile) Truncate(size uint64) fuse.Status {
 	o.needUpload = true
 	o.lock.Unlock()
 
+	if r == fuse.OK {
+		if err := o.object.Truncated(int64(size)); err != nil {
+			log.Warnf("[objectfile] Truncated() error %s %v", o.name, err)
+			return fuse.EIO
+		}
+	}
+
 	return r
 }
 
@@ -1,16 +1,21 @@
 package fs
 
 import (
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hironobu-s/swiftfs/config"
 	"github.com/hironobu-s/swiftfs/mapper"
-	"github.com/hironobu-s/swiftfs/openstack"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
+	"github.com/rackspace/gophercloud"
 )
 
 const (
@@ -31,18 +36,14 @@ func TestSetup(t *testing.T) {
 	c.CreateContainer = true
 	c.Debug = true
 	c.NoDaemon = true
+	c.CacheDirectory = filepath.Join(testDir, "objectfile")
 
-	// initialize swift and uplaod testdata
-	swift := openstack.NewSwift(c)
-	if err = swift.Auth(); err != nil {
-		t.Fatalf("%v", err)
-	}
-
-	swift.DeleteContainer()
-	swift.CreateContainer()
+	// initialize storage
+	storage := fakeswift.New(TEST_CONTAINER_NAME)
+	storage.CreateContainer()
 
 	// mapper
-	mp, err := mapper.NewObjectMapper(c)
+	mp, err := mapper.NewObjectMapper(c, storage)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -147,3 +148,50 @@ func TestWrite(t *testing.T) {
 		t.Fatalf("Write() returns invalid data, %s", read)
 	}
 }
+
+func TestSyncUpload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-sync")
+	defer os.RemoveAll(dir)
+
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.CacheDirectory = dir
+
+	storage := fakeswift.New(TEST_CONTAINER_NAME)
+	storage.CreateContainer()
+
+	mp, err := mapper.NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer mp.Close(time.Second)
+
+	obj, err := mp.Create("sync-upload")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	file := NewObjectFile("sync-upload", obj)
+	file.syncUpload = true
+	if err = file.OpenLocalFile(uint32(os.O_RDWR), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Release()
+
+	if _, code := file.Write([]byte(TEST_DATA), 0); !code.Ok() {
+		t.Fatalf("Write() error %v", code)
+	}
+
+	// The error of uploading is returned to close(2).
+	storage.SetError(fakeswift.OP_UPLOAD, &gophercloud.UnexpectedResponseCodeError{Method: "PUT", Expected: []int{201}, Actual: 413})
+	if code := file.Flush(); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("Flush() returns %v", code)
+	}
+
+	storage.SetError(fakeswift.OP_UPLOAD, nil)
+	if code := file.Fsync(0); !code.Ok() {
+		t.Errorf("Fsync() error %v", code)
+	}
+	if data, _ := storage.Data("sync-upload"); string(data) != TEST_DATA {
+		t.Errorf("Changes were not uploaded by fsync")
+	}
+}
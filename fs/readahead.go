@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"sync"
+)
+
+const (
+	// The first window of read-ahead. It is doubled while reads are sequential.
+	READ_AHEAD_MIN_WINDOW = 1024 * 1024 // 1MB
+)
+
+// readAhead detects sequential reads of a file and decides the range to prefetch.
+type readAhead struct {
+	maxWindow int64
+	window    int64
+
+	// The offset that the next sequential read starts from.
+	nextOffset int64
+
+	// The end of the range that has been prefetched.
+	prefetched int64
+
+	lock sync.Mutex
+}
+
+func newReadAhead(maxWindow int64) *readAhead {
+	return &readAhead{
+		maxWindow: maxWindow,
+	}
+}
+
+// next is called for each read and returns the range to prefetch.
+// size is 0 if nothing should be prefetched.
+func (r *readAhead) next(off int64, size int64) (start int64, length int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	end := off + size
+	sequential := off == r.nextOffset
+	r.nextOffset = end
+
+	if r.maxWindow <= 0 {
+		return 0, 0
+	}
+
+	// Random access resets the window.
+	if !sequential {
+		r.window = 0
+		r.prefetched = end
+		return 0, 0
+	}
+
+	if r.prefetched < end {
+		r.prefetched = end
+	}
+
+	// Prefetch again when the half of the window has been consumed.
+	if r.window > 0 && r.prefetched-end >= r.window/2 {
+		return 0, 0
+	}
+
+	if r.window == 0 {
+		r.window = READ_AHEAD_MIN_WINDOW
+	} else {
+		r.window *= 2
+	}
+	if r.window > r.maxWindow {
+		r.window = r.maxWindow
+	}
+
+	start = r.prefetched
+	r.prefetched = end + r.window
+	return start, r.prefetched - start
+}
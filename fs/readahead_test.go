@@ -0,0 +1,57 @@
+package fs
+
+import (
+	"testing"
+)
+
+func TestReadAheadSequential(t *testing.T) {
+	r := newReadAhead(4 * READ_AHEAD_MIN_WINDOW)
+
+	start, length := r.next(0, 4096)
+	if start != 4096 || length != READ_AHEAD_MIN_WINDOW {
+		t.Errorf("Invalid range to prefetch %d-%d", start, length)
+	}
+
+	// the prefetched range is enough
+	if _, length = r.next(4096, 4096); length != 0 {
+		t.Errorf("Prefetch should not be done %d", length)
+	}
+
+	// the window grows up to maxWindow
+	var off int64 = 8192
+	for i := 0; i < 1000; i++ {
+		r.next(off, 4096)
+		off += 4096
+	}
+	if r.window != 4*READ_AHEAD_MIN_WINDOW {
+		t.Errorf("Invalid window %d", r.window)
+	}
+	if r.prefetched <= off {
+		t.Errorf("Prefetched range %d is behind the read %d", r.prefetched, off)
+	}
+}
+
+func TestReadAheadRandom(t *testing.T) {
+	r := newReadAhead(4 * READ_AHEAD_MIN_WINDOW)
+
+	r.next(0, 4096)
+	if _, length := r.next(100000, 4096); length != 0 {
+		t.Errorf("Random reads should not be prefetched %d", length)
+	}
+	if r.window != 0 {
+		t.Errorf("Window should be reset %d", r.window)
+	}
+
+	// sequential again
+	if start, length := r.next(104096, 4096); start != 108192 || length != READ_AHEAD_MIN_WINDOW {
+		t.Errorf("Invalid range to prefetch %d-%d", start, length)
+	}
+}
+
+func TestReadAheadDisabled(t *testing.T) {
+	r := newReadAhead(0)
+
+	if _, length := r.next(0, 4096); length != 0 {
+		t.Errorf("Prefetch should not be done %d", length)
+	}
+}
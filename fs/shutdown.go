@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// inflight counts the operations in progress.
+type inflight struct {
+	n    int
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+func newInflight() *inflight {
+	i := &inflight{}
+	i.cond = sync.NewCond(&i.lock)
+	return i
+}
+
+func (i *inflight) begin() {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.n++
+	i.lock.Unlock()
+}
+
+func (i *inflight) end() {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.n--
+	i.cond.Broadcast()
+	i.lock.Unlock()
+}
+
+// wait waits for the operations up to timeout. It returns false if some of them are still in progress.
+func (i *inflight) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		i.lock.Lock()
+		i.cond.Broadcast()
+		i.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for i.n > 0 && time.Now().Before(deadline) {
+		i.cond.Wait()
+	}
+	return i.n == 0
+}
+
+// Shutdown makes the file system refuse new files, and waits for the files in release up to timeout.
+// It returns false if some of them are still uploading.
+func (fs *objectFileSystem) Shutdown(timeout time.Duration) bool {
+	fs.lock.Lock()
+	fs.shutdown = true
+	fs.lock.Unlock()
+
+	log.Debugf("Shutdown: wait for releasing files")
+	return fs.releases.wait(timeout)
+}
+
+// Resume makes the file system accept new files again, when the unmount after Shutdown was cancelled.
+func (fs *objectFileSystem) Resume() {
+	fs.lock.Lock()
+	fs.shutdown = false
+	fs.lock.Unlock()
+}
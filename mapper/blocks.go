@@ -0,0 +1,196 @@
+package mapper
+
+const (
+	// Objects are fetched from the object storage in units of this size.
+	CACHE_BLOCK_SIZE = 1024 * 1024 // 1MB
+
+	// Maximum number of blocks that are fetched by a range request. It limits the memory to buffer a response.
+	FETCH_MAX_BLOCKS = 16
+)
+
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// blockMap tracks which blocks of the local file have been fetched from the object storage.
+// The local file is a sparse file, its blocks that are not present are filled with zero.
+type blockMap struct {
+	blockSize int64
+
+	// Size of the remote data that can be fetched. Data after this is local only.
+	remoteSize int64
+
+	present []bool
+
+	// Blocks that are being fetched.
+	fetching []bool
+}
+
+func newBlockMap(remoteSize int64, blockSize int64) *blockMap {
+	return &blockMap{
+		blockSize:  blockSize,
+		remoteSize: remoteSize,
+		present:    make([]bool, (remoteSize+blockSize-1)/blockSize),
+		fetching:   make([]bool, (remoteSize+blockSize-1)/blockSize),
+	}
+}
+
+// restoreBlockMap returns a block map whose blocks are present except the ones that overlap the absent ranges.
+func restoreBlockMap(remoteSize int64, blockSize int64, absent []byteRange) *blockMap {
+	b := newBlockMap(remoteSize, blockSize)
+	for i := range b.present {
+		b.present[i] = true
+	}
+	for _, r := range absent {
+		first, last := b.clamp(r.offset, r.length)
+		for i := first; i <= last; i++ {
+			b.present[i] = false
+		}
+	}
+	return b
+}
+
+// clamp returns the range of block indexes that overlap [off, off+size) in the remote data.
+func (b *blockMap) clamp(off int64, size int64) (first int64, last int64) {
+	end := off + size
+	if end > b.remoteSize || end < off {
+		end = b.remoteSize
+	}
+	if off >= end {
+		return 0, -1
+	}
+	return off / b.blockSize, (end - 1) / b.blockSize
+}
+
+// blockRange returns the range of the block in the remote data.
+func (b *blockMap) blockRange(i int64) (start int64, end int64) {
+	start = i * b.blockSize
+	end = start + b.blockSize
+	if end > b.remoteSize {
+		end = b.remoteSize
+	}
+	return start, end
+}
+
+// missing returns the ranges of consecutive blocks that overlap [off, off+size) and are neither present nor being fetched.
+func (b *blockMap) missing(off int64, size int64) []byteRange {
+	ranges := []byteRange{}
+
+	first, last := b.clamp(off, size)
+	for i := first; i <= last; i++ {
+		if b.present[i] || b.fetching[i] {
+			continue
+		}
+
+		start, end := b.blockRange(i)
+		if n := len(ranges); n > 0 && ranges[n-1].offset+ranges[n-1].length == start {
+			ranges[n-1].length += end - start
+		} else {
+			ranges = append(ranges, byteRange{offset: start, length: end - start})
+		}
+	}
+	return ranges
+}
+
+// absent returns the ranges of consecutive blocks that are not present, including the blocks being fetched.
+func (b *blockMap) absent() []byteRange {
+	ranges := []byteRange{}
+	for i := range b.present {
+		if b.present[i] {
+			continue
+		}
+
+		start, end := b.blockRange(int64(i))
+		if n := len(ranges); n > 0 && ranges[n-1].offset+ranges[n-1].length == start {
+			ranges[n-1].length += end - start
+		} else {
+			ranges = append(ranges, byteRange{offset: start, length: end - start})
+		}
+	}
+	return ranges
+}
+
+// markPresent marks the blocks that are entirely in [off, off+size) as present.
+func (b *blockMap) markPresent(off int64, size int64) {
+	first, last := b.clamp(off, size)
+	for i := first; i <= last; i++ {
+		start, end := b.blockRange(i)
+		if off <= start && end <= off+size {
+			b.present[i] = true
+		}
+	}
+}
+
+// busy returns true if some blocks that overlap [off, off+size) are being fetched.
+func (b *blockMap) busy(off int64, size int64) bool {
+	first, last := b.clamp(off, size)
+	for i := first; i <= last; i++ {
+		if b.fetching[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// setFetching marks the blocks that overlap [off, off+size) as being fetched or not.
+func (b *blockMap) setFetching(off int64, size int64, fetching bool) {
+	first, last := b.clamp(off, size)
+	for i := first; i <= last; i++ {
+		b.fetching[i] = fetching
+	}
+}
+
+// split divides the ranges at the block boundaries into pieces that can be fetched by n requests in parallel.
+// Consecutive blocks are fetched by a request, up to FETCH_MAX_BLOCKS blocks.
+func (b *blockMap) split(ranges []byteRange, n int) []byteRange {
+	if n < 1 {
+		n = 1
+	}
+
+	total := int64(0)
+	for _, r := range ranges {
+		first, last := b.clamp(r.offset, r.length)
+		total += last - first + 1
+	}
+
+	per := (total + int64(n) - 1) / int64(n)
+	if per > FETCH_MAX_BLOCKS {
+		per = FETCH_MAX_BLOCKS
+	}
+
+	pieces := []byteRange{}
+	for _, r := range ranges {
+		first, last := b.clamp(r.offset, r.length)
+		for i := first; i <= last; i += per {
+			j := i + per - 1
+			if j > last {
+				j = last
+			}
+			start, _ := b.blockRange(i)
+			_, end := b.blockRange(j)
+			pieces = append(pieces, byteRange{offset: start, length: end - start})
+		}
+	}
+	return pieces
+}
+
+// truncate discards the remote data after size.
+func (b *blockMap) truncate(size int64) {
+	if size >= b.remoteSize {
+		return
+	}
+	b.remoteSize = size
+	b.present = b.present[:(size+b.blockSize-1)/b.blockSize]
+	b.fetching = b.fetching[:len(b.present)]
+}
+
+// complete returns true if all blocks are present.
+func (b *blockMap) complete() bool {
+	for _, p := range b.present {
+		if !p {
+			return false
+		}
+	}
+	return true
+}
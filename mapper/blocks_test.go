@@ -0,0 +1,135 @@
+package mapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlockMapMissing(t *testing.T) {
+	b := newBlockMap(35, 10)
+
+	if len(b.present) != 4 {
+		t.Fatalf("Invalid number of blocks %d", len(b.present))
+	}
+
+	ranges := b.missing(5, 10)
+	if !reflect.DeepEqual(ranges, []byteRange{{0, 20}}) {
+		t.Errorf("Invalid missing ranges %v", ranges)
+	}
+
+	b.markPresent(10, 10)
+	ranges = b.missing(0, 100)
+	if !reflect.DeepEqual(ranges, []byteRange{{0, 10}, {20, 15}}) {
+		t.Errorf("Invalid missing ranges %v", ranges)
+	}
+
+	if ranges = b.missing(40, 10); len(ranges) != 0 {
+		t.Errorf("Ranges after the remote data should not be missing %v", ranges)
+	}
+}
+
+func TestBlockMapMarkPresent(t *testing.T) {
+	b := newBlockMap(35, 10)
+
+	// blocks partially covered are not present
+	b.markPresent(5, 20)
+	if !reflect.DeepEqual(b.present, []bool{false, true, false, false}) {
+		t.Errorf("Invalid blocks %v", b.present)
+	}
+
+	// the last block is shorter than the block size
+	b.markPresent(30, 5)
+	if !b.present[3] {
+		t.Errorf("The last block should be present")
+	}
+
+	b.markPresent(0, 35)
+	if !b.complete() {
+		t.Errorf("All blocks should be present")
+	}
+}
+
+func TestBlockMapTruncate(t *testing.T) {
+	b := newBlockMap(35, 10)
+
+	b.truncate(15)
+	if b.remoteSize != 15 || len(b.present) != 2 {
+		t.Errorf("Invalid block map after truncate (remoteSize=%d, blocks=%d)", b.remoteSize, len(b.present))
+	}
+
+	ranges := b.missing(0, 100)
+	if !reflect.DeepEqual(ranges, []byteRange{{0, 15}}) {
+		t.Errorf("Invalid missing ranges %v", ranges)
+	}
+
+	// extending does not change the remote size
+	b.truncate(100)
+	if b.remoteSize != 15 {
+		t.Errorf("Invalid remote size %d", b.remoteSize)
+	}
+}
+
+func TestBlockMapFetching(t *testing.T) {
+	b := newBlockMap(35, 10)
+
+	b.setFetching(10, 1, true)
+	if !b.busy(0, 15) || b.busy(20, 10) {
+		t.Errorf("Invalid busy state %v", b.fetching)
+	}
+
+	// blocks being fetched are not missing
+	ranges := b.missing(0, 100)
+	if !reflect.DeepEqual(ranges, []byteRange{{0, 10}, {20, 15}}) {
+		t.Errorf("Invalid missing ranges %v", ranges)
+	}
+
+	b.setFetching(10, 1, false)
+	if b.busy(0, 100) {
+		t.Errorf("Invalid busy state %v", b.fetching)
+	}
+}
+
+func TestBlockMapSplit(t *testing.T) {
+	b := newBlockMap(35, 10)
+
+	// consecutive blocks are fetched by a request
+	blocks := b.split([]byteRange{{0, 20}, {30, 5}}, 1)
+	if !reflect.DeepEqual(blocks, []byteRange{{0, 20}, {30, 5}}) {
+		t.Errorf("Invalid blocks %v", blocks)
+	}
+
+	// divided for parallel requests
+	blocks = b.split([]byteRange{{0, 35}}, 2)
+	if !reflect.DeepEqual(blocks, []byteRange{{0, 20}, {20, 15}}) {
+		t.Errorf("Invalid blocks %v", blocks)
+	}
+
+	blocks = b.split([]byteRange{{0, 20}, {30, 5}}, 4)
+	if !reflect.DeepEqual(blocks, []byteRange{{0, 10}, {10, 10}, {30, 5}}) {
+		t.Errorf("Invalid blocks %v", blocks)
+	}
+
+	// a request does not exceed FETCH_MAX_BLOCKS
+	b = newBlockMap(10*(FETCH_MAX_BLOCKS+1), 10)
+	blocks = b.split([]byteRange{{0, b.remoteSize}}, 1)
+	if len(blocks) != 2 || blocks[0].length != 10*FETCH_MAX_BLOCKS {
+		t.Errorf("Invalid blocks %v", blocks)
+	}
+}
+
+func TestBlockMapRestore(t *testing.T) {
+	b := newBlockMap(35, 10)
+	b.markPresent(10, 10)
+	b.setFetching(30, 5, true)
+
+	// blocks being fetched are absent
+	absent := b.absent()
+	if !reflect.DeepEqual(absent, []byteRange{{0, 10}, {20, 15}}) {
+		t.Errorf("Invalid absent ranges %v", absent)
+	}
+
+	r := restoreBlockMap(35, 10, absent)
+	if !reflect.DeepEqual(r.present, []bool{false, true, false, false}) {
+		t.Errorf("Invalid restored blocks %v", r.present)
+	}
+}
@@ -0,0 +1,434 @@
+package mapper
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// The index of the cached files. It is used to reuse them after restart.
+	CACHE_INDEX_FILE = "index.json"
+
+	// The directory that the cached files are stored in.
+	CACHE_DATA_DIR = "data"
+
+	// The lock file that prevents other processes from using the same cache directory.
+	CACHE_LOCK_FILE = "lock"
+)
+
+// cacheIndexEntry is a cached file that is complete and has no local changes.
+type cacheIndexEntry struct {
+	Hash         string    `json:"hash"`
+	LastModified time.Time `json:"last_modified"`
+	LastAccess   time.Time `json:"last_access"`
+}
+
+// cacheLocalpath returns the path of the local file for the object in the container.
+// The name is a hash of the container and the full object path, so that distinct objects never share a file
+// and the name does not exceed NAME_MAX. Files are distributed to subdirectories by the first byte of the hash.
+func cacheLocalpath(dir string, container string, path string) string {
+	h := hashName(container + "\x00" + path)
+	return filepath.Join(dir, CACHE_DATA_DIR, h[:2], h)
+}
+
+func hashName(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheManager keeps the local files within the budget by evicting the least recently used ones.
+// Files that are opened, have local changes or are being fetched are never evicted.
+type cacheManager struct {
+	dir       string // the cache directory for the mount
+	container string
+	lockfile  *os.File
+	maxBytes  int64 // 0 means unlimited
+	maxFiles  int   // 0 means unlimited
+
+	used  int64
+	lru   *list.List // *object, the front is the most recently used
+	index map[string]cacheIndexEntry
+
+	// Paths in the index that were restored by the first syncObjects().
+	restored map[string]bool
+
+	lock sync.Mutex
+}
+
+// Files in keep are not removed even if they are not in the index.
+func newCacheManager(dir string, container string, maxBytes int64, maxFiles int, keep map[string]bool) (*cacheManager, error) {
+	c := &cacheManager{
+		dir:       dir,
+		container: container,
+		maxBytes:  maxBytes,
+		maxFiles:  maxFiles,
+		lru:       list.New(),
+		index:     map[string]cacheIndexEntry{},
+		restored:  map[string]bool{},
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.dir, CACHE_DATA_DIR), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := c.lockDirectory(); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, CACHE_INDEX_FILE))
+	if err == nil {
+		if err = json.Unmarshal(data, &c.index); err != nil {
+			log.Warnf("[cache] Broken cache index, all cached files are discarded. %v", err)
+			c.index = map[string]cacheIndexEntry{}
+		}
+	}
+
+	// Files that are not in the index are incomplete.
+	paths := map[string]bool{}
+	for p := range keep {
+		paths[p] = true
+	}
+	for path := range c.index {
+		paths[c.localpath(path)] = true
+	}
+	filepath.Walk(filepath.Join(c.dir, CACHE_DATA_DIR), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !paths[p] {
+			log.Debugf("[cache] Remove %s that is not in the index", p)
+			os.Remove(p)
+		}
+		return nil
+	})
+
+	return c, nil
+}
+
+// lockDirectory locks the lock file in the cache directory. The lock is released when the process exits.
+func (c *cacheManager) lockDirectory() (err error) {
+	c.lockfile, err = os.OpenFile(filepath.Join(c.dir, CACHE_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	// POSIX record lock is owned by the process, so that it does not conflict in the same process.
+	lk := &syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: int16(os.SEEK_SET),
+	}
+	if err = syscall.FcntlFlock(c.lockfile.Fd(), syscall.F_SETLK, lk); err != nil {
+		c.lockfile.Close()
+		c.lockfile = nil
+		return fmt.Errorf("Cache directory %s is used by another swiftfs process", c.dir)
+	}
+
+	c.lockfile.Truncate(0)
+	fmt.Fprintf(c.lockfile, "%d\n", os.Getpid())
+	return nil
+}
+
+// close saves the index and releases the lock file.
+func (c *cacheManager) close() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.save()
+	if c.lockfile != nil {
+		c.lockfile.Close()
+		c.lockfile = nil
+	}
+}
+
+// usage returns the size(bytes) and the number of the local files.
+func (c *cacheManager) usage() (bytes int64, files int) {
+	if c == nil {
+		return 0, 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.used, c.lru.Len()
+}
+
+// setLimits changes the budget, and evicts the files over it.
+func (c *cacheManager) setLimits(maxBytes int64, maxFiles int) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxBytes = maxBytes
+	c.maxFiles = maxFiles
+	c.evict()
+	c.save()
+}
+
+func (c *cacheManager) localpath(path string) string {
+	return cacheLocalpath(c.dir, c.container, path)
+}
+
+// restore reuses the cached file of the object if it is same as the object in the listing.
+func (c *cacheManager) restore(o *object) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.index[o.Path]
+	if !ok {
+		return
+	}
+
+	size := diskUsage(c.localpath(o.Path))
+	if size < 0 || e.Hash != o.hash || e.LastModified.Unix() != o.modified.Unix() {
+		log.Debugf("[cache] Discard %s, the object was changed", o.Path)
+		os.Remove(c.localpath(o.Path))
+		delete(c.index, o.Path)
+		return
+	}
+
+	log.Debugf("[cache] Restore %s", o.Path)
+	o.downloaded = true
+	o.lastAccess = e.LastAccess
+	o.cacheSize = size
+	o.cacheElem = c.lru.PushFront(o)
+	c.used += size
+	c.restored[o.Path] = true
+}
+
+// prune discards the cached files of objects that do not exist anymore, and sorts the restored ones.
+// It is called after the first syncObjects().
+func (c *cacheManager) prune() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for path := range c.index {
+		if !c.restored[path] {
+			log.Debugf("[cache] Discard %s, the object was deleted", path)
+			os.Remove(c.localpath(path))
+			delete(c.index, path)
+		}
+	}
+	c.restored = map[string]bool{}
+
+	objs := make(byLastAccess, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		objs = append(objs, e.Value.(*object))
+	}
+	sort.Sort(objs)
+	c.lru.Init()
+	for _, o := range objs {
+		o.cacheElem = c.lru.PushBack(o)
+	}
+
+	c.evict()
+	c.save()
+}
+
+type byLastAccess []*object
+
+func (s byLastAccess) Len() int           { return len(s) }
+func (s byLastAccess) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastAccess) Less(i, j int) bool { return s[i].lastAccess.After(s[j].lastAccess) }
+
+// open marks the object as used. It is called when the local file is opened.
+func (c *cacheManager) open(o *object) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	o.openCount++
+	o.lastAccess = time.Now()
+	if o.cacheElem == nil {
+		o.cacheElem = c.lru.PushFront(o)
+	} else {
+		c.lru.MoveToFront(o.cacheElem)
+	}
+}
+
+// release is called when the local file is closed.
+func (c *cacheManager) release(o *object) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if o.openCount > 0 {
+		o.openCount--
+	}
+	c.update(o)
+	c.evict()
+	c.save()
+}
+
+// commit is called when the local file has been changed, e.g. uploaded or moved.
+func (c *cacheManager) commit(o *object) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if o.cacheElem == nil {
+		o.lastAccess = time.Now()
+		o.cacheElem = c.lru.PushFront(o)
+	}
+	c.update(o)
+	c.evict()
+	c.save()
+}
+
+// remove forgets the object. The local file should be removed by the caller.
+func (c *cacheManager) remove(o *object) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if o.cacheElem != nil {
+		c.lru.Remove(o.cacheElem)
+		o.cacheElem = nil
+	}
+	c.used -= o.cacheSize
+	o.cacheSize = 0
+
+	if _, ok := c.index[o.Path]; ok {
+		delete(c.index, o.Path)
+		c.save()
+	}
+}
+
+// update refreshes the disk usage and the index entry of the object. Need to hold the lock.
+func (c *cacheManager) update(o *object) {
+	if o.cacheElem == nil {
+		return
+	}
+
+	size := diskUsage(c.localpath(o.Path))
+	if size < 0 {
+		size = 0
+	}
+	c.used += size - o.cacheSize
+	o.cacheSize = size
+
+	o.fetchLock.Lock()
+	clean := o.blocks == nil && !o.dirty && o.downloaded
+	o.fetchLock.Unlock()
+
+	if hash, modified := o.remote(); clean && hash != "" {
+		c.index[o.Path] = cacheIndexEntry{
+			Hash:         hash,
+			LastModified: modified,
+			LastAccess:   o.lastAccess,
+		}
+	} else {
+		delete(c.index, o.Path)
+	}
+}
+
+// evict removes the least recently used files until the usage is within the budget. Need to hold the lock.
+func (c *cacheManager) evict() {
+	over := func() bool {
+		return (c.maxBytes > 0 && c.used > c.maxBytes) || (c.maxFiles > 0 && c.lru.Len() > c.maxFiles)
+	}
+
+	for e := c.lru.Back(); e != nil && over(); {
+		prev := e.Prev()
+		c.discardLocked(e.Value.(*object))
+		e = prev
+	}
+}
+
+// discard removes the local file of the object if it is not used.
+// It returns false if the object is opened, has local changes or is being fetched.
+func (c *cacheManager) discard(o *object) bool {
+	if c == nil {
+		return o.evict()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.discardLocked(o) {
+		return false
+	}
+	c.save()
+	return true
+}
+
+func (c *cacheManager) discardLocked(o *object) bool {
+	if o.openCount > 0 || !o.evict() {
+		return false
+	}
+
+	log.Debugf("[cache] Discard %s (%d bytes)", o.Path, o.cacheSize)
+	if o.cacheElem != nil {
+		c.lru.Remove(o.cacheElem)
+		o.cacheElem = nil
+	}
+	c.used -= o.cacheSize
+	o.cacheSize = 0
+	delete(c.index, o.Path)
+	return true
+}
+
+// save writes the index to the cache directory. Need to hold the lock.
+func (c *cacheManager) save() {
+	data, err := json.Marshal(c.index)
+	if err != nil {
+		log.Warnf("[cache] Can't save the cache index %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it, not to leave a broken index.
+	p := filepath.Join(c.dir, CACHE_INDEX_FILE)
+	if err = ioutil.WriteFile(p+".tmp", data, 0600); err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		log.Warnf("[cache] Can't save the cache index %v", err)
+	}
+}
+
+// diskUsage returns the size of the blocks allocated for the file. The local files may be sparse.
+// It returns -1 if the file does not exist.
+func diskUsage(path string) int64 {
+	st, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return int64(sys.Blocks) * 512
+	}
+	return st.Size()
+}
@@ -0,0 +1,264 @@
+package mapper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
+)
+
+func newCachedObject(t *testing.T, cache *cacheManager, path string, size int) *object {
+	o := newObject(storage, path, FILE)
+	o.cache = cache
+	o.hash = "hash-" + path
+	o.downloaded = true
+
+	os.MkdirAll(filepath.Dir(o.Localpath()), 0700)
+	if err := ioutil.WriteFile(o.Localpath(), make([]byte, size), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return o
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-cache")
+	defer os.RemoveAll(dir)
+
+	cache, err := newCacheManager(dir, TEST_CONTAINER, 0, 3, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	o1 := newCachedObject(t, cache, "o1", 4096)
+	o2 := newCachedObject(t, cache, "o2", 4096)
+	o3 := newCachedObject(t, cache, "o3", 4096)
+	o4 := newCachedObject(t, cache, "o4", 4096)
+
+	// opened
+	cache.open(o1)
+
+	// has local changes
+	cache.commit(o2)
+	o2.dirty = true
+
+	cache.commit(o3)
+	if _, err = os.Stat(o1.Localpath()); err != nil {
+		t.Fatalf("o1 should not be evicted %v", err)
+	}
+
+	// o3 is the least recently used one that can be evicted
+	cache.commit(o4)
+	for _, o := range []*object{o1, o2, o4} {
+		if _, err = os.Stat(o.Localpath()); err != nil {
+			t.Errorf("%s should not be evicted %v", o.Path, err)
+		}
+	}
+	if _, err = os.Stat(o3.Localpath()); !os.IsNotExist(err) {
+		t.Errorf("o3 should be evicted")
+	}
+	if o3.downloaded {
+		t.Errorf("o3 should be downloaded again")
+	}
+
+	// o1 can be evicted after it is closed
+	cache.release(o1)
+	o5 := newCachedObject(t, cache, "o5", 4096)
+	cache.commit(o5)
+	if _, err = os.Stat(o1.Localpath()); !os.IsNotExist(err) {
+		t.Errorf("o1 should be evicted")
+	}
+	if _, err = os.Stat(o4.Localpath()); err != nil {
+		t.Errorf("o4 should not be evicted %v", err)
+	}
+}
+
+func TestCacheSetLimits(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-cache")
+	defer os.RemoveAll(dir)
+
+	cache, err := newCacheManager(dir, TEST_CONTAINER, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	objs := []*object{}
+	for _, name := range []string{"o1", "o2", "o3"} {
+		o := newCachedObject(t, cache, name, 4096)
+		cache.commit(o)
+		objs = append(objs, o)
+	}
+
+	// The least recently used files are evicted by the new budget.
+	cache.setLimits(0, 1)
+	if _, files := cache.usage(); files != 1 {
+		t.Errorf("%d files are cached", files)
+	}
+	if _, err = os.Stat(objs[2].Localpath()); err != nil {
+		t.Errorf("o3 should not be evicted %v", err)
+	}
+}
+
+func TestCacheSizeBudget(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-cache")
+	defer os.RemoveAll(dir)
+
+	cache, err := newCacheManager(dir, TEST_CONTAINER, 64*1024, 0, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	objs := []*object{}
+	for _, name := range []string{"o1", "o2", "o3"} {
+		o := newCachedObject(t, cache, name, 30*1024)
+		cache.commit(o)
+		objs = append(objs, o)
+	}
+
+	if _, err = os.Stat(objs[0].Localpath()); !os.IsNotExist(err) {
+		t.Errorf("o1 should be evicted")
+	}
+	if cache.used > cache.maxBytes {
+		t.Errorf("Cache usage %d is over the budget", cache.used)
+	}
+}
+
+func TestCacheRestore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-cache")
+	defer os.RemoveAll(dir)
+
+	storage.DeleteContainer()
+	storage.CreateContainer()
+	storage.Reset()
+
+	data := []byte(strings.Repeat(TEST_DATA, 1000))
+	storage.Upload("restored", bytes.NewReader(data))
+	storage.Upload("changed", bytes.NewReader(data))
+	storage.Upload("deleted", bytes.NewReader(data))
+
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER
+	c.CacheDirectory = dir
+
+	m, err := NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, name := range []string{"restored", "changed", "deleted"} {
+		obj, _ := m.Get(name)
+		file, err := obj.Open(os.O_RDONLY, 0600)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err = obj.Fetch(0, int64(obj.Size)); err != nil {
+			t.Fatalf("%v", err)
+		}
+		file.Close()
+		obj.Release()
+	}
+
+	// restart
+	m.Close(time.Second)
+	storage.Upload("changed", strings.NewReader(TEST_DATA))
+	storage.Delete("deleted")
+	storage.Reset()
+
+	m, err = NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	obj, _ := m.Get("restored")
+	file, err := obj.Open(os.O_RDONLY, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	if err = obj.Fetch(0, int64(obj.Size)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := storage.Requests(fakeswift.OP_GET_RANGE) + storage.Requests(fakeswift.OP_GET); n != 0 {
+		t.Errorf("%d requests were sent to read the restored object", n)
+	}
+	local, _ := ioutil.ReadFile(obj.Localpath())
+	if !bytes.Equal(local, data) {
+		t.Errorf("restored local file mismatched")
+	}
+
+	obj, _ = m.Get("changed")
+	if _, err = os.Stat(obj.Localpath()); !os.IsNotExist(err) {
+		t.Errorf("local file of the changed object should be discarded")
+	}
+	if _, err = os.Stat(m.cache.localpath("deleted")); !os.IsNotExist(err) {
+		t.Errorf("local file of the deleted object should be discarded")
+	}
+}
+
+func TestCacheMounts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-cache")
+	defer os.RemoveAll(dir)
+
+	c1 := &config.Config{CacheDirectory: dir, IdentityEndpoint: "http://keystone/v2.0", TenantName: "t", ContainerName: "c1"}
+	c2 := &config.Config{CacheDirectory: dir, IdentityEndpoint: "http://keystone/v2.0", TenantName: "t", ContainerName: "c2"}
+	if c1.MountCacheDirectory() == c2.MountCacheDirectory() {
+		t.Fatalf("mounts of different containers share the cache directory")
+	}
+
+	m1, _ := newCacheManager(c1.MountCacheDirectory(), "c1", 0, 0, nil)
+	defer m1.close()
+	o := newCachedObject(t, m1, "obj", 4096)
+	m1.commit(o)
+
+	// Starting the cache manager of other mount does not remove the files of c1.
+	m2, err := newCacheManager(c2.MountCacheDirectory(), "c2", 0, 0, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer m2.close()
+	if _, err := os.Stat(o.Localpath()); err != nil {
+		t.Errorf("local file of c1 was removed %v", err)
+	}
+}
+
+// TestCacheLock runs TestCacheLockHelper in other process, that should fail to use the locked directory.
+func TestCacheLock(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-cache")
+	defer os.RemoveAll(dir)
+
+	cache, err := newCacheManager(dir, TEST_CONTAINER, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestCacheLockHelper")
+	cmd.Env = append(os.Environ(), "SWIFTFS_TEST_CACHE_DIR="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("other process could use the locked cache directory %v %s", err, out)
+	}
+
+	// It is released by close()
+	cache.close()
+	cmd = exec.Command(os.Args[0], "-test.run=TestCacheLockHelper")
+	cmd.Env = append(os.Environ(), "SWIFTFS_TEST_CACHE_DIR="+dir)
+	if err := cmd.Run(); err == nil {
+		t.Errorf("other process could not use the released cache directory")
+	}
+}
+
+func TestCacheLockHelper(t *testing.T) {
+	dir := os.Getenv("SWIFTFS_TEST_CACHE_DIR")
+	if dir == "" {
+		return
+	}
+
+	if _, err := newCacheManager(dir, TEST_CONTAINER, 0, 0, nil); err == nil {
+		t.Fatalf("the locked cache directory was used")
+	}
+}
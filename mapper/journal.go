@@ -0,0 +1,293 @@
+package mapper
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// The journal of objects that have local changes. It is in the cache directory of the mount.
+	JOURNAL_FILE = "journal"
+
+	JOURNAL_DIRTY = "dirty" // the object has local changes
+	JOURNAL_CLEAN = "clean" // the changes were uploaded or discarded
+	JOURNAL_LOST  = "lost"  // the changes can not be recovered
+)
+
+// JournalEntry is a record of the journal.
+type JournalEntry struct {
+	Op   string    `json:"op"`
+	Path string    `json:"path"`
+	File string    `json:"file,omitempty"` // the local file
+	Gen  uint64    `json:"gen"`
+	Time time.Time `json:"time"`
+
+	// The local file may not be complete. Missing is the ranges (offset and length) of the remote object
+	// that are not in the local file, they are fetched from the remote object of Hash before uploading.
+	Missing    [][2]int64 `json:"missing,omitempty"`
+	RemoteSize int64      `json:"remote_size,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+
+	// The reason why the changes can not be recovered (JOURNAL_LOST only).
+	Reason string `json:"reason,omitempty"`
+}
+
+// journal records the objects that have local changes, so that the changes are uploaded after a crash.
+// The generation increases for every change, an object is clean if it was uploaded with the generation of the last change.
+type journal struct {
+	path string
+	file *os.File
+	gen  uint64
+
+	// The latest dirty record of the objects that have local changes, and the unrecoverable entries.
+	pending map[string]JournalEntry
+	lost    map[string]JournalEntry
+
+	lock sync.Mutex
+}
+
+// openJournal reads the journal in the directory.
+func openJournal(dir string) (*journal, error) {
+	j := &journal{
+		path:    filepath.Join(dir, JOURNAL_FILE),
+		pending: map[string]JournalEntry{},
+		lost:    map[string]JournalEntry{},
+	}
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last record may be written partially by a crash.
+			log.Warnf("[journal] Ignore a broken record %v", err)
+			continue
+		}
+
+		if e.Gen > j.gen {
+			j.gen = e.Gen
+		}
+		j.apply(e)
+	}
+	return j, scanner.Err()
+}
+
+// apply updates the state by the record. Need to hold the lock except in openJournal().
+func (j *journal) apply(e JournalEntry) {
+	switch e.Op {
+	case JOURNAL_DIRTY:
+		j.pending[e.Path] = e
+		delete(j.lost, e.Path)
+	case JOURNAL_CLEAN:
+		if p, ok := j.pending[e.Path]; ok && p.Gen <= e.Gen {
+			delete(j.pending, e.Path)
+		}
+	case JOURNAL_LOST:
+		delete(j.pending, e.Path)
+		j.lost[e.Path] = e
+	}
+}
+
+// files returns the local files of the pending entries.
+func (j *journal) files() map[string]bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	files := map[string]bool{}
+	for _, e := range j.pending {
+		files[e.File] = true
+	}
+	return files
+}
+
+// compact rewrites the journal with the entries that are still needed, and opens it to append records.
+func (j *journal) compact() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries := []JournalEntry{}
+	for _, e := range j.pending {
+		entries = append(entries, e)
+	}
+	for _, e := range j.lost {
+		entries = append(entries, e)
+	}
+	sort.Sort(byJournalPath(entries))
+
+	f, err := os.OpenFile(j.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = j.encode(f, e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err = os.Rename(j.path+".tmp", j.path); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (j *journal) encode(f *os.File, e JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// append writes the record and waits until it is on the disk.
+func (j *journal) append(e JournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file == nil {
+		j.apply(e)
+		return nil
+	}
+
+	e.Time = time.Now()
+	if err := j.encode(j.file, e); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.apply(e)
+	return nil
+}
+
+// next returns the generation for a new change.
+func (j *journal) next() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.gen++
+	return j.gen
+}
+
+func (j *journal) dirty(e JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	e.Op = JOURNAL_DIRTY
+	return j.append(e)
+}
+
+func (j *journal) clean(path string, gen uint64) error {
+	if j == nil {
+		return nil
+	}
+	return j.append(JournalEntry{Op: JOURNAL_CLEAN, Path: path, Gen: gen})
+}
+
+// discard records that the changes of the object are not needed anymore, e.g. it was deleted.
+func (j *journal) discard(path string) error {
+	if j == nil {
+		return nil
+	}
+	return j.clean(path, j.next())
+}
+
+func (j *journal) markLost(e JournalEntry, reason string) error {
+	if j == nil {
+		return nil
+	}
+
+	e.Op = JOURNAL_LOST
+	e.Reason = reason
+	return j.append(e)
+}
+
+// recovering returns the pending entries read at startup.
+func (j *journal) recovering() []JournalEntry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries := []JournalEntry{}
+	for _, e := range j.pending {
+		entries = append(entries, e)
+	}
+	sort.Sort(byJournalPath(entries))
+	return entries
+}
+
+// unrecoverable returns the entries whose changes can not be recovered.
+func (j *journal) unrecoverable() []JournalEntry {
+	entries := []JournalEntry{}
+	if j == nil {
+		return entries
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for _, e := range j.lost {
+		entries = append(entries, e)
+	}
+	sort.Sort(byJournalPath(entries))
+	return entries
+}
+
+// forgetLost removes the unrecoverable entries from the journal.
+func (j *journal) forgetLost() error {
+	if j == nil {
+		return nil
+	}
+
+	j.lock.Lock()
+	j.lost = map[string]JournalEntry{}
+	j.lock.Unlock()
+
+	return j.compact()
+}
+
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+type byJournalPath []JournalEntry
+
+func (s byJournalPath) Len() int           { return len(s) }
+func (s byJournalPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byJournalPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
@@ -0,0 +1,188 @@
+package mapper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
+)
+
+func TestJournalReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-journal")
+	defer os.RemoveAll(dir)
+
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	j.compact()
+
+	// "a" was changed again while uploading the first change.
+	j.dirty(JournalEntry{Path: "a", File: "/cache/a", Gen: j.next()})
+	j.dirty(JournalEntry{Path: "a", File: "/cache/a", Gen: j.next()})
+	j.clean("a", 1)
+	j.dirty(JournalEntry{Path: "b", File: "/cache/b", Gen: j.next()})
+	j.clean("b", 3)
+	j.dirty(JournalEntry{Path: "c", File: "/cache/c", Gen: j.next()})
+	j.markLost(JournalEntry{Path: "c", File: "/cache/c", Gen: 4}, "test")
+	j.close()
+
+	// A record written partially by a crash
+	f, _ := os.OpenFile(filepath.Join(dir, JOURNAL_FILE), os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"op":"dirty","path":"d",`)
+	f.Close()
+
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if entries := j.recovering(); len(entries) != 1 || entries[0].Path != "a" || entries[0].Gen != 2 {
+		t.Errorf("Invalid pending entries %v", entries)
+	}
+	if entries := j.unrecoverable(); len(entries) != 1 || entries[0].Path != "c" || entries[0].Reason != "test" {
+		t.Errorf("Invalid unrecoverable entries %v", entries)
+	}
+	if gen := j.next(); gen != 5 {
+		t.Errorf("Generation %d was reused", gen)
+	}
+
+	// Compaction keeps the state.
+	if err = j.compact(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	j.close()
+
+	j, _ = openJournal(dir)
+	if len(j.recovering()) != 1 || len(j.unrecoverable()) != 1 {
+		t.Errorf("Journal was broken by compaction %v %v", j.recovering(), j.unrecoverable())
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-journal")
+	defer os.RemoveAll(dir)
+
+	storage.DeleteContainer()
+	storage.CreateContainer()
+	storage.Reset()
+
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER
+	c.CacheDirectory = dir
+	c.UploadWorkers = 0
+
+	m, err := NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, name := range []string{"recovered", "lost"} {
+		obj, err := m.Create(name)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		file, _ := obj.Open(os.O_WRONLY, 0600)
+		obj.FetchForWrite(0, int64(len(TEST_DATA)))
+		file.WriteString(TEST_DATA)
+		file.Close()
+	}
+
+	// crash before uploading
+	lost, _ := m.Get("lost")
+	os.Remove(lost.Localpath())
+	m.journal.close()
+	m.cache.close()
+
+	m, err = NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer m.Close(time.Second)
+
+	if data, _ := storage.Data("recovered"); string(data) != TEST_DATA {
+		t.Errorf("Local changes were not uploaded after the crash")
+	}
+	if entries := m.UnrecoverableUploads(); len(entries) != 1 || entries[0].Path != "lost" {
+		t.Errorf("Invalid unrecoverable uploads %v", entries)
+	}
+	if entries := m.journal.recovering(); len(entries) != 0 {
+		t.Errorf("Recovered changes are still pending %v", entries)
+	}
+
+	if err = m.ForgetUnrecoverableUploads(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if entries := m.UnrecoverableUploads(); len(entries) != 0 {
+		t.Errorf("Unrecoverable uploads were not forgotten %v", entries)
+	}
+}
+
+func TestJournalRecoveryPartial(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-journal")
+	defer os.RemoveAll(dir)
+
+	storage.DeleteContainer()
+	storage.CreateContainer()
+	storage.Reset()
+
+	data := make([]byte, CACHE_BLOCK_SIZE*3)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for _, name := range []string{"partial", "changed"} {
+		storage.Upload(name, bytes.NewReader(data))
+	}
+
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER
+	c.CacheDirectory = dir
+	c.UploadWorkers = 0
+
+	m, err := NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Only the second block is fetched by the write.
+	for _, name := range []string{"partial", "changed"} {
+		obj, _ := m.Get(name)
+		file, _ := obj.Open(os.O_WRONLY, 0600)
+		obj.FetchForWrite(CACHE_BLOCK_SIZE+10, 4)
+		file.WriteAt([]byte("hoge"), CACHE_BLOCK_SIZE+10)
+		file.Close()
+	}
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 2 {
+		t.Errorf("%d range requests were sent", n)
+	}
+
+	// crash before uploading, and "changed" is overwritten by others
+	storage.Upload("changed", strings.NewReader(TEST_DATA))
+	m.journal.close()
+	m.cache.close()
+
+	m, err = NewObjectMapper(c, storage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer m.Close(time.Second)
+
+	// Blocks that were not fetched are fetched before uploading.
+	expected := append([]byte{}, data...)
+	copy(expected[CACHE_BLOCK_SIZE+10:], "hoge")
+	if uploaded, _ := storage.Data("partial"); !bytes.Equal(uploaded, expected) {
+		t.Errorf("Local changes were not uploaded with the blocks not fetched")
+	}
+
+	if entries := m.UnrecoverableUploads(); len(entries) != 1 || entries[0].Path != "changed" {
+		t.Errorf("Invalid unrecoverable uploads %v", entries)
+	}
+	if uploaded, _ := storage.Data("changed"); string(uploaded) != TEST_DATA {
+		t.Errorf("Changed object was overwritten by the local changes")
+	}
+}
@@ -2,13 +2,12 @@ package mapper
 
 import (
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"path/filepath"
-
 	log "github.com/Sirupsen/logrus"
 	"github.com/hironobu-s/swiftfs/config"
 	"github.com/hironobu-s/swiftfs/openstack"
@@ -16,49 +15,231 @@ import (
 
 type ObjectMapper struct {
 	objects map[string]*object
-	swift   *openstack.Swift
+	storage openstack.ObjectStorage
 
 	// object list caching
 	objectCacheTime int
 	lastCached      time.Time
-}
 
-func NewObjectMapper(c *config.Config) (*ObjectMapper, error) {
-	var err error
+	downloadConcurrency int
 
-	swift := openstack.NewSwift(c)
-	if err = swift.Auth(); err != nil {
-		return nil, err
-	}
+	// Protects the tunables that are changed by Reconfigure().
+	tunableLock sync.Mutex
+
+	// local files
+	cache    *cacheManager
+	uploader *uploader
+	journal  *journal
+}
 
+// NewObjectMapper creates a mapper for the container that the storage points to.
+// The storage must be ready to use (e.g. authenticated).
+func NewObjectMapper(c *config.Config, storage openstack.ObjectStorage) (m *ObjectMapper, err error) {
 	if c.CreateContainer {
-		if err = swift.CreateContainer(); err != nil {
+		if err = storage.CreateContainer(); err != nil {
 			return nil, err
 		}
 
 	} else {
-		_, err := swift.GetContainer()
+		_, err := storage.GetContainer()
 		if err != nil {
 			return nil, fmt.Errorf("Container \"%s\" not found", c.ContainerName)
 		}
 	}
 
-	m := &ObjectMapper{
+	// Local files that have changes not uploaded by the previous process are kept.
+	if c.CacheDirectory == "" {
+		return nil, fmt.Errorf("Cache directory is not set")
+	}
+	dir := c.MountCacheDirectory()
+	journal, err := openJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The journal and the lock of the cache directory are released if the mount fails.
+	var cache *cacheManager
+	defer func() {
+		if err != nil {
+			journal.close()
+			cache.close()
+		}
+	}()
+
+	cache, err = newCacheManager(dir, c.ContainerName, c.CacheSize, c.CacheFiles, journal.files())
+	if err != nil {
+		return nil, err
+	}
+
+	m = &ObjectMapper{
 		objects:         map[string]*object{},
-		swift:           swift,
+		storage:         storage,
 		objectCacheTime: c.ObjectCacheTime,
 		lastCached:      time.Now(),
+
+		downloadConcurrency: c.DownloadConcurrency,
+		cache:               cache,
+		journal:             journal,
 	}
 
-	m.syncObjects()
+	// The cached files of the previous run are reused if the objects were not changed.
+	// They are kept for the next mount if the listing failed.
+	if err = m.syncObjects(); err != nil {
+		return nil, fmt.Errorf("Can't list objects in container \"%s\", %v", c.ContainerName, err)
+	}
+	m.cache.prune()
+
+	if c.UploadWorkers > 0 {
+		m.uploader = newUploader(c.UploadWorkers, c.UploadDelay, c.UploadRetries)
+	}
+
+	// Finish the uploads interrupted by a crash before the mount goes live.
+	m.recover()
+	if err = m.journal.compact(); err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
 
+// recover uploads the local changes in the journal that were not uploaded by the previous process.
+// Changes that can not be recovered are recorded as unrecoverable entries.
+func (m *ObjectMapper) recover() {
+	for _, e := range m.journal.recovering() {
+		log.Warnf("[mapper] Recover local changes of %s", e.Path)
+
+		st, err := os.Stat(e.File)
+		if err != nil {
+			log.Warnf("[mapper] Can't recover %s, the local file was lost. %v", e.Path, err)
+			m.journal.markLost(e, fmt.Sprintf("the local file was lost (%v)", err))
+			continue
+		}
+
+		obj, ok := m.objects[e.Path]
+		if ok && obj.Type != FILE {
+			log.Warnf("[mapper] Can't recover %s, it is not a file now", e.Path)
+			m.journal.markLost(e, "it is not a file now")
+			continue
+		}
+
+		// Blocks that were not fetched are fetched on uploading, they must be of the same remote object.
+		if len(e.Missing) > 0 && (!ok || obj.hash != e.Hash) {
+			log.Warnf("[mapper] Can't recover %s, the remote object was changed", e.Path)
+			m.journal.markLost(e, "the remote object was changed, and the blocks not fetched were lost")
+			continue
+		}
+
+		if !ok {
+			obj = m.newObject(e.Path, FILE)
+			m.objects[e.Path] = obj
+		}
+
+		// The cache layout may be changed.
+		if e.File != obj.Localpath() {
+			if err = os.MkdirAll(filepath.Dir(obj.Localpath()), 0700); err == nil {
+				err = os.Rename(e.File, obj.Localpath())
+			}
+			if err != nil {
+				log.Warnf("[mapper] Can't recover %s, %v", e.Path, err)
+				m.journal.markLost(e, err.Error())
+				continue
+			}
+		}
+
+		obj.blocks = nil
+		obj.downloaded = true
+		if len(e.Missing) > 0 {
+			absent := make([]byteRange, 0, len(e.Missing))
+			for _, r := range e.Missing {
+				absent = append(absent, byteRange{offset: r[0], length: r[1]})
+			}
+			obj.blocks = restoreBlockMap(e.RemoteSize, CACHE_BLOCK_SIZE, absent)
+			obj.downloaded = false
+		}
+		obj.dirty = true
+		obj.gen = e.Gen
+		obj.journaledAbsent = obj.absentSize()
+		obj.setAttr(uint64(st.Size()), st.ModTime())
+
+		if err = obj.Upload(); err != nil {
+			log.Warnf("[mapper] Can't upload the recovered changes of %s, try again later. %v", e.Path, err)
+			if m.uploader != nil {
+				m.uploader.enqueue(obj)
+			}
+		}
+	}
+}
+
+// UnrecoverableUploads returns the journal entries of local changes that could not be recovered after a crash.
+func (m *ObjectMapper) UnrecoverableUploads() []JournalEntry {
+	return m.journal.unrecoverable()
+}
+
+// ForgetUnrecoverableUploads removes the unrecoverable entries from the journal.
+func (m *ObjectMapper) ForgetUnrecoverableUploads() error {
+	return m.journal.forgetLost()
+}
+
+// Close uploads the pending changes up to timeout, saves the state of the local cache and releases the cache directory.
+// It returns the paths of the objects that failed to upload. Their changes are recovered on the next mount.
+func (m *ObjectMapper) Close(timeout time.Duration) []string {
+	abandoned := m.uploader.close(timeout)
+	m.journal.close()
+	m.cache.close()
+	return abandoned
+}
+
+// PendingUploads returns the paths of the objects that have local changes waiting for uploading.
+func (m *ObjectMapper) PendingUploads() []string {
+	return m.uploader.pending()
+}
+
+// DrainUploads uploads the pending changes immediately, and waits for them up to timeout.
+// It returns the paths of the objects that are still waiting.
+func (m *ObjectMapper) DrainUploads(timeout time.Duration) []string {
+	return m.uploader.drain(timeout)
+}
+
+// CacheUsage returns the size(bytes) and the number of the local files.
+func (m *ObjectMapper) CacheUsage() (bytes int64, files int) {
+	return m.cache.usage()
+}
+
+// Reconfigure applies the tunables of the reloaded config. See config.Reload().
+// Objects that were already listed keep the download concurrency.
+func (m *ObjectMapper) Reconfigure(c *config.Config) {
+	m.tunableLock.Lock()
+	m.objectCacheTime = c.ObjectCacheTime
+	m.downloadConcurrency = c.DownloadConcurrency
+	m.tunableLock.Unlock()
+
+	m.cache.setLimits(c.CacheSize, c.CacheFiles)
+	m.uploader.reconfigure(c.UploadWorkers, c.UploadDelay, c.UploadRetries)
+}
+
+// tunables returns the object cache time and the download concurrency.
+func (m *ObjectMapper) tunables() (objectCacheTime int, downloadConcurrency int) {
+	m.tunableLock.Lock()
+	defer m.tunableLock.Unlock()
+	return m.objectCacheTime, m.downloadConcurrency
+}
+
+func (m *ObjectMapper) newObject(path string, t int) *object {
+	_, concurrency := m.tunables()
+
+	obj := newObject(m.storage, path, t)
+	obj.concurrency = concurrency
+	obj.cache = m.cache
+	obj.uploader = m.uploader
+	obj.journal = m.journal
+	return obj
+}
+
 // ----- Sync between local and object storage
+// syncObjects appends the listed objects. The objects are kept if the listing failed.
 func (m *ObjectMapper) syncObjects() error {
 	log.Debugf("syncObject() begin")
-	objch, n := m.swift.List()
+	objch, n, errch := m.storage.List()
 
 N:
 	for {
@@ -71,32 +252,71 @@ N:
 				t = FILE
 			}
 
-			log.Debugf("[mapper] syncObject() append %s %s", s.Name, s.ContentType)
-
-			obj := newObject(m.swift, s.Name, t)
-			obj.Size = uint64(s.Bytes)
-
 			// gophercloudがタイムゾーンを考慮しないで返してくるっぽい？
 			lm, err := time.Parse(time.RFC3339, s.LastModified+"Z")
 			if err != nil {
 				log.Debugf("Invalid time format[%s]", s.LastModified)
 				lm = time.Now()
 			}
+
+			// Keep the object and its local file if it was not changed.
+			// The object that has local changes or is opened is also kept.
+			if old, ok := m.objects[s.Name]; ok {
+				if hash, modified := old.remote(); old.Type == t && hash == s.Hash && modified.Unix() == lm.Unix() {
+					continue
+				} else if !m.cache.discard(old) {
+					log.Debugf("[mapper] syncObject() keep %s in use", s.Name)
+					continue
+				}
+			}
+
+			log.Debugf("[mapper] syncObject() append %s %s", s.Name, s.ContentType)
+
+			obj := m.newObject(s.Name, t)
+			obj.Size = uint64(s.Bytes)
+			obj.hash = s.Hash
+			obj.modified = lm
 			obj.Mtime = lm
 
+			// The listing reports the size of DLO manifest itself (0 byte).
+			if t == FILE && s.Bytes == 0 {
+				m.resolveManifest(obj)
+			}
+
+			if t == FILE {
+				m.cache.restore(obj)
+			}
 			m.objects[s.Name] = obj
 
 		case num := <-n:
 			log.Debugf("syncObject() %d objects were appended", num)
 			break N
+
+		case err := <-errch:
+			log.Warnf("[mapper] Can't list objects, keep the previous objects. %v", err)
+			return err
 		}
 	}
 	return nil
 }
 
+// resolveManifest sets the logical size to the object if it is a large object.
+func (m *ObjectMapper) resolveManifest(obj *object) {
+	info, err := m.storage.Head(obj.Path)
+	if err != nil {
+		log.Debugf("[mapper] Can't get information of %s %v", obj.Path, err)
+		return
+	}
+
+	obj.manifest = info.Manifest
+	if info.Manifest != openstack.MANIFEST_NONE {
+		obj.Size = uint64(info.Size)
+	}
+}
+
 // ----- Stat operation
 func (m *ObjectMapper) Stat() (openstack.Container, error) {
-	return m.swift.GetContainer()
+	return m.storage.GetContainer()
 }
 
 // ----- File operations
@@ -115,11 +335,11 @@ func (m *ObjectMapper) Create(path string) (obj *object, err error) {
 		return nil, fmt.Errorf("Object already exists(localpath=%s)", path)
 	}
 
-	obj = newObject(m.swift, path, FILE)
+	obj = m.newObject(path, FILE)
 	m.objects[path] = obj
 
 	// upload to object storage
-	if err = m.swift.Upload(path, strings.NewReader("")); err != nil {
+	if err = m.storage.Upload(path, strings.NewReader("")); err != nil {
 		return nil, err
 	}
 
@@ -134,52 +354,68 @@ func (m *ObjectMapper) Rename(oldPath string, newPath string) (err error) {
 		return fmt.Errorf("Object (%s) not found", oldPath)
 	}
 
-	// Copy localfile
-	from, err := obj.Open(os.O_RDONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer from.Close()
+	// The changes not uploaded yet are uploaded to the new object.
+	pending := m.uploader.cancel(obj)
 
-	newobj := newObject(m.swift, newPath, obj.Type)
-	to, err := newobj.Open(os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
-	if err != nil {
+	// Coping on object storage
+	if err = m.storage.Copy(oldPath, newPath); err != nil {
+		if pending {
+			m.uploader.enqueue(obj)
+		}
 		return err
 	}
-	defer to.Close()
 
-	n, err := io.Copy(to, from)
-	if err != nil {
-		os.Remove(to.Name())
-		return err
+	newobj := m.newObject(newPath, obj.Type)
+	newobj.Size, newobj.Mtime = obj.Attr()
+	newobj.manifest = obj.manifest
+	if info, err := m.storage.Head(newPath); err == nil {
+		newobj.hash = info.Hash
+		newobj.modified = info.LastModified
 	}
 
-	st, _ := os.Stat(newobj.Localpath())
-	if st.Size() != n {
-		os.Remove(to.Name())
-		return fmt.Errorf("Copy() error")
+	// Move localfile. Blocks that have not been fetched yet are fetched from the new object later.
+	moved := false
+	obj.fetchLock.Lock()
+	if _, err := os.Stat(obj.Localpath()); err == nil {
+		if err = os.MkdirAll(filepath.Dir(newobj.Localpath()), 0700); err == nil {
+			err = os.Rename(obj.Localpath(), newobj.Localpath())
+		}
+		if err != nil {
+			log.Warnf("[mapper] Can't move the local file of %s, %v", oldPath, err)
+		} else {
+			newobj.blocks = obj.blocks
+			newobj.downloaded = obj.downloaded
+			newobj.dirty = obj.dirty
+			newobj.gen = obj.gen
+			moved = true
+		}
 	}
-
-	// Flush new object
-	if err = newobj.Flush(); err != nil {
-		return err
+	obj.fetchLock.Unlock()
+
+	m.cache.remove(obj)
+	if moved {
+		m.cache.commit(newobj)
+		if newobj.dirty {
+			newobj.journaledAbsent = newobj.absentSize()
+			m.journal.dirty(newobj.journalEntry())
+			newobj.Commit()
+		}
 	}
+	m.journal.discard(oldPath)
 
-	// Append new object
+	// Append new object after coping succeeded
 	// Do not use Set() method. We should use Copy() method.
 	m.objects[newPath] = newobj
 
-	// Coping on object storage
-	if err = m.swift.Copy(oldPath, newPath); err != nil {
-		os.Remove(to.Name())
-		return err
-	}
-
-	// Delete old object
-	return m.Delete(oldPath)
+	// Delete old object. Segments are shared with the new object if it is a large object.
+	return m.delete(oldPath, false)
 }
 
 func (m *ObjectMapper) Delete(path string) (err error) {
+	return m.delete(path, true)
+}
+
+func (m *ObjectMapper) delete(path string, withSegments bool) (err error) {
 	log.Debugf("[mapper] Delete %s", path)
 
 	obj, ok := m.objects[path]
@@ -187,13 +423,30 @@ func (m *ObjectMapper) Delete(path string) (err error) {
 		return fmt.Errorf("Object (%s) not found", path)
 	}
 
-	if err := m.swift.Delete(path); err != nil {
+	m.uploader.cancel(obj)
+	m.journal.discard(path)
+
+	var segments []openstack.Segment
+	if withSegments && obj.Type == FILE {
+		if info, err := m.storage.Head(path); err == nil {
+			segments = info.DeletableSegments()
+		}
+	}
+
+	if err := m.storage.Delete(path); err != nil {
 		return err
 	}
 
+	if len(segments) > 0 {
+		if err := m.storage.DeleteSegments(segments); err != nil {
+			log.Warnf("[mapper] Can't delete segments of %s %v", path, err)
+		}
+	}
+
 	// Directory does not have localpath.
 	if obj.Type == FILE {
-		if err := os.Remove(obj.Localpath()); err != nil {
+		m.cache.remove(obj)
+		if err := os.Remove(obj.Localpath()); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	} else {
@@ -208,10 +461,13 @@ func (m *ObjectMapper) Delete(path string) (err error) {
 func (m *ObjectMapper) OpenDir(dirname string) []*object {
 	log.Debugf("[mapper] OpenDir %s", dirname)
 
+	// The listing is tried again on the next call if it failed.
+	objectCacheTime, _ := m.tunables()
 	d := time.Since(m.lastCached)
-	if d.Seconds() > float64(m.objectCacheTime) {
-		m.syncObjects()
-		m.lastCached = time.Now()
+	if d.Seconds() > float64(objectCacheTime) {
+		if err := m.syncObjects(); err == nil {
+			m.lastCached = time.Now()
+		}
 	}
 
 	i := 0
@@ -236,10 +492,10 @@ func (m *ObjectMapper) Mkdir(path string) (obj *object, err error) {
 		return o, fmt.Errorf("Object already exists(localpath=%s)", path)
 	}
 
-	obj = newObject(m.swift, path, DIRECTORY)
+	obj = m.newObject(path, DIRECTORY)
 	m.objects[path] = obj
 
-	if err = m.swift.MakeDirectory(path); err != nil {
+	if err = m.storage.MakeDirectory(path); err != nil {
 		return nil, err
 	}
 
@@ -249,13 +505,12 @@ func (m *ObjectMapper) Mkdir(path string) (obj *object, err error) {
 func (m *ObjectMapper) Rmdir(path string) error {
 	for _, obj := range m.OpenDir(path) {
 		if obj.Type == DIRECTORY {
-			if err := m.Rmdir(obj.Name); err != nil {
+			if err := m.Rmdir(obj.Path); err != nil {
 				return err
 			}
 		} else {
-			p := filepath.Join(path, obj.Name)
-			log.Debugf("[mapper] Rmdir %s ", p)
-			if err := m.Delete(p); err != nil {
+			log.Debugf("[mapper] Rmdir %s ", obj.Path)
+			if err := m.Delete(obj.Path); err != nil {
 				return err
 			}
 		}
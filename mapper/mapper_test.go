@@ -1,43 +1,46 @@
 package mapper
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
 )
 
 var mapper *ObjectMapper
 
 func initMapper() {
 	mapper.objects = map[string]*object{}
-	swift.DeleteContainer()
-	swift.CreateContainer()
+	storage.DeleteContainer()
+	storage.CreateContainer()
+	storage.Reset()
 }
 
 func TestNewObjectMapper(t *testing.T) {
 	// if we need debug messages, please comment it out.
 	// logrus.SetLevel(logrus.DebugLevel)
 
-	// init swift
-	if err := initSwift(); err != nil {
-		t.Fatalf("%v", err)
-	}
-	swift.DeleteContainer()
-	swift.CreateContainer()
+	// init storage
+	initStorage()
 
 	// Upload test directory and test data before initialize mapper
 	dirname := "test-directory"
-	swift.Upload(TEST_OBJECT, strings.NewReader(TEST_DATA))
-	swift.MakeDirectory(dirname)
+	storage.Upload(TEST_OBJECT, strings.NewReader(TEST_DATA))
+	storage.MakeDirectory(dirname)
 
 	// init mapper
 	c := config.NewConfig()
 	c.ContainerName = TEST_CONTAINER
-	mapper, _ = NewObjectMapper(c)
+	c.CacheDirectory = testDir
+	mapper, _ = NewObjectMapper(c, storage)
 
 	// test to exist local file or directory by syncObject()
 	obj, ok := mapper.objects[dirname]
@@ -81,13 +84,13 @@ func TestCreate(t *testing.T) {
 	}
 
 	// object exists on object storage?
-	r := swift.Get(objname)
+	r := storage.Get(objname)
 	if r.Body == nil {
 		t.Fatalf("object %s was created but not found on object storage", objname)
 	}
 	defer r.Body.Close()
 
-	swift.Delete(objname)
+	storage.Delete(objname)
 }
 
 func TestRename(t *testing.T) {
@@ -97,21 +100,37 @@ func TestRename(t *testing.T) {
 	objfrom := TEST_OBJECT + "-from"
 	objto := TEST_OBJECT + "-to"
 
-	_, err = mapper.Create(objfrom)
+	from, err := mapper.Create(objfrom)
 	if err != nil {
 		t.Fatalf("create error %s", err)
 	}
 
+	file, err := from.Open(os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.WriteString(TEST_DATA)
+	file.Close()
+	if err = from.Upload(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
 	if err = mapper.Rename(objfrom, objto); err != nil {
 		t.Fatalf("rename error %s", err)
 	}
 
-	// local file exists ?
+	// local file was moved ?
 	obj, _ := mapper.Get(objto)
-	_, err = os.Stat(obj.Localpath())
+	data, err := ioutil.ReadFile(obj.Localpath())
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
+	if string(data) != TEST_DATA {
+		t.Errorf("local file of the renamed object is %q", data)
+	}
+	if _, err = os.Stat(from.Localpath()); !os.IsNotExist(err) {
+		t.Errorf("local file of the old object still exists")
+	}
 }
 
 func TestDelete(t *testing.T) {
@@ -150,7 +169,7 @@ func TestMkdir(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 
-	r := swift.Get(dir.Name)
+	r := storage.Get(dir.Name)
 	if r.Body == nil {
 		t.Fatalf("Directory was not created on object storage")
 	}
@@ -185,11 +204,11 @@ func TestRmdir(t *testing.T) {
 	}
 
 	// following requests should be 404 status.
-	r := swift.Get(TEST_DIRECTORY)
+	r := storage.Get(TEST_DIRECTORY)
 	if r.Err == nil {
 		t.Fatalf("Directory still exists on object storage")
 	}
-	r = swift.Get(objname)
+	r = storage.Get(objname)
 	if r.Err == nil {
 		t.Fatalf("Object still exists on object storage")
 	}
@@ -221,3 +240,243 @@ func TestOpenDir(t *testing.T) {
 		t.Fatalf("count of objects is not match %d != %d", len(objects), num)
 	}
 }
+
+func TestRenameCopyError(t *testing.T) {
+	var err error
+	initMapper()
+
+	objfrom := TEST_OBJECT + "-from"
+	objto := TEST_OBJECT + "-to"
+
+	if _, err = mapper.Create(objfrom); err != nil {
+		t.Fatalf("create error %s", err)
+	}
+
+	storage.SetError(fakeswift.OP_COPY, errors.New("copy failed"))
+	if err = mapper.Rename(objfrom, objto); err == nil {
+		t.Fatalf("Rename() should fail when Copy() on object storage failed")
+	}
+
+	if _, ok := mapper.Get(objfrom); !ok {
+		t.Fatalf("Old object was removed from mapper")
+	}
+	if _, ok := mapper.Get(objto); ok {
+		t.Fatalf("New object was appended to mapper")
+	}
+	if !storage.Exists(objfrom) {
+		t.Fatalf("Old object was removed from object storage")
+	}
+}
+
+func TestDeleteError(t *testing.T) {
+	var err error
+	initMapper()
+
+	objname := TEST_OBJECT + "-test-delete-error"
+	if _, err = mapper.Create(objname); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	storage.SetError(fakeswift.OP_DELETE, errors.New("delete failed"))
+	if err = mapper.Delete(objname); err == nil {
+		t.Fatalf("Delete() should fail when Delete() on object storage failed")
+	}
+
+	if _, ok := mapper.Get(objname); !ok {
+		t.Fatalf("Object was removed from mapper")
+	}
+}
+
+func TestRmdirError(t *testing.T) {
+	var err error
+	initMapper()
+
+	mapper.Mkdir(TEST_DIRECTORY)
+	mapper.Mkdir(filepath.Join(TEST_DIRECTORY, "sub"))
+
+	objname := filepath.Join(TEST_DIRECTORY, "sub", TEST_OBJECT)
+	if _, err = mapper.Create(objname); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	storage.SetObjectError(fakeswift.OP_DELETE, objname, errors.New("delete failed"))
+	if err = mapper.Rmdir(TEST_DIRECTORY); err == nil {
+		t.Fatalf("Rmdir() should fail when Delete() on object storage failed")
+	}
+
+	if _, ok := mapper.Get(TEST_DIRECTORY); !ok {
+		t.Fatalf("Directory was removed from mapper")
+	}
+	if !storage.Exists(objname) {
+		t.Fatalf("Object was removed from object storage")
+	}
+
+	storage.Reset()
+	if err = mapper.Rmdir(TEST_DIRECTORY); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if storage.Exists(objname) || storage.Exists(TEST_DIRECTORY) {
+		t.Fatalf("Objects still exist on object storage")
+	}
+}
+
+func TestLargeObjects(t *testing.T) {
+	var err error
+	initMapper()
+
+	storage.Upload("dlo-segments/00", strings.NewReader("hoge"))
+	storage.Upload("dlo-segments/01", strings.NewReader("fuga"))
+	storage.PutDynamicLargeObject("dlo", "dlo-segments/")
+
+	storage.Upload("slo-segments/00", strings.NewReader(TEST_DATA))
+	storage.PutStaticLargeObject("slo", []string{"slo-segments/00"})
+
+	mapper.syncObjects()
+
+	// size
+	obj, ok := mapper.Get("dlo")
+	if !ok {
+		t.Fatalf("DLO not found")
+	} else if obj.Size != uint64(len("hogefuga")) {
+		t.Errorf("Invalid size of DLO %d", obj.Size)
+	}
+
+	obj, ok = mapper.Get("slo")
+	if !ok {
+		t.Fatalf("SLO not found")
+	} else if obj.Size != uint64(len(TEST_DATA)) {
+		t.Errorf("Invalid size of SLO %d", obj.Size)
+	}
+
+	// rename should keep segments
+	if err = mapper.Rename("dlo", "dlo-renamed"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if data, _ := storage.Data("dlo-renamed"); string(data) != "hogefuga" {
+		t.Errorf("Invalid data of renamed DLO %s", data)
+	}
+	if !storage.Exists("dlo-segments/00") {
+		t.Errorf("Segments were deleted by renaming")
+	}
+
+	// delete should keep segments of DLO, since other files may match the prefix
+	storage.Upload("dlo-segments/memo.txt", strings.NewReader("memo"))
+	mapper.syncObjects()
+	if err = mapper.Delete("dlo-renamed"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !storage.Exists("dlo-segments/memo.txt") {
+		t.Errorf("A file under the prefix of DLO was deleted")
+	}
+	if !storage.Exists("dlo-segments/00") || !storage.Exists("dlo-segments/01") {
+		t.Errorf("Segments of DLO were deleted")
+	}
+
+	// overwriting DLO should keep segments too
+	storage.PutDynamicLargeObject("dlo", "dlo-segments/")
+	mapper.syncObjects()
+	obj, _ = mapper.Get("dlo")
+	file, err := obj.Open(os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.WriteString("new data")
+	file.Close()
+
+	if err = obj.Upload(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !storage.Exists("dlo-segments/memo.txt") || !storage.Exists("dlo-segments/00") {
+		t.Errorf("Files under the prefix of DLO were deleted by overwriting")
+	}
+
+	// overwriting should remove old segments of SLO
+	obj, _ = mapper.Get("slo")
+	file, err = obj.Open(os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.WriteString("new data")
+	file.Close()
+
+	if err = obj.Upload(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if storage.Exists("slo-segments/00") {
+		t.Errorf("Old segments of SLO still exist")
+	}
+	if data, _ := storage.Data("slo"); string(data) != "new data" {
+		t.Errorf("Invalid data of overwritten SLO %s", data)
+	}
+}
+
+func TestSyncObjectsError(t *testing.T) {
+	initMapper()
+
+	mapper.Create(TEST_OBJECT)
+	storage.Delete(TEST_OBJECT)
+
+	// Objects are kept if the listing failed, and it is tried again.
+	storage.SetError(fakeswift.OP_LIST, errors.New("list failed"))
+	mapper.lastCached = time.Time{}
+	if objects := mapper.OpenDir(""); len(objects) != 1 {
+		t.Errorf("Objects were changed by the failed listing %v", objects)
+	}
+	if !mapper.lastCached.IsZero() {
+		t.Errorf("Failed listing should be tried again")
+	}
+
+	storage.Reset()
+	mapper.OpenDir("")
+	if mapper.lastCached.IsZero() {
+		t.Errorf("Listing was not tried again")
+	}
+}
+
+func TestNewObjectMapperError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "swiftfs-mapper")
+	defer os.RemoveAll(dir)
+
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER
+	c.CacheDirectory = dir
+
+	storage.SetError(fakeswift.OP_LIST, errors.New("list failed"))
+	defer storage.Reset()
+	if _, err := NewObjectMapper(c, storage); err == nil {
+		t.Fatalf("NewObjectMapper should fail")
+	}
+
+	// The cache directory is released by the failed mount.
+	cmd := exec.Command(os.Args[0], "-test.run=TestCacheLockHelper")
+	cmd.Env = append(os.Environ(), "SWIFTFS_TEST_CACHE_DIR="+c.MountCacheDirectory())
+	if err := cmd.Run(); err == nil {
+		t.Errorf("other process could not use the cache directory of the failed mount")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	initMapper()
+
+	c := config.NewConfig()
+	c.ObjectCacheTime = 60
+	c.DownloadConcurrency = 2
+	defer mapper.Reconfigure(config.NewConfig())
+
+	// Reconfigure() is called by the signal handler while the file system is used.
+	done := make(chan struct{})
+	go func() {
+		mapper.Reconfigure(c)
+		close(done)
+	}()
+	mapper.OpenDir("")
+	mapper.Create(TEST_OBJECT + "-reconfigure")
+	<-done
+
+	if cacheTime, concurrency := mapper.tunables(); cacheTime != 60 || concurrency != 2 {
+		t.Errorf("Invalid tunables %d %d", cacheTime, concurrency)
+	}
+	if obj, _ := mapper.Create(TEST_OBJECT + "-reconfigure-new"); obj.concurrency != 2 {
+		t.Errorf("New object does not use the download concurrency %d", obj.concurrency)
+	}
+}
@@ -1,10 +1,13 @@
 package mapper
 
 import (
+	"container/list"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -21,7 +24,26 @@ type Object interface {
 	Open(flag int, perm os.FileMode) (*os.File, error)
 	Flush() error
 	Upload() error
+
+	// Commit uploads the local changes. They are uploaded in background if write-back is enabled.
+	Commit() error
+
+	// Sync uploads the local changes immediately even if write-back is enabled.
+	Sync() error
 	download() error
+
+	// Release should be called when the file returned by Open() is closed.
+	Release()
+
+	// Fetch makes [off, off+size) of the local file readable by downloading missing blocks.
+	Fetch(off int64, size int64) error
+
+	// FetchForWrite prepares the local file for a write to [off, off+size).
+	// Blocks overwritten partially are downloaded, the others are not.
+	FetchForWrite(off int64, size int64) error
+
+	// Truncated should be called after the local file is truncated.
+	Truncated(size int64) error
 }
 
 type object struct {
@@ -33,29 +55,115 @@ type object struct {
 	Size  uint64
 	Mtime time.Time
 
-	swift      *openstack.Swift
+	storage    openstack.ObjectStorage
 	downloaded bool
+
+	// Hash and Last-Modified in the object storage, and kind of manifest.
+	// They are used to check whether the object was changed at syncObjects().
+	hash     string
+	modified time.Time
+	manifest int
+
+	// Size, Mtime, hash and modified are updated by the upload worker.
+	// Use Attr() and remote() to read them while the object may be uploading.
+	attrLock sync.Mutex
+
+	// The local file has changes that are not uploaded.
+	// gen is the generation of the last change, that is recorded to the journal.
+	// journaledAbsent is the size of the blocks that were not fetched when the change was recorded.
+	dirty           bool
+	gen             uint64
+	journal         *journal
+	journaledAbsent int64
+
+	// Blocks of the local file that have been fetched. nil means the local file is complete.
+	blocks    *blockMap
+	fetchLock sync.Mutex
+	fetchCond *sync.Cond
+
+	// The number of range requests that are sent in parallel.
+	concurrency int
+
+	// Uploads the local changes in background. nil means they are uploaded synchronously.
+	uploader *uploader
+
+	// Fields for the cache manager. They are protected by the lock of the cache manager.
+	cache      *cacheManager
+	cacheElem  *list.Element
+	cacheSize  int64
+	openCount  int
+	lastAccess time.Time
+}
+
+// Attr returns the size and the modification time.
+func (o *object) Attr() (size uint64, mtime time.Time) {
+	o.attrLock.Lock()
+	defer o.attrLock.Unlock()
+	return o.Size, o.Mtime
+}
+
+func (o *object) setAttr(size uint64, mtime time.Time) {
+	o.attrLock.Lock()
+	defer o.attrLock.Unlock()
+	o.Size = size
+	o.Mtime = mtime
+}
+
+// remote returns the hash and Last-Modified in the object storage.
+func (o *object) remote() (hash string, modified time.Time) {
+	o.attrLock.Lock()
+	defer o.attrLock.Unlock()
+	return o.hash, o.modified
+}
+
+func (o *object) setRemote(hash string, modified time.Time) {
+	o.attrLock.Lock()
+	defer o.attrLock.Unlock()
+	o.hash = hash
+	o.modified = modified
 }
 
+// Localpath returns the path of the local file in the cache directory of the mapper.
 func (o *object) Localpath() string {
-	p := strings.Replace(o.Path, "/", "-", -1)
-	return filepath.Join(os.TempDir(), "swiftfs", p)
+	return o.cache.localpath(o.Path)
 }
 
 // Open Temporary file
 // Need to call close() after useing.
 func (o *object) Open(flag int, perm os.FileMode) (*os.File, error) {
+	file, err := o.open(flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	o.cache.open(o)
+	return file, nil
+}
+
+func (o *object) open(flag int, perm os.FileMode) (*os.File, error) {
+	o.fetchLock.Lock()
+	defer o.fetchLock.Unlock()
+
+	// The filedata is not downloaded when the filesystem opens a localfile.
+	// Create a sparse file that has the same size as the object, then Fetch() downloads blocks of it on demand.
+	// But, it does not need to download if O_TRUNC flag passed.
+	if err := os.MkdirAll(filepath.Dir(o.Localpath()), 0700); err != nil {
+		return nil, err
+	}
 
-	// Download the filedata from the object storage when filesystem try to open an localfile
-	// But, it does not need to download if O_TRUNC or O_CREATE flag passed.
 	_, err := os.Stat(o.Localpath())
-	if (flag&os.O_TRUNC == 0 && flag&os.O_CREATE == 0) && err != nil {
-		log.Debugf("Open temporary file %s with downloading flag:%d %v", o.Path, flag, err)
-		if err := o.download(); err != nil {
-			log.Warnf("Download error %s, %v", o.Path, err)
+	if flag&os.O_TRUNC != 0 {
+		log.Debugf("Open temporary file %s flag:%d", o.Path, flag)
+		o.blocks = nil
+		if err := o.markDirty(); err != nil {
+			return nil, err
+		}
+
+	} else if err != nil {
+		log.Debugf("Open temporary file %s as a sparse file flag:%d", o.Path, flag)
+		if err := o.createSparseFile(); err != nil {
 			return nil, err
 		}
-		o.downloaded = true
 
 	} else {
 		log.Debugf("Open temporary file %s flag:%d", o.Path, flag)
@@ -69,7 +177,287 @@ func (o *object) Open(flag int, perm os.FileMode) (*os.File, error) {
 	return file, err
 }
 
+func (o *object) createSparseFile() error {
+	file, err := os.OpenFile(o.Localpath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	size, _ := o.Attr()
+	if err = file.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	if size > 0 {
+		o.blocks = newBlockMap(int64(size), CACHE_BLOCK_SIZE)
+	} else {
+		o.blocks = nil
+	}
+	return nil
+}
+
+func (o *object) Release() {
+	o.cache.release(o)
+}
+
+// evict removes the local file if it has no local changes and is not being fetched.
+func (o *object) evict() bool {
+	o.fetchLock.Lock()
+	defer o.fetchLock.Unlock()
+
+	if o.dirty || (o.blocks != nil && o.blocks.busy(0, o.blocks.remoteSize)) {
+		return false
+	}
+
+	os.Remove(o.Localpath())
+	o.blocks = nil
+	o.downloaded = false
+	return true
+}
+
+func (o *object) Fetch(off int64, size int64) error {
+	o.fetchLock.Lock()
+	defer o.fetchLock.Unlock()
+
+	return o.fetch(off, size)
+}
+
+func (o *object) FetchForWrite(off int64, size int64) error {
+	o.fetchLock.Lock()
+	defer o.fetchLock.Unlock()
+
+	if o.blocks == nil || size <= 0 {
+		return o.markDirty()
+	}
+
+	// Only the blocks at both edges of the write need to be downloaded.
+	bs := o.blocks.blockSize
+	if off%bs != 0 {
+		if err := o.fetch(off, 1); err != nil {
+			return err
+		}
+	}
+	if end := off + size; end%bs != 0 && o.blocks != nil && end < o.blocks.remoteSize {
+		if err := o.fetch(end-1, 1); err != nil {
+			return err
+		}
+	}
+
+	// Blocks entirely overwritten must not be downloaded later.
+	if o.blocks != nil {
+		o.blocks.markPresent(off, size)
+	}
+	return o.markDirty()
+}
+
+func (o *object) Truncated(size int64) error {
+	o.fetchLock.Lock()
+	defer o.fetchLock.Unlock()
+
+	if o.blocks != nil {
+		o.blocks.truncate(size)
+	}
+	return o.markDirty()
+}
+
+// markDirty records a change of the local file to the journal. Need to hold fetchLock.
+// The blocks that are not fetched yet are recorded too, they are fetched before uploading even after a crash.
+func (o *object) markDirty() error {
+	if o.blocks != nil && o.blocks.complete() {
+		o.blocks = nil
+		o.downloaded = true
+	}
+
+	if o.journal != nil {
+		o.gen = o.journal.next()
+	} else {
+		o.gen++
+	}
+
+	// Blocks that are not fetched only decrease, the record is written again when they decreased.
+	absent := o.absentSize()
+	if !o.dirty || absent != o.journaledAbsent {
+		if err := o.journal.dirty(o.journalEntry()); err != nil {
+			log.Warnf("[mapper] Can't write the journal %s, %v", o.Path, err)
+			return err
+		}
+		o.dirty = true
+		o.journaledAbsent = absent
+	}
+	return nil
+}
+
+// journalEntry returns the record of the local changes. Need to hold fetchLock.
+func (o *object) journalEntry() JournalEntry {
+	e := JournalEntry{Path: o.Path, File: o.Localpath(), Gen: o.gen}
+	if o.blocks != nil {
+		for _, r := range o.blocks.absent() {
+			e.Missing = append(e.Missing, [2]int64{r.offset, r.length})
+		}
+		e.RemoteSize = o.blocks.remoteSize
+		e.Hash, _ = o.remote()
+	}
+	return e
+}
+
+// absentSize returns the size of the blocks that are not fetched. Need to hold fetchLock.
+func (o *object) absentSize() (size int64) {
+	if o.blocks != nil {
+		for _, r := range o.blocks.absent() {
+			size += r.length
+		}
+	}
+	return size
+}
+
+// fetch downloads the missing blocks in [off, off+size). Need to hold fetchLock.
+// The blocks are downloaded in parallel, and blocks being fetched by other goroutines are waited for.
+func (o *object) fetch(off int64, size int64) error {
+	for o.blocks != nil {
+		b := o.blocks
+
+		ranges := b.missing(off, size)
+		if len(ranges) == 0 {
+			if !b.busy(off, size) {
+				break
+			}
+			o.cond().Wait()
+			continue
+		}
+
+		if err := o.fetchBlocks(b, b.split(ranges, o.concurrency)); err != nil {
+			return err
+		}
+	}
+
+	if o.blocks != nil && o.blocks.complete() {
+		o.blocks = nil
+		o.downloaded = true
+	}
+	return nil
+}
+
+// fetchBlocks downloads the pieces of consecutive blocks with concurrent range requests.
+// fetchLock is released while downloading.
+func (o *object) fetchBlocks(b *blockMap, blocks []byteRange) error {
+	for _, r := range blocks {
+		b.setFetching(r.offset, r.length, true)
+	}
+
+	o.fetchLock.Unlock()
+	defer o.fetchLock.Lock()
+
+	concurrency := o.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	errs := make(chan error, len(blocks))
+	wg := sync.WaitGroup{}
+	for _, r := range blocks {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r byteRange) {
+			defer wg.Done()
+
+			data, err := o.fetchRange(r.offset, r.length)
+			<-sem
+
+			o.fetchLock.Lock()
+			defer o.fetchLock.Unlock()
+
+			// The local file may be truncated while downloading.
+			if err == nil && o.blocks == b {
+				if end := r.offset + int64(len(data)); end > b.remoteSize {
+					data = data[:max64(b.remoteSize-r.offset, 0)]
+				}
+				if err = o.writeLocal(data, r.offset); err == nil {
+					b.markPresent(r.offset, r.length)
+				}
+			}
+			b.setFetching(r.offset, r.length, false)
+			o.cond().Broadcast()
+
+			if err != nil {
+				log.Warnf("Download error %s offset=%d length=%d, %v", o.Path, r.offset, r.length, err)
+				errs <- err
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	close(errs)
+	return <-errs
+}
+
+// fetchRange downloads the range of the object.
+func (o *object) fetchRange(off int64, length int64) ([]byte, error) {
+	result := o.storage.GetRange(o.Path, off, length)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	defer result.Body.Close()
+
+	// The server may ignore Range header and return whole of the object.
+	body := io.Reader(result.Body)
+	if result.Header.Get("Content-Range") == "" && off > 0 {
+		if _, err := io.CopyN(ioutil.Discard, body, off); err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, length)
+	if n, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("Short read %s (%d bytes of %d) %v", o.Path, n, length, err)
+	}
+	return data, nil
+}
+
+// writeLocal writes the data to the same position of the local file.
+func (o *object) writeLocal(data []byte, off int64) error {
+	file, err := os.OpenFile(o.Localpath(), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(data, off)
+	return err
+}
+
+// cond returns the condition variable to wait for blocks being fetched. Need to hold fetchLock.
+func (o *object) cond() *sync.Cond {
+	if o.fetchCond == nil {
+		o.fetchCond = sync.NewCond(&o.fetchLock)
+	}
+	return o.fetchCond
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func (o *object) download() error {
+	o.fetchLock.Lock()
+	defer o.fetchLock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(o.Localpath()), 0700); err != nil {
+		return err
+	}
+
+	// Large objects are downloaded with parallel range requests.
+	if size, _ := o.Attr(); o.concurrency > 1 && size > CACHE_BLOCK_SIZE {
+		if err := o.createSparseFile(); err != nil {
+			return err
+		}
+		return o.fetch(0, int64(size))
+	}
+
 	// Do not use o.Open() method.
 	file, err := os.OpenFile(o.Localpath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
@@ -77,13 +465,18 @@ func (o *object) download() error {
 	}
 	defer file.Close()
 
-	result := o.swift.Get(o.Path)
+	result := o.storage.Get(o.Path)
+	if result.Err != nil {
+		return result.Err
+	}
 	defer result.Body.Close()
 
 	if _, err = io.Copy(file, result.Body); err != nil {
 		return err
 	}
 
+	o.blocks = nil
+	o.downloaded = true
 	return nil
 }
 
@@ -100,13 +493,28 @@ func (o *object) Flush() (err error) {
 	if err != nil {
 		return err
 	}
-	o.Size = uint64(stat.Size())
-	o.Mtime = stat.ModTime()
-
+	o.setAttr(uint64(stat.Size()), stat.ModTime())
 	return nil
 }
 
 func (o *object) Upload() (err error) {
+	return o.upload(nil)
+}
+
+// upload uploads the local file to the object storage.
+// If cancelled returns true after uploading, e.g. the object was deleted while uploading,
+// the result is thrown away and the uploaded object is deleted.
+func (o *object) upload(cancelled func() bool) (err error) {
+	// The local file should be complete before uploading.
+	size, _ := o.Attr()
+	if err = o.Fetch(0, int64(size)); err != nil {
+		return err
+	}
+
+	o.fetchLock.Lock()
+	gen := o.gen
+	o.fetchLock.Unlock()
+
 	// Do not use o.Open() method.
 	file, err := os.OpenFile(o.Localpath(), os.O_RDONLY, 0644)
 	if err != nil {
@@ -117,11 +525,94 @@ func (o *object) Upload() (err error) {
 	// Flush
 	o.Flush()
 
+	// Segments of the large object will be orphaned by overwriting.
+	var segments []openstack.Segment
+	if info, err := o.storage.Head(o.Path); err == nil {
+		segments = info.DeletableSegments()
+	}
+
 	// upload to object storage
-	return o.swift.Upload(o.Path, file)
+	if err = o.storage.Upload(o.Path, file); err != nil {
+		return err
+	}
+
+	// The hash and Last-Modified are needed to reuse the local file as a cache.
+	info, headErr := o.storage.Head(o.Path)
+
+	// The object is still dirty if it was changed while uploading.
+	o.fetchLock.Lock()
+	if cancelled != nil && cancelled() {
+		o.fetchLock.Unlock()
+		log.Debugf("[mapper] Upload of %s was cancelled, delete the uploaded object", o.Path)
+		if headErr == nil {
+			o.deleteUploaded(info)
+		}
+
+	} else {
+		if o.dirty && o.gen == gen {
+			o.dirty = false
+			if err := o.journal.clean(o.Path, gen); err != nil {
+				log.Warnf("[mapper] Can't write the journal %s, %v", o.Path, err)
+			}
+		}
+		o.downloaded = true
+		o.fetchLock.Unlock()
+
+		if headErr == nil {
+			o.setRemote(info.Hash, info.LastModified)
+		}
+		o.cache.commit(o)
+	}
+
+	if len(segments) > 0 {
+		if err := o.storage.DeleteSegments(segments); err != nil {
+			log.Warnf("Can't delete old segments of %s, %v", o.Path, err)
+		}
+	}
+	return nil
+}
+
+// deleteUploaded deletes the object uploaded by the cancelled upload.
+// It is kept if the object was replaced after the upload, e.g. a new file of the same name was created.
+func (o *object) deleteUploaded(uploaded openstack.ObjectInfo) {
+	info, err := o.storage.Head(o.Path)
+	if err != nil || info.Hash != uploaded.Hash || !info.LastModified.Equal(uploaded.LastModified) {
+		return
+	}
+
+	if err = o.storage.Delete(o.Path); err != nil {
+		log.Warnf("[mapper] Can't delete %s uploaded by the cancelled upload, %v", o.Path, err)
+		return
+	}
+	if segments := info.DeletableSegments(); len(segments) > 0 {
+		if err = o.storage.DeleteSegments(segments); err != nil {
+			log.Warnf("[mapper] Can't delete segments of %s, %v", o.Path, err)
+		}
+	}
+}
+
+func (o *object) Commit() error {
+	if o.uploader == nil {
+		return o.Upload()
+	}
+
+	o.uploader.enqueue(o)
+	return nil
+}
+
+func (o *object) Sync() error {
+	// The queued upload is replaced by this one. It is queued again if this fails.
+	pending := o.uploader.withdraw(o)
+	if err := o.Upload(); err != nil {
+		if pending {
+			o.uploader.enqueue(o)
+		}
+		return err
+	}
+	return nil
 }
 
-func newObject(swift *openstack.Swift, path string, t int) (obj *object) {
+func newObject(storage openstack.ObjectStorage, path string, t int) (obj *object) {
 	name := filepath.Base(path)
 	dir := filepath.Dir(path)
 	if dir == "." {
@@ -137,7 +628,7 @@ func newObject(swift *openstack.Swift, path string, t int) (obj *object) {
 		Size:  0,
 		Mtime: time.Now(),
 
-		swift:      swift,
+		storage:    storage,
 		downloaded: false,
 	}
 	return obj
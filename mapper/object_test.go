@@ -1,16 +1,16 @@
 package mapper
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"strings"
 
-	log "github.com/Sirupsen/logrus"
-	"github.com/hironobu-s/swiftfs/config"
-	"github.com/hironobu-s/swiftfs/openstack"
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
 )
 
 const (
@@ -20,45 +20,56 @@ const (
 	TEST_DATA      = "testdata"
 )
 
-var swift *openstack.Swift
+var storage *fakeswift.Storage
+
+// Local files of the tests are in the temporary directory.
+var testDir string
+var testCache *cacheManager
 
 func TestMain(m *testing.M) {
-	if err := initSwift(); err != nil {
-		log.Errorf("%v", err)
-		os.Exit(1)
-	} else {
-		os.Exit(m.Run())
-	}
-}
+	initStorage()
 
-func initSwift() error {
-	c := config.NewConfig()
-	c.ContainerName = TEST_CONTAINER
+	testDir, _ = ioutil.TempDir("", "swiftfs-mapper")
+	testCache, _ = newCacheManager(filepath.Join(testDir, "objects"), TEST_CONTAINER, 0, 0, nil)
 
-	// initialize swift
-	var err error
-	swift = openstack.NewSwift(c)
-	if err = swift.Auth(); err != nil {
-		return err
-	}
-	if err = swift.DeleteContainer(); err != nil {
-		// 404
-	}
+	code := m.Run()
+	testCache.close()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
 
-	if err = swift.CreateContainer(); err != nil {
-		return err
-	}
-	return nil
+// newTestObject creates an object whose local file is in the temporary directory.
+func newTestObject(path string, t int) *object {
+	o := newObject(storage, path, t)
+	o.cache = testCache
+	return o
+}
+
+func initStorage() {
+	storage = fakeswift.New(TEST_CONTAINER)
+	storage.CreateContainer()
 }
 
 func TestLocalPath(t *testing.T) {
-	path := TEST_OBJECT
-	o := &object{
-		Path: path,
+	o1 := newTestObject("a/b-c", FILE)
+	o2 := newTestObject("a-b/c", FILE)
+
+	if !strings.HasPrefix(o1.Localpath(), testDir+"/") {
+		t.Errorf("localpath %s is not in the temp directory", o1.Localpath())
+	}
+	if o1.Localpath() == o2.Localpath() {
+		t.Errorf("localpath of %s and %s collided", o1.Path, o2.Path)
 	}
 
-	if o.Localpath() != "/tmp/swiftfs/"+TEST_OBJECT {
-		t.Fatalf("localpath mismatched %s != %s", path, o.Localpath())
+	// long names
+	o3 := newTestObject(strings.Repeat("a", 1000)+"/"+strings.Repeat("b", 1000), FILE)
+	if len(filepath.Base(o3.Localpath())) > 255 {
+		t.Errorf("localpath %s is longer than NAME_MAX", o3.Localpath())
+	}
+
+	// containers
+	if cacheLocalpath("/tmp", "c1", "obj") == cacheLocalpath("/tmp", "c2", "obj") {
+		t.Errorf("localpath of objects in different containers collided")
 	}
 }
 
@@ -66,16 +77,13 @@ func TestDownload(t *testing.T) {
 	var err error
 
 	// upload test object
-	if err = swift.Upload(TEST_OBJECT, strings.NewReader(TEST_DATA)); err != nil {
+	if err = storage.Upload(TEST_OBJECT, strings.NewReader(TEST_DATA)); err != nil {
 		t.Fatalf("%v", err)
 	}
 
 	// download test
 	path := TEST_OBJECT
-	o := &object{
-		Path:  path,
-		swift: swift,
-	}
+	o := newTestObject(path, FILE)
 
 	err = o.download()
 	if err != nil {
@@ -97,9 +105,7 @@ func TestDownload(t *testing.T) {
 
 func TestOpen(t *testing.T) {
 	path := TEST_OBJECT
-	o := &object{
-		Path: path,
-	}
+	o := newTestObject(path, FILE)
 
 	file, err := o.Open(os.O_RDWR, 0600)
 	if err != nil {
@@ -113,9 +119,7 @@ func TestOpen(t *testing.T) {
 func TestFlush(t *testing.T) {
 	var err error
 	path := TEST_OBJECT
-	o := &object{
-		Path: path,
-	}
+	o := newTestObject(path, FILE)
 
 	loc, _ := time.LoadLocation("Asia/Tokyo")
 	tt := time.Date(2015, 1, 1, 13, 0, 0, 0, loc)
@@ -135,10 +139,7 @@ func TestUpload(t *testing.T) {
 	var err error
 
 	path := TEST_OBJECT + "2"
-	o := &object{
-		Path:  path,
-		swift: swift,
-	}
+	o := newTestObject(path, FILE)
 
 	file, err := o.Open(os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
@@ -154,9 +155,201 @@ func TestUpload(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 
-	result := swift.Get(path)
+	result := storage.Get(path)
 	data, _ := ioutil.ReadAll(result.Body)
 	if string(data) != TEST_DATA {
 		t.Fatalf("File data does not match TEST_DATA")
 	}
 }
+
+func TestLazyRead(t *testing.T) {
+	var err error
+
+	path := TEST_OBJECT + "-lazy"
+	data := make([]byte, CACHE_BLOCK_SIZE*3+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err = storage.Upload(path, bytes.NewReader(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer storage.Delete(path)
+
+	o := newTestObject(path, FILE)
+	o.Size = uint64(len(data))
+	os.Remove(o.Localpath())
+	defer os.Remove(o.Localpath())
+
+	file, err := o.Open(os.O_RDONLY, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	if st, _ := file.Stat(); st.Size() != int64(len(data)) {
+		t.Fatalf("size of the local file is %d", st.Size())
+	}
+
+	// Only the block that contains the range is downloaded.
+	storage.Reset()
+	off := int64(CACHE_BLOCK_SIZE + 10)
+	if err = o.Fetch(off, 20); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 1 {
+		t.Errorf("%d range requests were sent", n)
+	}
+	if n := storage.Requests(fakeswift.OP_GET); n != 0 {
+		t.Errorf("%d get requests were sent", n)
+	}
+
+	buf := make([]byte, 20)
+	file.ReadAt(buf, off)
+	if !bytes.Equal(buf, data[off:off+20]) {
+		t.Errorf("fetched data mismatched")
+	}
+
+	// Fetched blocks are not downloaded again.
+	o.Fetch(off, 20)
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 1 {
+		t.Errorf("%d range requests were sent", n)
+	}
+
+	// Fetch the rest. A range request is sent for each run of consecutive blocks.
+	if err = o.Fetch(0, int64(len(data))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 3 {
+		t.Errorf("%d range requests were sent", n)
+	}
+	if o.blocks != nil {
+		t.Errorf("blocks should be nil after all blocks were fetched")
+	}
+
+	local, _ := ioutil.ReadFile(o.Localpath())
+	if !bytes.Equal(local, data) {
+		t.Errorf("local file mismatched")
+	}
+}
+
+func TestFetchForWrite(t *testing.T) {
+	var err error
+
+	path := TEST_OBJECT + "-lazy-write"
+	data := make([]byte, CACHE_BLOCK_SIZE*3)
+	if err = storage.Upload(path, bytes.NewReader(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer storage.Delete(path)
+
+	o := newTestObject(path, FILE)
+	o.Size = uint64(len(data))
+	os.Remove(o.Localpath())
+	defer os.Remove(o.Localpath())
+
+	file, err := o.Open(os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	// The write covers the second block entirely and the third block partially.
+	storage.Reset()
+	if err = o.FetchForWrite(CACHE_BLOCK_SIZE, CACHE_BLOCK_SIZE+10); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 1 {
+		t.Errorf("%d range requests were sent", n)
+	}
+	if missing := o.blocks.missing(0, int64(len(data))); len(missing) != 1 || missing[0].offset != 0 {
+		t.Errorf("only the first block should be missing %v", missing)
+	}
+}
+
+func TestParallelDownload(t *testing.T) {
+	var err error
+
+	path := TEST_OBJECT + "-parallel"
+	data := make([]byte, CACHE_BLOCK_SIZE*8)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err = storage.Upload(path, bytes.NewReader(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer storage.Delete(path)
+
+	o := newTestObject(path, FILE)
+	o.Size = uint64(len(data))
+	o.concurrency = 4
+	defer os.Remove(o.Localpath())
+
+	storage.Reset()
+	storage.SetLatency(fakeswift.OP_GET_RANGE, 50*time.Millisecond)
+	defer storage.Reset()
+
+	begin := time.Now()
+	if err = o.download(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// 8 blocks are fetched by 4 concurrent requests of 2 blocks, that take about the latency.
+	if elapsed := time.Now().Sub(begin); elapsed > 300*time.Millisecond {
+		t.Errorf("Download was not parallelized (%v)", elapsed)
+	}
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 4 {
+		t.Errorf("%d range requests were sent", n)
+	}
+
+	local, _ := ioutil.ReadFile(o.Localpath())
+	if !bytes.Equal(local, data) {
+		t.Errorf("local file mismatched")
+	}
+	if !o.downloaded || o.blocks != nil {
+		t.Errorf("object should be downloaded")
+	}
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	var err error
+
+	path := TEST_OBJECT + "-concurrent"
+	data := make([]byte, CACHE_BLOCK_SIZE*4)
+	if err = storage.Upload(path, bytes.NewReader(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer storage.Delete(path)
+
+	o := newTestObject(path, FILE)
+	o.Size = uint64(len(data))
+	o.concurrency = 2
+	os.Remove(o.Localpath())
+	defer os.Remove(o.Localpath())
+
+	file, err := o.Open(os.O_RDONLY, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	storage.Reset()
+	storage.SetLatency(fakeswift.OP_GET_RANGE, 20*time.Millisecond)
+	defer storage.Reset()
+
+	// Blocks being fetched by other goroutine are not requested again.
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- o.Fetch(0, int64(len(data)))
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err = <-errs; err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	if n := storage.Requests(fakeswift.OP_GET_RANGE); n != 2 {
+		t.Errorf("%d range requests were sent", n)
+	}
+}
@@ -0,0 +1,387 @@
+package mapper
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hironobu-s/swiftfs/openstack"
+)
+
+const (
+	// The first interval between retries. It is doubled for each retry.
+	UPLOAD_RETRY_BACKOFF = time.Second
+
+	// The interval to try again after all retries failed.
+	UPLOAD_RETRY_INTERVAL = time.Minute
+)
+
+type uploadTask struct {
+	obj *object
+	due time.Time
+
+	running   bool
+	requeued  bool // enqueued again while uploading
+	cancelled bool // cancelled while uploading, the result is thrown away
+	err       error
+}
+
+// uploader uploads local changes in background (write-back).
+// Changes of the same object within the delay are coalesced into one upload.
+type uploader struct {
+	workers int
+	delay   time.Duration
+	retries int
+	backoff time.Duration
+
+	tasks   map[*object]*uploadTask
+	ch      chan *uploadTask
+	wake    chan struct{}
+	stop    chan struct{}
+	retire  chan struct{} // stops a worker
+	closing bool
+
+	// Paths that were given up on close.
+	abandoned []string
+
+	wg   sync.WaitGroup
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+func newUploader(workers int, delay time.Duration, retries int) *uploader {
+	u := &uploader{
+		workers: workers,
+		delay:   delay,
+		retries: retries,
+		backoff: UPLOAD_RETRY_BACKOFF,
+		tasks:   map[*object]*uploadTask{},
+		ch:      make(chan *uploadTask),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		retire:  make(chan struct{}),
+	}
+	u.cond = sync.NewCond(&u.lock)
+
+	for i := 0; i < workers; i++ {
+		u.wg.Add(1)
+		go u.worker()
+	}
+	go u.dispatcher()
+
+	return u
+}
+
+// reconfigure changes the number of the workers, the delay and the retries.
+// Extra workers stop after their uploads in progress.
+func (u *uploader) reconfigure(workers int, delay time.Duration, retries int) {
+	if u == nil || workers < 1 {
+		return
+	}
+
+	u.lock.Lock()
+	n := workers - u.workers
+	u.workers = workers
+	u.delay = delay
+	u.retries = retries
+	u.lock.Unlock()
+
+	for ; n > 0; n-- {
+		u.wg.Add(1)
+		go u.worker()
+	}
+	go func() {
+		for ; n < 0; n++ {
+			select {
+			case u.retire <- struct{}{}:
+			case <-u.stop:
+				return
+			}
+		}
+	}()
+}
+
+// enqueue schedules uploading the object after the delay.
+func (u *uploader) enqueue(o *object) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	due := time.Now().Add(u.delay)
+	if t, ok := u.tasks[o]; ok {
+		log.Debugf("[uploader] Coalesce %s", o.Path)
+		t.due = due
+		t.requeued = t.running
+		t.cancelled = false
+	} else {
+		log.Debugf("[uploader] Enqueue %s", o.Path)
+		u.tasks[o] = &uploadTask{obj: o, due: due}
+	}
+	u.notify()
+}
+
+// cancel removes the object from the queue. It does not wait for the upload in progress,
+// the worker throws away the result and deletes the uploaded object when it finishes.
+// It returns true if the object was in the queue.
+func (u *uploader) cancel(o *object) bool {
+	if u == nil {
+		return false
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	t, ok := u.tasks[o]
+	if !ok || t.cancelled {
+		return false
+	}
+	if t.running {
+		t.cancelled = true
+	} else {
+		delete(u.tasks, o)
+	}
+	return true
+}
+
+// withdraw removes the object from the queue to upload it by the caller. It waits for the upload in progress.
+// It returns true if the object was in the queue.
+func (u *uploader) withdraw(o *object) bool {
+	if u == nil {
+		return false
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for {
+		t, ok := u.tasks[o]
+		if !ok || t.cancelled {
+			return false
+		} else if !t.running {
+			delete(u.tasks, o)
+			return true
+		}
+		u.cond.Wait()
+	}
+}
+
+// pending returns the paths of the objects that are waiting for uploading.
+func (u *uploader) pending() []string {
+	paths := []string{}
+	if u == nil {
+		return paths
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for o, t := range u.tasks {
+		if !t.cancelled {
+			paths = append(paths, o.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// close uploads the pending objects immediately, and stops the workers. It waits for them up to timeout.
+// Objects that failed to upload or were not uploaded by the deadline are given up, and their paths are returned.
+// Their changes are kept in the journal.
+func (u *uploader) close(timeout time.Duration) []string {
+	if u == nil {
+		return []string{}
+	}
+
+	u.lock.Lock()
+	u.closing = true
+	u.flush(timeout)
+
+	// The uploads in progress are not waited for after the deadline.
+	finished := len(u.tasks) == 0
+	for o, t := range u.tasks {
+		if !t.cancelled {
+			log.Warnf("[uploader] Give up uploading %s, timed out", o.Path)
+			u.abandoned = append(u.abandoned, o.Path)
+		}
+		delete(u.tasks, o)
+	}
+	abandoned := append([]string{}, u.abandoned...)
+	u.lock.Unlock()
+
+	close(u.stop)
+	if finished {
+		u.wg.Wait()
+	}
+
+	sort.Strings(abandoned)
+	return abandoned
+}
+
+// drain uploads the pending objects immediately, and waits for them up to timeout.
+// It returns the paths of the objects that are still waiting.
+func (u *uploader) drain(timeout time.Duration) []string {
+	if u == nil {
+		return []string{}
+	}
+
+	u.lock.Lock()
+	u.flush(timeout)
+	u.lock.Unlock()
+
+	return u.pending()
+}
+
+// flush makes the pending objects due, and waits for the queue to be empty up to timeout. Need to hold the lock.
+func (u *uploader) flush(timeout time.Duration) {
+	// Wake the waiting loop up at the deadline.
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		u.lock.Lock()
+		u.cond.Broadcast()
+		u.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	now := time.Now()
+	for _, t := range u.tasks {
+		t.due = now
+	}
+	u.notify()
+	for len(u.tasks) > 0 && time.Now().Before(deadline) {
+		u.cond.Wait()
+	}
+}
+
+// notify wakes the dispatcher up. Need to hold the lock.
+func (u *uploader) notify() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatcher passes the tasks to the workers when they are due.
+func (u *uploader) dispatcher() {
+	for {
+		ready, next := u.ready()
+		for _, t := range ready {
+			select {
+			case u.ch <- t:
+			case <-u.stop:
+				return
+			}
+		}
+
+		select {
+		case <-u.wake:
+		case <-time.After(next):
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// ready returns the tasks that are due, and the duration until the next task is due.
+func (u *uploader) ready() (ready []*uploadTask, next time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	now := time.Now()
+	next = time.Hour
+	for _, t := range u.tasks {
+		if t.running {
+			continue
+		}
+		if d := t.due.Sub(now); d <= 0 {
+			t.running = true
+			t.requeued = false
+			ready = append(ready, t)
+		} else if d < next {
+			next = d
+		}
+	}
+	return ready, next
+}
+
+func (u *uploader) worker() {
+	defer u.wg.Done()
+
+	for {
+		select {
+		case t := <-u.ch:
+			u.upload(t)
+		case <-u.retire:
+			return
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// isCancelled returns true if the task was cancelled while uploading.
+func (u *uploader) isCancelled(t *uploadTask) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return t.cancelled
+}
+
+func (u *uploader) upload(t *uploadTask) {
+	u.lock.Lock()
+	retries := u.retries
+	backoff := u.backoff
+	u.lock.Unlock()
+
+	cancelled := func() bool { return u.isCancelled(t) }
+
+	var err error
+	for i := 0; i <= retries && !cancelled(); i++ {
+		if i > 0 {
+			log.Debugf("[uploader] Retry %s after %v", t.obj.Path, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if err = t.obj.upload(cancelled); err == nil {
+			break
+		}
+		log.Debugf("[uploader] Upload error %s %v", t.obj.Path, err)
+
+		// Requests were already retried by the retry policy of the storage.
+		// Only transient errors are retried again, other errors are tried again after UPLOAD_RETRY_INTERVAL.
+		if !openstack.Retryable(err) {
+			break
+		}
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	// The task was given up by close().
+	if u.tasks[t.obj] != t {
+		return
+	}
+
+	t.running = false
+	t.err = err
+	if t.cancelled {
+		log.Debugf("[uploader] Cancelled %s", t.obj.Path)
+		delete(u.tasks, t.obj)
+
+	} else if err != nil {
+		if u.closing {
+			log.Warnf("[uploader] Give up uploading %s %v", t.obj.Path, err)
+			u.abandoned = append(u.abandoned, t.obj.Path)
+			delete(u.tasks, t.obj)
+		} else {
+			log.Warnf("[uploader] Upload error %s, try again after %v. %v", t.obj.Path, UPLOAD_RETRY_INTERVAL, err)
+			t.due = time.Now().Add(UPLOAD_RETRY_INTERVAL)
+		}
+
+	} else if !t.requeued {
+		log.Debugf("[uploader] Uploaded %s", t.obj.Path)
+		delete(u.tasks, t.obj)
+	}
+
+	u.notify()
+	u.cond.Broadcast()
+}
@@ -0,0 +1,285 @@
+package mapper
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hironobu-s/swiftfs/openstack/fakeswift"
+)
+
+func newDirtyObject(t *testing.T, u *uploader, path string, data string) *object {
+	o := newTestObject(path, FILE)
+	o.uploader = u
+
+	file, err := o.Open(os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.WriteString(data)
+	file.Close()
+	return o
+}
+
+func waitUploads(t *testing.T, u *uploader) {
+	for i := 0; i < 100; i++ {
+		if len(u.pending()) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("uploads are still pending %v", u.pending())
+}
+
+func TestUploaderCoalesce(t *testing.T) {
+	initMapper()
+
+	u := newUploader(2, 100*time.Millisecond, 0)
+	defer u.close(time.Second)
+
+	o := newDirtyObject(t, u, "writeback-coalesce", TEST_DATA)
+	defer os.Remove(o.Localpath())
+
+	for i := 0; i < 3; i++ {
+		if err := o.Commit(); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if p := u.pending(); len(p) != 1 || p[0] != o.Path {
+		t.Errorf("Invalid pending uploads %v", p)
+	}
+	if storage.Exists(o.Path) {
+		t.Errorf("Object was uploaded before the delay")
+	}
+
+	waitUploads(t, u)
+	if n := storage.Requests(fakeswift.OP_UPLOAD); n != 1 {
+		t.Errorf("%d uploads were done", n)
+	}
+	if data, _ := storage.Data(o.Path); string(data) != TEST_DATA {
+		t.Errorf("Uploaded data mismatched")
+	}
+	if o.dirty {
+		t.Errorf("Object should not be dirty after uploading")
+	}
+}
+
+func TestUploaderRetry(t *testing.T) {
+	initMapper()
+
+	u := newUploader(1, 0, 3)
+	u.backoff = 10 * time.Millisecond
+	defer u.close(time.Second)
+
+	storage.SetError(fakeswift.OP_UPLOAD, syscall.ECONNRESET)
+	o := newDirtyObject(t, u, "writeback-retry", TEST_DATA)
+	defer os.Remove(o.Localpath())
+
+	o.Commit()
+	time.Sleep(15 * time.Millisecond)
+	storage.SetError(fakeswift.OP_UPLOAD, nil)
+
+	waitUploads(t, u)
+	if n := storage.Requests(fakeswift.OP_UPLOAD); n < 2 {
+		t.Errorf("Upload was not retried (%d)", n)
+	}
+	if data, _ := storage.Data(o.Path); string(data) != TEST_DATA {
+		t.Errorf("Uploaded data mismatched")
+	}
+
+	// Permanent errors are not retried until UPLOAD_RETRY_INTERVAL.
+	storage.Reset()
+	storage.SetError(fakeswift.OP_UPLOAD, errors.New("upload error"))
+	defer storage.SetError(fakeswift.OP_UPLOAD, nil)
+
+	o.Commit()
+	time.Sleep(100 * time.Millisecond)
+	if n := storage.Requests(fakeswift.OP_UPLOAD); n != 1 {
+		t.Errorf("Upload was retried on a permanent error (%d)", n)
+	}
+}
+
+func TestUploaderClose(t *testing.T) {
+	initMapper()
+
+	u := newUploader(1, time.Hour, 0)
+	o := newDirtyObject(t, u, "writeback-close", TEST_DATA)
+	defer os.Remove(o.Localpath())
+	o.Commit()
+
+	// Pending uploads are done without waiting for the delay.
+	if abandoned := u.close(time.Second); len(abandoned) != 0 {
+		t.Errorf("Invalid abandoned uploads %v", abandoned)
+	}
+	if data, _ := storage.Data(o.Path); string(data) != TEST_DATA {
+		t.Errorf("Pending upload was not done on close")
+	}
+
+	// Failed uploads are given up and returned.
+	storage.SetError(fakeswift.OP_UPLOAD, errors.New("upload error"))
+	defer storage.SetError(fakeswift.OP_UPLOAD, nil)
+
+	u = newUploader(1, time.Hour, 0)
+	o.uploader = u
+	o.Commit()
+	if abandoned := u.close(time.Second); len(abandoned) != 1 || abandoned[0] != o.Path {
+		t.Errorf("Invalid abandoned uploads %v", abandoned)
+	}
+
+	// Uploads not finished by the timeout are given up without waiting for them.
+	storage.SetError(fakeswift.OP_UPLOAD, nil)
+	storage.SetLatency(fakeswift.OP_UPLOAD, time.Second)
+	defer storage.SetLatency(fakeswift.OP_UPLOAD, 0)
+
+	u = newUploader(1, time.Hour, 0)
+	o.uploader = u
+	o.Commit()
+	start := time.Now()
+	if abandoned := u.close(50 * time.Millisecond); len(abandoned) != 1 || abandoned[0] != o.Path {
+		t.Errorf("Invalid abandoned uploads %v", abandoned)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("close() waited for the upload in progress %v", d)
+	}
+}
+
+func TestUploaderDrain(t *testing.T) {
+	initMapper()
+
+	u := newUploader(1, time.Hour, 0)
+	defer u.close(time.Second)
+
+	o := newDirtyObject(t, u, "writeback-drain", TEST_DATA)
+	defer os.Remove(o.Localpath())
+	o.Commit()
+
+	// Pending uploads are done without waiting for the delay.
+	if p := u.drain(time.Second); len(p) != 0 {
+		t.Errorf("Uploads are still pending %v", p)
+	}
+	if data, _ := storage.Data(o.Path); string(data) != TEST_DATA {
+		t.Errorf("Pending upload was not done on drain")
+	}
+
+	// Failed uploads are returned after the timeout.
+	storage.SetError(fakeswift.OP_UPLOAD, errors.New("upload error"))
+	defer storage.SetError(fakeswift.OP_UPLOAD, nil)
+
+	o.Commit()
+	if p := u.drain(50 * time.Millisecond); len(p) != 1 || p[0] != o.Path {
+		t.Errorf("Invalid pending uploads %v", p)
+	}
+}
+
+func TestUploaderCancel(t *testing.T) {
+	initMapper()
+
+	u := newUploader(1, 0, 0)
+	defer u.close(time.Second)
+
+	storage.SetLatency(fakeswift.OP_UPLOAD, 200*time.Millisecond)
+	defer storage.SetLatency(fakeswift.OP_UPLOAD, 0)
+
+	o := newDirtyObject(t, u, "writeback-cancel", TEST_DATA)
+	defer os.Remove(o.Localpath())
+	o.Commit()
+
+	for i := 0; i < 100 && storage.Requests(fakeswift.OP_UPLOAD) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The upload in progress is not waited for.
+	start := time.Now()
+	if !u.cancel(o) {
+		t.Errorf("Object was not in the queue")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("cancel() waited for the upload in progress %v", d)
+	}
+	if p := u.pending(); len(p) != 0 {
+		t.Errorf("Cancelled upload is still pending %v", p)
+	}
+
+	// The result is thrown away, and the uploaded object is deleted.
+	for i := 0; i < 100; i++ {
+		u.lock.Lock()
+		n := len(u.tasks)
+		u.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if storage.Exists(o.Path) {
+		t.Errorf("Object uploaded by the cancelled upload was not deleted")
+	}
+	if !o.dirty {
+		t.Errorf("Object should be dirty after the cancelled upload")
+	}
+}
+
+func TestUploaderReconfigure(t *testing.T) {
+	initMapper()
+
+	u := newUploader(1, time.Hour, 0)
+	defer u.close(time.Second)
+
+	o := newDirtyObject(t, u, "writeback-reconfigure", TEST_DATA)
+	defer os.Remove(o.Localpath())
+	o.Commit()
+
+	// The new delay is used by the following changes.
+	u.reconfigure(3, 0, 1)
+	o.Commit()
+	waitUploads(t, u)
+	if data, _ := storage.Data(o.Path); string(data) != TEST_DATA {
+		t.Errorf("Uploaded data mismatched")
+	}
+
+	u.lock.Lock()
+	workers, retries := u.workers, u.retries
+	u.lock.Unlock()
+	if workers != 3 || retries != 1 {
+		t.Errorf("Invalid workers %d and retries %d", workers, retries)
+	}
+
+	// Extra workers stop, and the others keep uploading.
+	u.reconfigure(1, 0, 0)
+	o.Commit()
+	waitUploads(t, u)
+}
+
+func TestRenamePending(t *testing.T) {
+	initMapper()
+
+	u := newUploader(1, time.Hour, 0)
+	defer u.close(time.Second)
+	mapper.uploader = u
+	defer func() { mapper.uploader = nil }()
+
+	obj, err := mapper.Create("writeback-from")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	file, _ := obj.Open(os.O_WRONLY, 0600)
+	obj.FetchForWrite(0, int64(len(TEST_DATA)))
+	file.WriteString(TEST_DATA)
+	file.Close()
+	obj.Commit()
+
+	if err = mapper.Rename("writeback-from", "writeback-to"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if p := u.pending(); len(p) != 1 || p[0] != "writeback-to" {
+		t.Errorf("Pending upload should move to the new object %v", p)
+	}
+
+	newobj, _ := mapper.Get("writeback-to")
+	defer os.Remove(newobj.Localpath())
+	if data, _ := ioutil.ReadFile(newobj.Localpath()); string(data) != TEST_DATA {
+		t.Errorf("Local changes were lost by rename")
+	}
+}
@@ -0,0 +1,108 @@
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rackspace/gophercloud"
+)
+
+// setClient makes the client of the storage URL with the token.
+// reauth issues a new token when the token expired. It is nil if the token can not be issued again.
+func (s *Swift) setClient(token string, storageURL string, reauth func() (string, error)) {
+	provider := &gophercloud.ProviderClient{
+		IdentityBase:     s.authOptions.IdentityEndpoint,
+		IdentityEndpoint: s.authOptions.IdentityEndpoint,
+		TokenID:          token,
+	}
+
+	if reauth != nil && s.authOptions.AllowReauth {
+		provider.ReauthFunc = func() error {
+			log.Debugf("(OpenStack) Reauthenticate")
+			token, err := reauth()
+			if err != nil {
+				return err
+			}
+			provider.TokenID = token
+			return nil
+		}
+	}
+
+	s.client = &gophercloud.ServiceClient{
+		ProviderClient: provider,
+		Endpoint:       gophercloud.NormalizeURL(storageURL),
+	}
+}
+
+// authStorageURL uses the pre-authorized storage URL and token without the identity service.
+func (s *Swift) authStorageURL() error {
+	log.Debugf("(OpenStack) Use the storage URL(%s) and token", s.storageURL)
+
+	if s.storageURL == "" || s.authOptions.TokenID == "" {
+		return fmt.Errorf("The storage URL and token are required")
+	}
+	s.setClient(s.authOptions.TokenID, s.storageURL, nil)
+	return nil
+}
+
+// authTempAuth authenticates with Swift TempAuth (v1.0).
+// The username is "account:user" and the password is the key.
+func (s *Swift) authTempAuth() error {
+	log.Debugf("(OpenStack) Authenticate by TempAuth(%s)", s.authOptions.Username)
+
+	token, storageURL, err := s.issueTokenV1()
+	if err != nil {
+		return err
+	}
+
+	s.setClient(token, storageURL, func() (string, error) {
+		token, _, err := s.issueTokenV1()
+		return token, err
+	})
+	return nil
+}
+
+// issueTokenV1 requests a token, and returns it with the storage URL.
+func (s *Swift) issueTokenV1() (token string, storageURL string, err error) {
+	url := s.authOptions.IdentityEndpoint
+
+	err = s.policy().do("auth", func(attempt int) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Auth-User", s.authOptions.Username)
+		req.Header.Set("X-Auth-Key", s.authOptions.Password)
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+
+		if r.StatusCode < 200 || r.StatusCode >= 300 {
+			data, _ := ioutil.ReadAll(r.Body)
+			return &gophercloud.UnexpectedResponseCodeError{
+				URL:      url,
+				Method:   "GET",
+				Expected: []int{http.StatusOK},
+				Actual:   r.StatusCode,
+				Body:     data,
+			}
+		}
+
+		token = r.Header.Get("X-Auth-Token")
+		storageURL = r.Header.Get("X-Storage-Url")
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if token == "" || storageURL == "" {
+		return "", "", fmt.Errorf("No token or storage URL in the response of %s", url)
+	}
+	return token, storageURL, nil
+}
@@ -0,0 +1,17 @@
+package openstack
+
+import (
+	"github.com/rackspace/gophercloud"
+)
+
+// StatusCode returns the HTTP status code of the error returned from Swift, or 0 if err is not an HTTP error.
+func StatusCode(err error) int {
+	if e, ok := err.(*gophercloud.UnexpectedResponseCodeError); ok {
+		return e.Actual
+	}
+	return 0
+}
+
+func isNotFound(err error) bool {
+	return StatusCode(err) == 404
+}
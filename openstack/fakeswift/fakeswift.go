@@ -0,0 +1,539 @@
+// Package fakeswift provides an in-memory implementation of openstack.ObjectStorage.
+// It is intended for the tests of the mapper and fs packages that should not depend on
+// a real Keystone and Swift endpoint.
+package fakeswift
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hironobu-s/swiftfs/openstack"
+	"github.com/rackspace/gophercloud"
+	"github.com/rackspace/gophercloud/openstack/objectstorage/v1/objects"
+)
+
+// Operation names which can be passed to SetLatency() and SetError().
+const (
+	OP_LIST             = "List"
+	OP_GET              = "Get"
+	OP_GET_RANGE        = "GetRange"
+	OP_UPLOAD           = "Upload"
+	OP_DELETE           = "Delete"
+	OP_COPY             = "Copy"
+	OP_GET_CONTAINER    = "GetContainer"
+	OP_CREATE_CONTAINER = "CreateContainer"
+	OP_MAKE_DIRECTORY   = "MakeDirectory"
+	OP_REMOVE_DIRECTORY = "RemoveDirectory"
+	OP_HEAD             = "Head"
+	OP_DELETE_SEGMENTS  = "DeleteSegments"
+)
+
+// Same format as "last_modified" in the container listing of Swift.
+const LAST_MODIFIED_FORMAT = "2006-01-02T15:04:05.000000"
+
+type object struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+
+	// Large objects. Segments are stored in the same container.
+	manifest int
+	prefix   string   // DLO
+	segments []string // SLO
+}
+
+func (o *object) hash() string {
+	sum := md5.Sum(o.data)
+	return hex.EncodeToString(sum[:])
+}
+
+// segmentNames returns the names of the segments. Need to hold the lock.
+func (s *Storage) segmentNames(obj *object) []string {
+	switch obj.manifest {
+	case openstack.MANIFEST_DLO:
+		names := []string{}
+		for name := range s.objects {
+			if strings.HasPrefix(name, obj.prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	case openstack.MANIFEST_SLO:
+		return obj.segments
+	}
+	return nil
+}
+
+// content returns the data of the object. Segments are concatenated if the object is a manifest.
+// Need to hold the lock.
+func (s *Storage) content(obj *object) []byte {
+	if obj.manifest == openstack.MANIFEST_NONE {
+		return obj.data
+	}
+
+	data := []byte{}
+	for _, name := range s.segmentNames(obj) {
+		if seg, ok := s.objects[name]; ok {
+			data = append(data, seg.data...)
+		}
+	}
+	return data
+}
+
+// Storage is an in-memory object storage that holds a single container.
+type Storage struct {
+	ContainerName string
+
+	// Value of account quota that GetContainer() returns.
+	Quota uint64
+
+	containerExists bool
+	objects         map[string]*object
+
+	latency  map[string]time.Duration
+	errors   map[string]error
+	requests map[string]int
+
+	lock sync.Mutex
+}
+
+func New(containerName string) *Storage {
+	return &Storage{
+		ContainerName: containerName,
+		Quota:         openstack.DEFAULT_ACCOUNT_QUOTA,
+		objects:       map[string]*object{},
+		latency:       map[string]time.Duration{},
+		errors:        map[string]error{},
+		requests:      map[string]int{},
+	}
+}
+
+// SetLatency makes the operation sleep for d before it runs.
+func (s *Storage) SetLatency(op string, d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency[op] = d
+}
+
+// SetError makes the operation fail with err. Pass nil to clear the error.
+func (s *Storage) SetError(op string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		delete(s.errors, op)
+	} else {
+		s.errors[op] = err
+	}
+}
+
+// SetObjectError makes the operation for the object name fail with err.
+// Pass nil to clear the error.
+func (s *Storage) SetObjectError(op string, name string, err error) {
+	s.SetError(op+":"+name, err)
+}
+
+// Reset clears all injected latencies and errors, and the request counters.
+func (s *Storage) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.latency = map[string]time.Duration{}
+	s.errors = map[string]error{}
+	s.requests = map[string]int{}
+}
+
+// Requests returns the number of times that the operation was called.
+func (s *Storage) Requests(op string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[op]
+}
+
+// Exists returns true if the object exists in the container.
+func (s *Storage) Exists(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.objects[name]
+	return ok
+}
+
+// Data returns a copy of the object data.
+func (s *Storage) Data(name string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, s.content(obj)...), true
+}
+
+// PutDynamicLargeObject stores a DLO manifest which refers to the objects with the prefix.
+func (s *Storage) PutDynamicLargeObject(name string, prefix string) error {
+	if err := s.put(name, []byte{}, "application/octet-stream"); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[name].manifest = openstack.MANIFEST_DLO
+	s.objects[name].prefix = prefix
+	return nil
+}
+
+// PutStaticLargeObject stores a SLO manifest which refers to the segments.
+func (s *Storage) PutStaticLargeObject(name string, segments []string) error {
+	s.lock.Lock()
+	for _, seg := range segments {
+		if _, ok := s.objects[seg]; !ok {
+			s.lock.Unlock()
+			return notFound("PUT", seg)
+		}
+	}
+	s.lock.Unlock()
+
+	if err := s.put(name, []byte{}, "application/octet-stream"); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[name].manifest = openstack.MANIFEST_SLO
+	s.objects[name].segments = segments
+	return nil
+}
+
+// begin applies the injected latency and returns the injected error for the operation.
+func (s *Storage) begin(op string, name string) error {
+	s.lock.Lock()
+	s.requests[op]++
+	d := s.latency[op]
+	err, ok := s.errors[op+":"+name]
+	if !ok {
+		err = s.errors[op]
+	}
+	s.lock.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return err
+}
+
+func (s *Storage) checkContainer() error {
+	if !s.containerExists {
+		return notFound("HEAD", s.ContainerName)
+	}
+	return nil
+}
+
+func (s *Storage) put(name string, data []byte, contentType string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkContainer(); err != nil {
+		return err
+	}
+	s.objects[name] = &object{
+		data:         data,
+		contentType:  contentType,
+		lastModified: time.Now().UTC(),
+	}
+	return nil
+}
+
+func (s *Storage) remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkContainer(); err != nil {
+		return err
+	}
+	if _, ok := s.objects[name]; !ok {
+		return notFound("DELETE", name)
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *Storage) List() (objch chan objects.Object, n chan int, errch chan error) {
+	objch = make(chan objects.Object)
+	n = make(chan int)
+	errch = make(chan error)
+
+	go func() {
+		if err := s.begin(OP_LIST, ""); err != nil {
+			errch <- err
+			return
+		}
+
+		s.lock.Lock()
+		names := make([]string, 0, len(s.objects))
+		for name := range s.objects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		list := make([]objects.Object, 0, len(names))
+		for _, name := range names {
+			obj := s.objects[name]
+
+			// Same as Swift, the listing reports the size of the DLO manifest itself.
+			size := int64(len(obj.data))
+			if obj.manifest == openstack.MANIFEST_SLO {
+				size = int64(len(s.content(obj)))
+			}
+
+			list = append(list, objects.Object{
+				Name:         name,
+				Bytes:        size,
+				ContentType:  obj.contentType,
+				Hash:         obj.hash(),
+				LastModified: obj.lastModified.Format(LAST_MODIFIED_FORMAT),
+			})
+		}
+		s.lock.Unlock()
+
+		for _, obj := range list {
+			objch <- obj
+		}
+		n <- len(list)
+	}()
+
+	return objch, n, errch
+}
+
+func (s *Storage) Get(name string) (result objects.DownloadResult) {
+	if result.Err = s.begin(OP_GET, name); result.Err != nil {
+		return result
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[name]
+	if !ok {
+		result.Err = notFound("GET", name)
+		return result
+	}
+
+	data := s.content(obj)
+	result.Header = http.Header{}
+	result.Header.Set("Content-Type", obj.contentType)
+	result.Header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	result.Header.Set("Etag", obj.hash())
+	result.Body = ioutil.NopCloser(bytes.NewReader(append([]byte{}, data...)))
+	return result
+}
+
+func (s *Storage) GetRange(name string, offset int64, length int64) (result objects.DownloadResult) {
+	if result.Err = s.begin(OP_GET_RANGE, name); result.Err != nil {
+		return result
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[name]
+	if !ok {
+		result.Err = notFound("GET", name)
+		return result
+	}
+
+	data := s.content(obj)
+	if offset >= int64(len(data)) {
+		result.Err = &gophercloud.UnexpectedResponseCodeError{
+			URL:      name,
+			Method:   "GET",
+			Expected: []int{200},
+			Actual:   416,
+		}
+		return result
+	}
+	end := offset + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+
+	result.Header = http.Header{}
+	result.Header.Set("Content-Type", obj.contentType)
+	result.Header.Set("Content-Length", fmt.Sprintf("%d", end-offset))
+	result.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, len(data)))
+	result.Body = ioutil.NopCloser(bytes.NewReader(append([]byte{}, data[offset:end]...)))
+	return result
+}
+
+func (s *Storage) Head(name string) (info openstack.ObjectInfo, err error) {
+	if err = s.begin(OP_HEAD, name); err != nil {
+		return info, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[name]
+	if !ok {
+		return info, notFound("HEAD", name)
+	}
+
+	info.Name = name
+	info.Size = int64(len(s.content(obj)))
+	info.Hash = obj.hash()
+	info.LastModified = obj.lastModified
+	info.Manifest = obj.manifest
+	if obj.manifest == openstack.MANIFEST_DLO {
+		info.ObjectManifest = s.ContainerName + "/" + obj.prefix
+	}
+	for _, segname := range s.segmentNames(obj) {
+		seg, ok := s.objects[segname]
+		if !ok {
+			continue
+		}
+		info.Segments = append(info.Segments, openstack.Segment{
+			Container: s.ContainerName,
+			Name:      segname,
+			Bytes:     int64(len(seg.data)),
+			Hash:      seg.hash(),
+		})
+	}
+	return info, nil
+}
+
+// DeleteSegments deletes the segments in the container. Segments in other containers are ignored.
+func (s *Storage) DeleteSegments(segments []openstack.Segment) error {
+	if err := s.begin(OP_DELETE_SEGMENTS, ""); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, seg := range segments {
+		if seg.Container == s.ContainerName {
+			delete(s.objects, seg.Name)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) Upload(name string, data io.ReadSeeker) error {
+	if err := s.begin(OP_UPLOAD, name); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	return s.put(name, b, "application/octet-stream")
+}
+
+func (s *Storage) Delete(name string) error {
+	if err := s.begin(OP_DELETE, name); err != nil {
+		return err
+	}
+	return s.remove(name)
+}
+
+func (s *Storage) Copy(oldName string, newName string) error {
+	if err := s.begin(OP_COPY, oldName); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, ok := s.objects[oldName]
+	if !ok {
+		return notFound("COPY", oldName)
+	}
+
+	// Manifests are copied as is, then segments are shared.
+	s.objects[newName] = &object{
+		data:         append([]byte{}, obj.data...),
+		contentType:  obj.contentType,
+		lastModified: time.Now().UTC(),
+		manifest:     obj.manifest,
+		prefix:       obj.prefix,
+		segments:     obj.segments,
+	}
+	return nil
+}
+
+func (s *Storage) GetContainer() (container openstack.Container, err error) {
+	if err = s.begin(OP_GET_CONTAINER, ""); err != nil {
+		return container, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err = s.checkContainer(); err != nil {
+		return container, err
+	}
+
+	container.Quota = s.Quota
+	for _, obj := range s.objects {
+		container.Used += uint64(len(obj.data))
+		container.Count++
+	}
+	return container, nil
+}
+
+func (s *Storage) CreateContainer() error {
+	if err := s.begin(OP_CREATE_CONTAINER, ""); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.containerExists = true
+	return nil
+}
+
+// DeleteContainer deletes the container and all objects in it.
+func (s *Storage) DeleteContainer() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkContainer(); err != nil {
+		return err
+	}
+	s.containerExists = false
+	s.objects = map[string]*object{}
+	return nil
+}
+
+func (s *Storage) MakeDirectory(name string) error {
+	if err := s.begin(OP_MAKE_DIRECTORY, name); err != nil {
+		return err
+	}
+	return s.put(name, []byte{}, "application/directory")
+}
+
+func (s *Storage) RemoveDirectory(name string) error {
+	if err := s.begin(OP_REMOVE_DIRECTORY, name); err != nil {
+		return err
+	}
+	return s.remove(name)
+}
+
+func notFound(method string, name string) error {
+	return &gophercloud.UnexpectedResponseCodeError{
+		URL:      name,
+		Method:   method,
+		Expected: []int{200},
+		Actual:   404,
+	}
+}
+
+var _ openstack.ObjectStorage = &Storage{}
@@ -0,0 +1,158 @@
+package fakeswift
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_CONTAINER_NAME = "fakeswift-test"
+	TEST_OBJECT_NAME    = "testobject"
+	TEST_OBJECT_DATA    = "hogehoge"
+)
+
+func newStorage(t *testing.T) *Storage {
+	s := New(TEST_CONTAINER_NAME)
+	if err := s.CreateContainer(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return s
+}
+
+func TestUploadAndGet(t *testing.T) {
+	s := newStorage(t)
+
+	if err := s.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	result := s.Get(TEST_OBJECT_NAME)
+	if result.Err != nil {
+		t.Fatalf("%v", result.Err)
+	}
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(body) != TEST_OBJECT_DATA {
+		t.Errorf("Invalid object data (It's different from uploaded).")
+	}
+
+	if result := s.Get("not-exists"); result.Err == nil {
+		t.Errorf("Get() should fail for the object that does not exist")
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newStorage(t)
+	s.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA))
+	s.MakeDirectory("dir")
+
+	found := map[string]string{}
+	objch, n, errch := s.List()
+L:
+	for {
+		select {
+		case err := <-errch:
+			t.Fatalf("%v", err)
+		case obj := <-objch:
+			found[obj.Name] = obj.ContentType
+			if _, err := time.Parse(LAST_MODIFIED_FORMAT, obj.LastModified); err != nil {
+				t.Errorf("Invalid last modified %s", obj.LastModified)
+			}
+		case num := <-n:
+			if num != 2 {
+				t.Errorf("Number of objects is %d, expected 2", num)
+			}
+			break L
+		}
+	}
+
+	if found["dir"] != "application/directory" {
+		t.Errorf("Directory not found in the list")
+	}
+	if _, ok := found[TEST_OBJECT_NAME]; !ok {
+		t.Errorf("Object not found in the list")
+	}
+}
+
+func TestCopyAndDelete(t *testing.T) {
+	s := newStorage(t)
+	s.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA))
+
+	if err := s.Copy(TEST_OBJECT_NAME, TEST_OBJECT_NAME+"-copy"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if data, ok := s.Data(TEST_OBJECT_NAME + "-copy"); !ok || string(data) != TEST_OBJECT_DATA {
+		t.Errorf("Copy failed")
+	}
+
+	if err := s.Delete(TEST_OBJECT_NAME); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Exists(TEST_OBJECT_NAME) {
+		t.Errorf("Delete failed")
+	}
+	if err := s.Delete(TEST_OBJECT_NAME); err == nil {
+		t.Errorf("Delete() should fail for the object that does not exist")
+	}
+}
+
+func TestGetContainer(t *testing.T) {
+	s := New(TEST_CONTAINER_NAME)
+	if _, err := s.GetContainer(); err == nil {
+		t.Errorf("GetContainer() should fail before the container is created")
+	}
+
+	s.CreateContainer()
+	s.Quota = 1000
+	s.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA))
+
+	c, err := s.GetContainer()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if c.Quota != 1000 || c.Used != uint64(len(TEST_OBJECT_DATA)) || c.Count != 1 {
+		t.Errorf("Invalid container stats %v", c)
+	}
+}
+
+func TestInjection(t *testing.T) {
+	s := newStorage(t)
+
+	e := errors.New("injected")
+	s.SetError(OP_UPLOAD, e)
+	if err := s.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA)); err != e {
+		t.Errorf("Injected error was not returned (%v)", err)
+	}
+	s.SetError(OP_UPLOAD, nil)
+
+	s.SetObjectError(OP_DELETE, "fail", e)
+	s.Upload("fail", strings.NewReader(""))
+	s.Upload("ok", strings.NewReader(""))
+	if err := s.Delete("fail"); err != e {
+		t.Errorf("Injected error was not returned (%v)", err)
+	}
+	if err := s.Delete("ok"); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	s.SetLatency(OP_GET_CONTAINER, 50*time.Millisecond)
+	start := time.Now()
+	s.GetContainer()
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Injected latency was not applied")
+	}
+
+	s.Reset()
+	start = time.Now()
+	s.GetContainer()
+	if time.Since(start) >= 50*time.Millisecond {
+		t.Errorf("Reset() did not clear the latency")
+	}
+}
@@ -0,0 +1,215 @@
+package openstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rackspace/gophercloud"
+)
+
+// Keystone v3 options that gophercloud.AuthOptions does not have.
+type v3AuthOptions struct {
+	UserDomainID      string
+	UserDomainName    string
+	ProjectDomainID   string
+	ProjectDomainName string
+
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+}
+
+// Request body of "POST /v3/auth/tokens"
+type v3AuthRequest struct {
+	Auth struct {
+		Identity v3Identity `json:"identity"`
+		Scope    *v3Scope   `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type v3Identity struct {
+	Methods               []string                 `json:"methods"`
+	Password              *v3Password              `json:"password,omitempty"`
+	Token                 *v3Token                 `json:"token,omitempty"`
+	ApplicationCredential *v3ApplicationCredential `json:"application_credential,omitempty"`
+}
+
+type v3Password struct {
+	User struct {
+		ID       string    `json:"id,omitempty"`
+		Name     string    `json:"name,omitempty"`
+		Domain   *v3Domain `json:"domain,omitempty"`
+		Password string    `json:"password"`
+	} `json:"user"`
+}
+
+type v3Token struct {
+	ID string `json:"id"`
+}
+
+type v3ApplicationCredential struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type v3Scope struct {
+	Project struct {
+		ID     string    `json:"id,omitempty"`
+		Name   string    `json:"name,omitempty"`
+		Domain *v3Domain `json:"domain,omitempty"`
+	} `json:"project"`
+}
+
+type v3Domain struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Response body of "POST /v3/auth/tokens". Only the service catalog is needed.
+type v3AuthResponse struct {
+	Token struct {
+		Catalog []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				RegionID  string `json:"region_id"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+func newDomain(id string, name string) *v3Domain {
+	if id == "" && name == "" {
+		return nil
+	}
+	return &v3Domain{ID: id, Name: name}
+}
+
+// useKeystoneV3 returns true if the auth URL is Keystone v3 or options that only v3 supports are given.
+func (s *Swift) useKeystoneV3() bool {
+	return strings.HasSuffix(strings.TrimSuffix(s.authOptions.IdentityEndpoint, "/"), "/v3") || s.v3Options != v3AuthOptions{}
+}
+
+// authV3 authenticates with Keystone v3, and makes the client of the object-store endpoint in the catalog.
+func (s *Swift) authV3() error {
+	token, endpoint, err := s.issueTokenV3()
+	if err != nil {
+		return err
+	}
+
+	// Pre-issued tokens can not be issued again.
+	var reauth func() (string, error)
+	if s.authOptions.TokenID == "" {
+		reauth = func() (string, error) {
+			token, _, err := s.issueTokenV3()
+			return token, err
+		}
+	}
+
+	s.setClient(token, endpoint, reauth)
+	return nil
+}
+
+// issueTokenV3 requests a token, and returns it with the URL of the object-store endpoint.
+func (s *Swift) issueTokenV3() (token string, endpoint string, err error) {
+	body, err := json.Marshal(s.v3AuthRequest())
+	if err != nil {
+		return "", "", err
+	}
+
+	url := strings.TrimSuffix(s.authOptions.IdentityEndpoint, "/")
+	if !strings.HasSuffix(url, "/v3") {
+		url += "/v3"
+	}
+	url += "/auth/tokens"
+
+	var res v3AuthResponse
+	err = s.policy().do("auth", func(attempt int) error {
+		r, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+
+		if r.StatusCode != http.StatusCreated {
+			data, _ := ioutil.ReadAll(r.Body)
+			return &gophercloud.UnexpectedResponseCodeError{
+				URL:      url,
+				Method:   "POST",
+				Expected: []int{http.StatusCreated},
+				Actual:   r.StatusCode,
+				Body:     data,
+			}
+		}
+
+		token = r.Header.Get("X-Subject-Token")
+		return json.NewDecoder(r.Body).Decode(&res)
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	region := s.endpointOptions.Region
+	iface := string(s.endpointOptions.Availability)
+	if iface == "" {
+		iface = string(gophercloud.AvailabilityPublic)
+	}
+
+	for _, service := range res.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, e := range service.Endpoints {
+			if e.Interface == iface && (region == "" || region == e.Region || region == e.RegionID) {
+				return token, e.URL, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("No object-store endpoint in the service catalog (region=%s, interface=%s)", region, iface)
+}
+
+func (s *Swift) v3AuthRequest() *v3AuthRequest {
+	req := &v3AuthRequest{}
+	identity := &req.Auth.Identity
+	o := s.authOptions
+
+	switch {
+	case s.v3Options.ApplicationCredentialID != "":
+		// Application credentials are scoped to the project already.
+		identity.Methods = []string{"application_credential"}
+		identity.ApplicationCredential = &v3ApplicationCredential{
+			ID:     s.v3Options.ApplicationCredentialID,
+			Secret: s.v3Options.ApplicationCredentialSecret,
+		}
+		return req
+
+	case o.TokenID != "":
+		identity.Methods = []string{"token"}
+		identity.Token = &v3Token{ID: o.TokenID}
+
+	default:
+		identity.Methods = []string{"password"}
+		identity.Password = &v3Password{}
+		identity.Password.User.ID = o.UserID
+		identity.Password.User.Name = o.Username
+		identity.Password.User.Password = o.Password
+		if o.UserID == "" {
+			identity.Password.User.Domain = newDomain(s.v3Options.UserDomainID, s.v3Options.UserDomainName)
+		}
+	}
+
+	if o.TenantID != "" || o.TenantName != "" {
+		req.Auth.Scope = &v3Scope{}
+		req.Auth.Scope.Project.ID = o.TenantID
+		req.Auth.Scope.Project.Name = o.TenantName
+		if o.TenantID == "" {
+			req.Auth.Scope.Project.Domain = newDomain(s.v3Options.ProjectDomainID, s.v3Options.ProjectDomainName)
+		}
+	}
+	return req
+}
@@ -0,0 +1,357 @@
+package openstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rackspace/gophercloud"
+	"github.com/rackspace/gophercloud/openstack/objectstorage/v1/objects"
+	"github.com/rackspace/gophercloud/rackspace/objectstorage/v1/containers"
+)
+
+const (
+	// Segments are stored under this prefix when the segment container is same as the container.
+	// Objects under this prefix are hidden from the listing.
+	SEGMENT_PREFIX = ".swiftfs_segments/"
+)
+
+// Kinds of manifest
+const (
+	MANIFEST_NONE = iota
+	MANIFEST_DLO  // Dynamic Large Object (X-Object-Manifest)
+	MANIFEST_SLO  // Static Large Object (X-Static-Large-Object)
+)
+
+// ObjectInfo is the information of an object returned by Head().
+type ObjectInfo struct {
+	Name string
+	Size int64 // Logical size. It is the total size of segments if the object is a manifest.
+
+	Hash         string // ETag without quotes
+	LastModified time.Time
+
+	Manifest       int       // MANIFEST_NONE, MANIFEST_DLO or MANIFEST_SLO
+	ObjectManifest string    // Value of X-Object-Manifest header (DLO only)
+	Segments       []Segment // Segments of the large object
+}
+
+type Segment struct {
+	Container string
+	Name      string
+	Bytes     int64
+	Hash      string
+}
+
+// DeletableSegments returns the segments which can be deleted with the object.
+// Segments of DLO are not returned, since the prefix of X-Object-Manifest may match other objects.
+func (info ObjectInfo) DeletableSegments() []Segment {
+	if info.Manifest != MANIFEST_SLO {
+		return nil
+	}
+	return info.Segments
+}
+
+// An entry of the SLO manifest to put.
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// An entry of the SLO manifest returned by "GET ?multipart-manifest=get".
+type sloManifestEntry struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	Hash  string `json:"hash"`
+}
+
+// segmentPrefix returns the prefix of segment names in the segment container.
+func (s *Swift) segmentPrefix() string {
+	if s.segmentContainer == s.containerName {
+		return SEGMENT_PREFIX
+	}
+	return ""
+}
+
+// isSegment returns true if the object in the container is a segment of large objects.
+func (s *Swift) isSegment(name string) bool {
+	prefix := s.segmentPrefix()
+	return prefix != "" && strings.HasPrefix(name, prefix)
+}
+
+// normalizeObject makes an object in the listing have the logical size.
+// Old Swift reports the size of SLO as "swift_bytes" parameter of the content type.
+func normalizeObject(obj objects.Object) objects.Object {
+	params := strings.Split(obj.ContentType, ";")
+	if len(params) == 1 {
+		return obj
+	}
+
+	ct := make([]string, 0, len(params))
+	for _, p := range params {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "swift_bytes=") {
+			if n, err := strconv.ParseInt(strings.TrimPrefix(p, "swift_bytes="), 10, 64); err == nil {
+				obj.Bytes = n
+			}
+			continue
+		}
+		ct = append(ct, p)
+	}
+	obj.ContentType = strings.Join(ct, ";")
+	return obj
+}
+
+// uploadLargeObject uploads data as segments in parallel, then puts the SLO manifest.
+func (s *Swift) uploadLargeObject(name string, data io.ReaderAt, size int64) (err error) {
+	log.Debugf("(OpenStack) Upload large object (%s) size=%d", name, size)
+
+	if s.segmentContainer != s.containerName {
+		err = s.policy().do("create "+s.segmentContainer, func(attempt int) error {
+			return containers.Create(s.client, s.segmentContainer, containers.CreateOpts{}).Err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Same naming as python-swiftclient
+	now := time.Now()
+	prefix := fmt.Sprintf("%s%s/slo/%d.%06d/%d/%d/",
+		s.segmentPrefix(), name, now.Unix(), now.Nanosecond()/1000, size, s.segmentSize)
+
+	num := int((size + s.segmentSize - 1) / s.segmentSize)
+	manifest := make([]sloSegment, num)
+	errs := make([]error, num)
+
+	sem := make(chan struct{}, s.segmentConcurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < num; i++ {
+		offset := int64(i) * s.segmentSize
+		length := s.segmentSize
+		if offset+length > size {
+			length = size - offset
+		}
+		segname := fmt.Sprintf("%s%08d", prefix, i)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, segname string, offset int64, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			log.Debugf("(OpenStack) Upload segment (%s) offset=%d length=%d", segname, offset, length)
+			var header http.Header
+			err := s.policy().do("upload "+segname, func(attempt int) (err error) {
+				result := objects.Create(s.client, s.segmentContainer, segname, io.NewSectionReader(data, offset, length), objects.CreateOpts{})
+				header, err = result.ExtractHeader()
+				return err
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			manifest[i] = sloSegment{
+				Path:      fmt.Sprintf("/%s/%s", s.segmentContainer, segname),
+				Etag:      strings.Trim(header.Get("Etag"), "\""),
+				SizeBytes: length,
+			}
+		}(i, segname, offset, length)
+	}
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			err = e
+			break
+		}
+	}
+
+	if err == nil {
+		var body []byte
+		if body, err = json.Marshal(manifest); err == nil {
+			err = s.putManifest(name, body)
+		}
+	}
+
+	if err != nil {
+		// Remove uploaded segments
+		for i, seg := range manifest {
+			if seg.Path != "" {
+				objects.Delete(s.client, s.segmentContainer, fmt.Sprintf("%s%08d", prefix, i), nil)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// putManifest puts the SLO manifest.
+// objects.Create is not used here, since it sends the MD5 of the manifest as ETag and
+// compares it with the returned ETag, which is the ETag of the large object instead.
+func (s *Swift) putManifest(name string, body []byte) error {
+	url := s.client.ServiceURL(s.containerName, name) + "?multipart-manifest=put"
+	return s.policy().do("put manifest "+name, func(attempt int) error {
+		resp, err := s.client.Request("PUT", url, gophercloud.RequestOpts{
+			RawBody: bytes.NewReader(body),
+			MoreHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+			OkCodes: []int{201},
+		})
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+}
+
+func (s *Swift) Head(name string) (info ObjectInfo, err error) {
+	var header http.Header
+	err = s.policy().do("head "+name, func(attempt int) (err error) {
+		header, err = objects.Get(s.client, s.containerName, name, nil).ExtractHeader()
+		return err
+	})
+	if err != nil {
+		return info, err
+	}
+
+	info.Name = name
+	info.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	info.Hash = strings.Trim(header.Get("Etag"), "\"")
+	info.LastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+
+	if manifest := header.Get("X-Object-Manifest"); manifest != "" {
+		info.Manifest = MANIFEST_DLO
+		info.ObjectManifest = manifest
+		info.Segments, err = s.dloSegments(manifest)
+
+	} else if strings.ToLower(header.Get("X-Static-Large-Object")) == "true" {
+		info.Manifest = MANIFEST_SLO
+		info.Segments, err = s.sloSegments(name)
+	}
+
+	return info, err
+}
+
+// dloSegments lists the segments that X-Object-Manifest ("container/prefix") refers to.
+func (s *Swift) dloSegments(manifest string) (segments []Segment, err error) {
+	if manifest, err = url.QueryUnescape(manifest); err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(manifest, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid X-Object-Manifest (%s)", manifest)
+	}
+
+	segments = []Segment{}
+	marker := ""
+	for {
+		objlist, err := s.listPage(parts[0], parts[1], marker)
+		if err != nil {
+			return nil, err
+		} else if len(objlist) == 0 {
+			break
+		}
+
+		for _, obj := range objlist {
+			segments = append(segments, Segment{
+				Container: parts[0],
+				Name:      obj.Name,
+				Bytes:     obj.Bytes,
+				Hash:      obj.Hash,
+			})
+		}
+		marker = objlist[len(objlist)-1].Name
+	}
+
+	return segments, nil
+}
+
+// sloSegments reads the SLO manifest of the object.
+func (s *Swift) sloSegments(name string) ([]Segment, error) {
+	result := s.download(name, objects.DownloadOpts{
+		MultipartManifest: "get",
+	})
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	defer result.Body.Close()
+
+	var manifest []sloManifestEntry
+	if err := json.NewDecoder(result.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	segments := make([]Segment, 0, len(manifest))
+	for _, m := range manifest {
+		parts := strings.SplitN(strings.TrimPrefix(m.Name, "/"), "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid segment name (%s) in the manifest of %s", m.Name, name)
+		}
+
+		segments = append(segments, Segment{
+			Container: parts[0],
+			Name:      parts[1],
+			Bytes:     m.Bytes,
+			Hash:      m.Hash,
+		})
+	}
+	return segments, nil
+}
+
+// copyManifest puts a new manifest which refers to the same segments as the object.
+func (s *Swift) copyManifest(info ObjectInfo, newName string) error {
+	log.Debugf("(OpenStack) Copy manifest from \"%s\" to \"%s\"", info.Name, newName)
+
+	switch info.Manifest {
+	case MANIFEST_DLO:
+		opts := objects.CreateOpts{
+			ObjectManifest: info.ObjectManifest,
+		}
+		return s.policy().do("copy manifest "+info.Name, func(attempt int) error {
+			return objects.Create(s.client, s.containerName, newName, strings.NewReader(""), opts).Err
+		})
+
+	case MANIFEST_SLO:
+		manifest := make([]sloSegment, 0, len(info.Segments))
+		for _, seg := range info.Segments {
+			manifest = append(manifest, sloSegment{
+				Path:      fmt.Sprintf("/%s/%s", seg.Container, seg.Name),
+				Etag:      seg.Hash,
+				SizeBytes: seg.Bytes,
+			})
+		}
+
+		body, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		return s.putManifest(newName, body)
+	}
+
+	return fmt.Errorf("%s is not a manifest", info.Name)
+}
+
+func (s *Swift) DeleteSegments(segments []Segment) error {
+	for _, seg := range segments {
+		log.Debugf("(OpenStack) Delete segment %s/%s", seg.Container, seg.Name)
+
+		err := s.deleteObject(seg.Container, seg.Name)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package openstack
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// The first interval between retries. It is doubled for each retry up to RETRY_MAX_BACKOFF.
+	RETRY_BACKOFF     = 500 * time.Millisecond
+	RETRY_MAX_BACKOFF = 16 * time.Second
+)
+
+// retryPolicy retries requests that failed with transient errors, with exponential backoff and jitter.
+type retryPolicy struct {
+	attempts   int           // The number of attempts including the first one
+	deadline   time.Duration // The time limit of retrying. 0 means no limit.
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetryPolicy(attempts int, deadline time.Duration) retryPolicy {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return retryPolicy{
+		attempts:   attempts,
+		deadline:   deadline,
+		backoff:    RETRY_BACKOFF,
+		maxBackoff: RETRY_MAX_BACKOFF,
+	}
+}
+
+// do calls f until it succeeds or fails with a permanent error.
+// f is called with the number of the attempt, starting from 0.
+func (p retryPolicy) do(op string, f func(attempt int) error) (err error) {
+	begin := time.Now()
+	backoff := p.backoff
+
+	for i := 0; ; i++ {
+		if err = f(i); err == nil || !Retryable(err) {
+			return err
+		}
+		if i+1 >= p.attempts {
+			break
+		}
+
+		// Sleep for a random duration in [backoff/2, backoff) not to retry at the same time as other clients.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if p.deadline > 0 && time.Now().Sub(begin)+wait > p.deadline {
+			break
+		}
+
+		log.Debugf("(OpenStack) Retry %s after %v. %v", op, wait, err)
+		time.Sleep(wait)
+
+		if backoff *= 2; backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+
+	log.Warnf("(OpenStack) Give up %s. %v", op, err)
+	return err
+}
+
+// Retryable returns true if the request may succeed by sending it again.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch StatusCode(err) {
+	case 0:
+		// Not an HTTP error
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	default:
+		return false
+	}
+
+	// Connection errors and timeouts. Errors of TLS and malformed URLs are not retried.
+	switch e := err.(type) {
+	case *url.Error:
+		// The connection was closed by the server before the response.
+		if e.Err == io.EOF {
+			return true
+		}
+		return Retryable(e.Err)
+	case *net.OpError:
+		return true
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED || e == syscall.ETIMEDOUT || e == syscall.EPIPE
+	case net.Error:
+		return e.Timeout()
+	}
+	return err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,98 @@
+package openstack
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rackspace/gophercloud"
+)
+
+func httpError(code int) error {
+	return &gophercloud.UnexpectedResponseCodeError{Method: "PUT", Expected: []int{201}, Actual: code}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{httpError(503), true},
+		{httpError(500), true},
+		{httpError(429), true},
+		{httpError(404), false},
+		{httpError(413), false},
+		{httpError(401), false},
+		{&url.Error{Op: "Put", URL: "http://swift", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, true},
+		{&url.Error{Op: "Put", URL: "http://swift", Err: &net.DNSError{Err: "timeout", Name: "swift", IsTimeout: true}}, true},
+		{&url.Error{Op: "Put", URL: "http://swift", Err: io.EOF}, true},
+		{&url.Error{Op: "Put", URL: "https://swift", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "parse", URL: "http://[swift", Err: errors.New("missing ']' in host")}, false},
+		{io.ErrUnexpectedEOF, true},
+		{syscall.ECONNRESET, true},
+		{syscall.EACCES, false},
+		{errors.New("invalid manifest"), false},
+	}
+
+	for _, test := range tests {
+		if r := Retryable(test.err); r != test.retryable {
+			t.Errorf("Retryable(%v) = %v", test.err, r)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := newRetryPolicy(3, 0)
+	p.backoff = time.Millisecond
+
+	// Transient errors are retried.
+	n := 0
+	err := p.do("test", func(attempt int) error {
+		if n++; n < 3 {
+			return httpError(503)
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Errorf("Request was not retried (%d attempts) %v", n, err)
+	}
+
+	// Up to the attempts
+	n = 0
+	err = p.do("test", func(attempt int) error {
+		n++
+		return httpError(503)
+	})
+	if StatusCode(err) != 503 || n != 3 {
+		t.Errorf("Invalid attempts %d %v", n, err)
+	}
+
+	// Permanent errors are not retried.
+	n = 0
+	err = p.do("test", func(attempt int) error {
+		n++
+		return httpError(404)
+	})
+	if !isNotFound(err) || n != 1 {
+		t.Errorf("Permanent error was retried (%d attempts) %v", n, err)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	p := newRetryPolicy(100, 50*time.Millisecond)
+	p.backoff = 20 * time.Millisecond
+
+	begin := time.Now()
+	p.do("test", func(attempt int) error {
+		return httpError(503)
+	})
+	if elapsed := time.Now().Sub(begin); elapsed > 100*time.Millisecond {
+		t.Errorf("Retrying exceeded the deadline (%v)", elapsed)
+	}
+}
@@ -0,0 +1,43 @@
+package openstack
+
+import (
+	"io"
+
+	"github.com/rackspace/gophercloud/openstack/objectstorage/v1/objects"
+)
+
+// ObjectStorage is the set of operations that the mapper uses to access a container.
+// Swift is the implementation for OpenStack Swift. Other implementations can be passed
+// to mapper.NewObjectMapper() to use alternative stores or to run tests without Swift.
+type ObjectStorage interface {
+	// List sends all objects in the container to the first channel,
+	// then sends the number of objects to the second one. If the listing failed, the error is sent
+	// to the third one instead of the number.
+	List() (chan objects.Object, chan int, chan error)
+
+	Get(name string) objects.DownloadResult
+
+	// GetRange downloads length bytes from offset of the object.
+	GetRange(name string, offset int64, length int64) objects.DownloadResult
+
+	Upload(name string, data io.ReadSeeker) error
+	Delete(name string) error
+
+	// Copy copies the object. If the object is a large object, the manifest is copied
+	// and the segments are shared with the new object.
+	Copy(oldName string, newName string) error
+
+	// Head returns the information of the object including segments of large objects.
+	Head(name string) (ObjectInfo, error)
+
+	// DeleteSegments deletes segments of large objects.
+	DeleteSegments(segments []Segment) error
+
+	GetContainer() (Container, error)
+	CreateContainer() error
+
+	MakeDirectory(name string) error
+	RemoveDirectory(name string) error
+}
+
+var _ ObjectStorage = &Swift{}
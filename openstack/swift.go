@@ -3,9 +3,12 @@ package openstack
 import (
 	"fmt"
 	"io"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hironobu-s/swiftfs/config"
@@ -30,29 +33,45 @@ type Swift struct {
 
 	containerName   string
 	ObjectListSize  int
+	authType        string // config.AUTH_*
+	storageURL      string // config.AUTH_STORAGE_URL only
 	authOptions     gophercloud.AuthOptions
+	v3Options       v3AuthOptions
 	endpointOptions gophercloud.EndpointOpts
+
+	// Large objects
+	segmentSize        int64
+	segmentContainer   string
+	segmentConcurrency int
+
+	// Retrying requests on transient failures
+	retry     retryPolicy
+	retryLock sync.Mutex
 }
 
 func NewSwift(c *config.Config) *Swift {
 	s := &Swift{}
 
-	// Auth options
-	var err error
-	s.authOptions, err = openstack.AuthOptionsFromEnv()
-	if err == nil {
-		log.Debugf("(OpenStack) Use auth parameters in ENV.")
-
-	} else {
-		log.Debugf("(OpenStack) Use auth parameters via command-line options.")
-		s.authOptions = gophercloud.AuthOptions{
-			IdentityEndpoint: c.IdentityEndpoint,
-			UserID:           c.UserID,
-			Username:         c.Username,
-			Password:         c.Password,
-			TenantID:         c.TenantID,
-			TenantName:       c.TenantName,
-		}
+	s.authType = c.AuthStrategy()
+	s.storageURL = c.StorageURL
+
+	// Auth options. The command-line options are also read from OS_* environment variables.
+	s.authOptions = gophercloud.AuthOptions{
+		IdentityEndpoint: c.IdentityEndpoint,
+		UserID:           c.UserID,
+		Username:         c.Username,
+		Password:         c.Password,
+		TenantID:         c.TenantID,
+		TenantName:       c.TenantName,
+		TokenID:          c.Token,
+	}
+	s.v3Options = v3AuthOptions{
+		UserDomainID:                c.UserDomainID,
+		UserDomainName:              c.UserDomainName,
+		ProjectDomainID:             c.ProjectDomainID,
+		ProjectDomainName:           c.ProjectDomainName,
+		ApplicationCredentialID:     c.ApplicationCredentialID,
+		ApplicationCredentialSecret: c.ApplicationCredentialSecret,
 	}
 
 	// Endpoint options
@@ -60,6 +79,9 @@ func NewSwift(c *config.Config) *Swift {
 	if c.RegionName != "" {
 		s.endpointOptions.Region = c.RegionName
 	}
+	if c.EndpointInterface != "" {
+		s.endpointOptions.Availability = gophercloud.Availability(c.EndpointInterface)
+	}
 
 	// Enable auto reauth
 	s.authOptions.AllowReauth = true
@@ -67,11 +89,48 @@ func NewSwift(c *config.Config) *Swift {
 	// Container Name
 	s.containerName = c.ContainerName
 
+	// Large objects
+	s.segmentSize = c.SegmentSize
+	s.segmentContainer = c.SegmentContainer
+	if s.segmentContainer == "" {
+		s.segmentContainer = s.containerName + "_segments"
+	}
+	s.segmentConcurrency = c.SegmentConcurrency
+	if s.segmentConcurrency < 1 {
+		s.segmentConcurrency = 1
+	}
+
+	s.retry = newRetryPolicy(c.RetryAttempts, c.RetryDeadline)
+
 	return s
 }
 
+// SetRetryPolicy changes the retry policy of the following requests.
+func (s *Swift) SetRetryPolicy(attempts int, deadline time.Duration) {
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	s.retry = newRetryPolicy(attempts, deadline)
+}
+
+func (s *Swift) policy() retryPolicy {
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	return s.retry
+}
+
 func (s *Swift) Auth() error {
-	if s.authOptions.Username != "" {
+	switch s.authType {
+	case config.AUTH_TEMPAUTH:
+		return s.authTempAuth()
+	case config.AUTH_STORAGE_URL:
+		return s.authStorageURL()
+	}
+
+	if s.v3Options.ApplicationCredentialID != "" {
+		log.Debugf("(OpenStack) Authenticate by application credential(%s)", s.v3Options.ApplicationCredentialID)
+	} else if s.authOptions.TokenID != "" {
+		log.Debugf("(OpenStack) Authenticate by token")
+	} else if s.authOptions.Username != "" {
 		log.Debugf("(OpenStack) Authenticate by username(%s)", s.authOptions.Username)
 	} else if s.authOptions.UserID != "" {
 		log.Debugf("(OpenStack) Authenticate by user-id(%s)", s.authOptions.UserID)
@@ -79,6 +138,11 @@ func (s *Swift) Auth() error {
 		log.Debugf("(OpenStack) Authenticate")
 	}
 
+	// gophercloud supports neither domains of the user and project nor application credentials.
+	if s.useKeystoneV3() {
+		return s.authV3()
+	}
+
 	provider, err := openstack.AuthenticatedClient(s.authOptions)
 	if err != nil {
 		return err
@@ -92,65 +156,139 @@ func (s *Swift) Auth() error {
 	return nil
 }
 
-func (s *Swift) List() (objch chan objects.Object, n chan int) {
+func (s *Swift) List() (objch chan objects.Object, n chan int, errch chan error) {
+	return s.list(true)
+}
+
+// list sends objects in the container. Segments of large objects are skipped if hideSegments is true.
+func (s *Swift) list(hideSegments bool) (objch chan objects.Object, n chan int, errch chan error) {
 	objch = make(chan objects.Object)
 	n = make(chan int)
+	errch = make(chan error)
 
 	go func() {
-		pager := objects.List(s.client, s.containerName, objects.ListOpts{
-			Full: true,
-		})
-
 		i := 0
-		pager.EachPage(func(page pagination.Page) (bool, error) {
-			objlist, err := objects.ExtractInfo(page)
+		marker := ""
+		for {
+			// The page that failed is requested again from the last object.
+			objlist, err := s.listPage(s.containerName, "", marker)
 			if err != nil {
-				log.Debugf("%v\n", err)
-				return false, err
+				log.Warnf("(OpenStack) Listing objects failed after %s. %v", marker, err)
+				errch <- err
+				return
+			} else if len(objlist) == 0 {
+				break
 			}
 
 			for _, obj := range objlist {
-				objch <- obj
+				if hideSegments && s.isSegment(obj.Name) {
+					continue
+				}
+				objch <- normalizeObject(obj)
 				i++
 			}
-
-			return true, nil
-		})
+			marker = objlist[len(objlist)-1].Name
+		}
 
 		n <- i
 	}()
 
-	return objch, n
+	return objch, n, errch
 }
 
 func (s *Swift) Upload(name string, data io.ReadSeeker) error {
-	opts := objects.CreateOpts{}
-	result := objects.Create(s.client, s.containerName, name, data, opts)
-	if result.Err != nil {
-		return result.Err
+	// Large files are uploaded as Static Large Objects
+	if ra, ok := data.(io.ReaderAt); ok && s.segmentSize > 0 {
+		size, err := data.Seek(0, os.SEEK_END)
+		if err != nil {
+			return err
+		}
+		if _, err = data.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+
+		if size > s.segmentSize {
+			return s.uploadLargeObject(name, ra, size)
+		}
 	}
-	return nil
+
+	return s.policy().do("upload "+name, func(attempt int) error {
+		// The data may be read partially by the failed request.
+		if _, err := data.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+		return objects.Create(s.client, s.containerName, name, data, objects.CreateOpts{}).Err
+	})
 }
 
 func (s *Swift) Delete(name string) error {
-	result := objects.Delete(s.client, s.containerName, name, nil)
-	return result.Err
+	return s.deleteObject(s.containerName, name)
+}
+
+// deleteObject deletes the object. Not Found on a retry means the failed request deleted it.
+func (s *Swift) deleteObject(container string, name string) error {
+	return s.policy().do("delete "+name, func(attempt int) error {
+		err := objects.Delete(s.client, container, name, nil).Err
+		if attempt > 0 && isNotFound(err) {
+			return nil
+		}
+		return err
+	})
 }
 
 func (s *Swift) Get(name string) objects.DownloadResult {
 	log.Debugf("(OpenStack) Download object (%s)", name)
-	opts := objects.DownloadOpts{}
-	return objects.Download(s.client, s.containerName, name, opts)
+	return s.download(name, objects.DownloadOpts{})
+}
+
+func (s *Swift) GetRange(name string, offset int64, length int64) objects.DownloadResult {
+	log.Debugf("(OpenStack) Download object (%s) offset=%d length=%d", name, offset, length)
+	opts := objects.DownloadOpts{
+		Range: fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+	}
+	return s.download(name, opts)
+}
+
+func (s *Swift) download(name string, opts objects.DownloadOpts) (result objects.DownloadResult) {
+	s.policy().do("download "+name, func(attempt int) error {
+		result = objects.Download(s.client, s.containerName, name, opts)
+		return result.Err
+	})
+	return result
 }
 
+// listPage returns the objects in the container after marker, up to the page size of the server.
+func (s *Swift) listPage(container string, prefix string, marker string) (objlist []objects.Object, err error) {
+	err = s.policy().do("list "+container, func(attempt int) error {
+		pager := objects.List(s.client, container, objects.ListOpts{
+			Full:   true,
+			Prefix: prefix,
+			Marker: marker,
+		})
+		return pager.EachPage(func(page pagination.Page) (bool, error) {
+			var err error
+			objlist, err = objects.ExtractInfo(page)
+			return false, err
+		})
+	})
+	return objlist, err
+}
+
+// Copy copies the object on the server side.
+// If the object is a large object, the manifest is copied and the segments are shared with the new one.
 func (s *Swift) Copy(oldName string, newName string) error {
+	if info, err := s.Head(oldName); err == nil && info.Manifest != MANIFEST_NONE {
+		return s.copyManifest(info, newName)
+	}
+
 	log.Debugf("(OpenStack) Copy object from \"%s\" to \"%s\"", oldName, newName)
 
 	opts := objects.CopyOpts{
 		Destination: fmt.Sprintf("%s/%s", s.containerName, newName),
 	}
-	result := objects.Copy(s.client, s.containerName, oldName, opts)
-	return result.Err
+	return s.policy().do("copy "+oldName, func(attempt int) error {
+		return objects.Copy(s.client, s.containerName, oldName, opts).Err
+	})
 }
 
 type Container struct {
@@ -166,8 +304,11 @@ func (s *Swift) GetContainer() (container Container, err error) {
 
 	// get account quota
 	go func(mm *sync.Mutex) {
-		account := accounts.Get(s.client)
-		headers, err := account.ExtractHeader()
+		var headers http.Header
+		err := s.policy().do("get account", func(attempt int) (err error) {
+			headers, err = accounts.Get(s.client).ExtractHeader()
+			return err
+		})
 		if err != nil {
 			cerr <- err
 			return
@@ -196,13 +337,11 @@ func (s *Swift) GetContainer() (container Container, err error) {
 	go func(mm *sync.Mutex) {
 		var strval string
 
-		result := containers.Get(s.client, s.containerName)
-		if result.Err != nil {
-			cerr <- result.Err
-			return
-		}
-
-		headers, err := result.ExtractHeader()
+		var headers http.Header
+		err := s.policy().do("get container", func(attempt int) (err error) {
+			headers, err = containers.Get(s.client, s.containerName).ExtractHeader()
+			return err
+		})
 		if err != nil {
 			cerr <- err
 			return
@@ -244,14 +383,15 @@ func (s *Swift) GetContainer() (container Container, err error) {
 
 func (s *Swift) CreateContainer() error {
 	opts := containers.CreateOpts{}
-	result := containers.Create(s.client, s.containerName, opts)
-	return result.Err
+	return s.policy().do("create "+s.containerName, func(attempt int) error {
+		return containers.Create(s.client, s.containerName, opts).Err
+	})
 }
 
 func (s *Swift) DeleteContainer() error {
 	var err error
 
-	objch, n := s.List()
+	objch, n, errch := s.list(false)
 N:
 	for {
 		select {
@@ -261,6 +401,8 @@ N:
 			}
 		case <-n:
 			break N
+		case err = <-errch:
+			return err
 		}
 	}
 
@@ -272,12 +414,11 @@ func (s *Swift) MakeDirectory(name string) error {
 	opts := objects.CreateOpts{
 		ContentType: "application/directory",
 	}
-	result := objects.Create(s.client, s.containerName, name, strings.NewReader(""), opts)
-	return result.Err
+	return s.policy().do("make directory "+name, func(attempt int) error {
+		return objects.Create(s.client, s.containerName, name, strings.NewReader(""), opts).Err
+	})
 }
 
 func (s *Swift) RemoveDirectory(name string) error {
-	opts := objects.DeleteOpts{}
-	result := objects.Delete(s.client, s.containerName, name, opts)
-	return result.Err
+	return s.deleteObject(s.containerName, name)
 }
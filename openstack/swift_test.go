@@ -1,6 +1,7 @@
 package openstack
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -8,9 +9,12 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/openstack/swifttest"
+	"github.com/rackspace/gophercloud/openstack/objectstorage/v1/objects"
 )
 
 var client *Swift
+var server *swifttest.Server
 
 const (
 	TEST_CONTAINER_NAME = "objfs-test"
@@ -22,11 +26,10 @@ const (
 func TestMain(m *testing.M) {
 	var err error
 
-	c := config.NewConfig()
-	c.ContainerName = TEST_CONTAINER_NAME
+	server = swifttest.NewServer()
 
-	client = NewSwift(c)
-	if err = client.Auth(); err != nil {
+	client, err = newTestClient(server, TEST_CONTAINER_NAME)
+	if err != nil {
 		log.Fatalf("%v", err)
 		os.Exit(1)
 	}
@@ -34,10 +37,32 @@ func TestMain(m *testing.M) {
 	client.CreateContainer()
 	code := m.Run()
 	client.DeleteContainer()
+	server.Close()
 
 	defer os.Exit(code)
 }
 
+// newTestClient returns an authenticated client for the local server.
+func newTestClient(server *swifttest.Server, containerName string) (*Swift, error) {
+	// NewSwift() prefers auth parameters in ENV.
+	for _, name := range []string{"OS_AUTH_URL", "OS_USERNAME", "OS_USERID", "OS_PASSWORD", "OS_TENANT_ID", "OS_TENANT_NAME"} {
+		os.Unsetenv(name)
+	}
+
+	c := config.NewConfig()
+	c.ContainerName = containerName
+	c.IdentityEndpoint = server.AuthURL()
+	c.Username = server.Username
+	c.Password = server.Password
+	c.TenantName = server.TenantName
+
+	s := NewSwift(c)
+	if err := s.Auth(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 func TestUpload(t *testing.T) {
 	testobj, err := ioutil.TempFile("", "objfs")
 	if err != nil {
@@ -74,12 +99,14 @@ func TestGet(t *testing.T) {
 }
 
 func TestList(t *testing.T) {
-	objch, n := client.List()
+	objch, n, errch := client.List()
 
 	exists := false
 L1:
 	for {
 		select {
+		case err := <-errch:
+			t.Fatalf("%v", err)
 		case obj := <-objch:
 			if obj.Name == TEST_OBJECT_NAME {
 				exists = true
@@ -98,12 +125,14 @@ func TestDelete(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 
-	objch, n := client.List()
+	objch, n, errch := client.List()
 
 	exists := false
 L2:
 	for {
 		select {
+		case err := <-errch:
+			t.Fatalf("%v", err)
 		case obj := <-objch:
 			if obj.Name == TEST_OBJECT_NAME {
 				exists = true
@@ -184,3 +213,389 @@ func TestContainerDeletion(t *testing.T) {
 		t.Errorf("Container deletion failed")
 	}
 }
+
+func TestAuthV3(t *testing.T) {
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.IdentityEndpoint = server.AuthURLv3()
+	c.Username = server.Username
+	c.Password = server.Password
+	c.TenantName = server.TenantName
+
+	if err := NewSwift(c).Auth(); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	c.Password = "wrong-password"
+	if err := NewSwift(c).Auth(); err == nil {
+		t.Errorf("Auth() should fail with wrong password")
+	}
+}
+
+func TestAuthV3Domains(t *testing.T) {
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.IdentityEndpoint = server.AuthURLv3()
+	c.Username = server.Username
+	c.Password = server.Password
+	c.TenantName = server.TenantName
+	c.UserDomainName = server.DomainName
+	c.ProjectDomainID = server.DomainID
+
+	s := NewSwift(c)
+	if err := s.Auth(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.client.TokenID != server.Token || strings.TrimSuffix(s.client.Endpoint, "/") != server.StorageURL() {
+		t.Errorf("Invalid client token=%s endpoint=%s", s.client.TokenID, s.client.Endpoint)
+	}
+
+	c.ProjectDomainID = "other"
+	if err := NewSwift(c).Auth(); err == nil {
+		t.Errorf("Auth() should fail with wrong project domain")
+	}
+}
+
+func TestAuthV3ApplicationCredential(t *testing.T) {
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.IdentityEndpoint = server.URL
+	c.ApplicationCredentialID = server.ApplicationCredentialID
+	c.ApplicationCredentialSecret = server.ApplicationCredentialSecret
+
+	// Keystone v3 is used without "/v3" in the auth URL.
+	if err := NewSwift(c).Auth(); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	c.ApplicationCredentialSecret = "wrong-secret"
+	if err := NewSwift(c).Auth(); err == nil {
+		t.Errorf("Auth() should fail with wrong secret")
+	}
+}
+
+func TestAuthV3Token(t *testing.T) {
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.IdentityEndpoint = server.AuthURLv3()
+	c.Token = server.Token
+	c.TenantID = server.TenantID
+
+	s := NewSwift(c)
+	if err := s.Auth(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.client.ReauthFunc != nil {
+		t.Errorf("Pre-issued token can not be reauthenticated")
+	}
+}
+
+func TestAuthTempAuth(t *testing.T) {
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.IdentityEndpoint = server.AuthURLv1()
+	c.Username = server.TenantName + ":" + server.Username
+	c.Password = server.Password
+
+	s := NewSwift(c)
+	if err := s.Auth(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.client.TokenID != server.Token || strings.TrimSuffix(s.client.Endpoint, "/") != server.StorageURL() {
+		t.Errorf("Invalid client token=%s endpoint=%s", s.client.TokenID, s.client.Endpoint)
+	}
+
+	c.Password = "wrong-key"
+	if err := NewSwift(c).Auth(); err == nil {
+		t.Errorf("Auth() should fail with wrong key")
+	}
+}
+
+func TestAuthStorageURL(t *testing.T) {
+	c := config.NewConfig()
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.StorageURL = server.StorageURL()
+	c.Token = server.Token
+
+	// No request is sent to the identity service.
+	s := NewSwift(c)
+	if err := s.Auth(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.client.TokenID != server.Token || strings.TrimSuffix(s.client.Endpoint, "/") != server.StorageURL() {
+		t.Errorf("Invalid client token=%s endpoint=%s", s.client.TokenID, s.client.Endpoint)
+	}
+	if s.client.ReauthFunc != nil {
+		t.Errorf("Pre-authorized token can not be reauthenticated")
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	var err error
+
+	server.SetListingLimit(7)
+	defer server.SetListingLimit(swifttest.DEFAULT_LISTING_LIMIT)
+
+	if err = client.CreateContainer(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	num := 50
+	for i := 0; i < num; i++ {
+		name := fmt.Sprintf("paging/%03d", i)
+		if err = client.Upload(name, strings.NewReader(TEST_OBJECT_DATA)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	found := map[string]bool{}
+	objch, n, errch := client.List()
+L:
+	for {
+		select {
+		case err := <-errch:
+			t.Fatalf("%v", err)
+		case obj := <-objch:
+			found[obj.Name] = true
+		case <-n:
+			break L
+		}
+	}
+
+	for i := 0; i < num; i++ {
+		name := fmt.Sprintf("paging/%03d", i)
+		if !found[name] {
+			t.Errorf("Object %s not found in the list", name)
+		}
+		client.Delete(name)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	var err error
+
+	if err = client.CreateContainer(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = client.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	copied := TEST_OBJECT_NAME + "-copied"
+	if err = client.Copy(TEST_OBJECT_NAME, copied); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	data, ok := server.Object(TEST_CONTAINER_NAME, copied)
+	if !ok || string(data) != TEST_OBJECT_DATA {
+		t.Errorf("Copied object does not match")
+	}
+
+	client.Delete(TEST_OBJECT_NAME)
+	client.Delete(copied)
+}
+
+func TestGetContainer(t *testing.T) {
+	var err error
+
+	if err = client.CreateContainer(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err = client.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer client.Delete(TEST_OBJECT_NAME)
+
+	container, err := client.GetContainer()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if container.Quota != DEFAULT_ACCOUNT_QUOTA {
+		t.Errorf("Quota should be default value when the account has no quota (%d)", container.Quota)
+	}
+	if container.Used != uint64(len(TEST_OBJECT_DATA)) || container.Count != 1 {
+		t.Errorf("Invalid container usage %v", container)
+	}
+
+	server.AccountQuota = 1024
+	defer func() { server.AccountQuota = 0 }()
+
+	container, err = client.GetContainer()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if container.Quota != 1024 {
+		t.Errorf("Invalid quota %d", container.Quota)
+	}
+}
+
+func TestUploadLargeObject(t *testing.T) {
+	var err error
+
+	c, err := newTestClient(server, TEST_CONTAINER_NAME)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.segmentSize = 10
+	c.CreateContainer()
+
+	data := strings.Repeat("0123456789", 3) + "abcde"
+	if err = c.Upload(TEST_OBJECT_NAME, strings.NewReader(data)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer c.Delete(TEST_OBJECT_NAME)
+
+	if !server.ContainerExists(c.segmentContainer) {
+		t.Fatalf("Segment container was not created")
+	}
+
+	result := c.Get(TEST_OBJECT_NAME)
+	body, err := ioutil.ReadAll(result.Body)
+	result.Body.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	} else if string(body) != data {
+		t.Errorf("Invalid object data %s", body)
+	}
+
+	objch, n, errch := c.List()
+L:
+	for {
+		select {
+		case err := <-errch:
+			t.Fatalf("%v", err)
+		case obj := <-objch:
+			if obj.Name == TEST_OBJECT_NAME && obj.Bytes != int64(len(data)) {
+				t.Errorf("Listing does not report the logical size (%d)", obj.Bytes)
+			}
+		case <-n:
+			break L
+		}
+	}
+}
+
+func TestUploadLargeObjectSameContainer(t *testing.T) {
+	var err error
+
+	c, err := newTestClient(server, TEST_CONTAINER_NAME)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.segmentSize = 4
+	c.segmentContainer = TEST_CONTAINER_NAME
+	c.CreateContainer()
+
+	if err = c.Upload(TEST_OBJECT_NAME, strings.NewReader(TEST_OBJECT_DATA)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer c.Delete(TEST_OBJECT_NAME)
+
+	objch, n, errch := c.List()
+L:
+	for {
+		select {
+		case err := <-errch:
+			t.Fatalf("%v", err)
+		case obj := <-objch:
+			if strings.HasPrefix(obj.Name, SEGMENT_PREFIX) {
+				t.Errorf("Segment %s appears in the listing", obj.Name)
+			}
+		case <-n:
+			break L
+		}
+	}
+}
+
+func TestNormalizeObject(t *testing.T) {
+	obj := normalizeObject(objects.Object{
+		Name:        "large",
+		Bytes:       100,
+		ContentType: "application/octet-stream;swift_bytes=1048576",
+	})
+
+	if obj.Bytes != 1048576 {
+		t.Errorf("Invalid size %d", obj.Bytes)
+	}
+	if obj.ContentType != "application/octet-stream" {
+		t.Errorf("Invalid content type %s", obj.ContentType)
+	}
+}
+
+func TestLargeObjectManifests(t *testing.T) {
+	var err error
+
+	if err = client.CreateContainer(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// DLO made by other tools, e.g. python-swiftclient
+	server.PutObject(TEST_CONTAINER_NAME+"_segments", "dlo/00", []byte("hoge"), "application/octet-stream")
+	server.PutObject(TEST_CONTAINER_NAME+"_segments", "dlo/01", []byte("fuga"), "application/octet-stream")
+	server.PutDynamicLargeObject(TEST_CONTAINER_NAME, "dlo", TEST_CONTAINER_NAME+"_segments/dlo/")
+
+	info, err := client.Head("dlo")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Manifest != MANIFEST_DLO || info.Size != 8 || len(info.Segments) != 2 {
+		t.Errorf("Invalid information of DLO %v", info)
+	}
+
+	// Copy() should copy the manifest
+	if err = client.Copy("dlo", "dlo-copied"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	copied, err := client.Head("dlo-copied")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if copied.Manifest != MANIFEST_DLO || copied.ObjectManifest != info.ObjectManifest {
+		t.Errorf("Copied object is not a manifest %v", copied)
+	}
+
+	// SLO
+	c, err := newTestClient(server, TEST_CONTAINER_NAME)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.segmentSize = 4
+	if err = c.Upload("slo", strings.NewReader(TEST_OBJECT_DATA)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	info, err = client.Head("slo")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Manifest != MANIFEST_SLO || info.Size != int64(len(TEST_OBJECT_DATA)) || len(info.Segments) != 2 {
+		t.Errorf("Invalid information of SLO %v", info)
+	}
+
+	if err = client.Copy("slo", "slo-copied"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if copied, err = client.Head("slo-copied"); err != nil || copied.Manifest != MANIFEST_SLO {
+		t.Errorf("Copied object is not a manifest %v", copied)
+	}
+
+	// DeleteSegments()
+	if err = client.DeleteSegments(info.Segments); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, seg := range info.Segments {
+		if _, ok := server.Object(seg.Container, seg.Name); ok {
+			t.Errorf("Segment %s still exists", seg.Name)
+		}
+	}
+
+	for _, name := range []string{"dlo", "dlo-copied", "slo", "slo-copied"} {
+		client.Delete(name)
+	}
+	client.DeleteSegments(copied.Segments)
+}
+
+func TestHeadNotFound(t *testing.T) {
+	if _, err := client.Head("not-exists"); err == nil {
+		t.Errorf("Head() should fail for the object that does not exist")
+	}
+}
@@ -0,0 +1,272 @@
+package swifttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Format of timestamps in Keystone responses.
+const KEYSTONE_TIME_FORMAT = "2006-01-02T15:04:05.000000Z"
+
+func (s *Server) expires() string {
+	return time.Now().Add(24 * time.Hour).UTC().Format(KEYSTONE_TIME_FORMAT)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) serveVersions(w http.ResponseWriter, r *http.Request) {
+	versions := map[string]interface{}{
+		"versions": map[string]interface{}{
+			"values": []interface{}{
+				map[string]interface{}{
+					"id":     "v3.0",
+					"status": "stable",
+					"links":  []interface{}{map[string]string{"rel": "self", "href": s.URL + "/v3/"}},
+				},
+				map[string]interface{}{
+					"id":     "v2.0",
+					"status": "stable",
+					"links":  []interface{}{map[string]string{"rel": "self", "href": s.URL + "/v2.0/"}},
+				},
+			},
+		},
+	}
+	writeJSON(w, http.StatusMultipleChoices, versions)
+}
+
+// ----- Keystone v2
+
+type v2AuthRequest struct {
+	Auth struct {
+		PasswordCredentials *struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"passwordCredentials"`
+		Token *struct {
+			ID string `json:"id"`
+		} `json:"token"`
+		TenantID   string `json:"tenantId"`
+		TenantName string `json:"tenantName"`
+	} `json:"auth"`
+}
+
+func (s *Server) serveKeystoneV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/v2.0/tokens" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req v2AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	auth := req.Auth
+	switch {
+	case auth.PasswordCredentials != nil:
+		if auth.PasswordCredentials.Username != s.Username || auth.PasswordCredentials.Password != s.Password {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+	case auth.Token != nil:
+		if auth.Token.ID != s.Token {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+	default:
+		http.Error(w, "No credentials", http.StatusBadRequest)
+		return
+	}
+
+	if (auth.TenantID != "" && auth.TenantID != s.TenantID) || (auth.TenantName != "" && auth.TenantName != s.TenantName) {
+		http.Error(w, "Invalid tenant", http.StatusUnauthorized)
+		return
+	}
+
+	tenant := map[string]string{"id": s.TenantID, "name": s.TenantName}
+	endpoint := map[string]string{
+		"region":      s.Region,
+		"tenantId":    s.TenantID,
+		"publicURL":   s.StorageURL(),
+		"internalURL": s.StorageURL(),
+		"adminURL":    s.StorageURL(),
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access": map[string]interface{}{
+			"token": map[string]interface{}{
+				"id":      s.Token,
+				"expires": s.expires(),
+				"tenant":  tenant,
+			},
+			"serviceCatalog": []interface{}{
+				map[string]interface{}{
+					"name":      "swift",
+					"type":      "object-store",
+					"endpoints": []interface{}{endpoint},
+				},
+			},
+			"user": map[string]interface{}{
+				"id":    s.Username,
+				"name":  s.Username,
+				"roles": []interface{}{},
+			},
+		},
+	})
+}
+
+// ----- Keystone v3
+
+type v3Domain struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type v3AuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password *struct {
+				User struct {
+					ID       string    `json:"id"`
+					Name     string    `json:"name"`
+					Domain   *v3Domain `json:"domain"`
+					Password string    `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+			Token *struct {
+				ID string `json:"id"`
+			} `json:"token"`
+			ApplicationCredential *struct {
+				ID     string `json:"id"`
+				Secret string `json:"secret"`
+			} `json:"application_credential"`
+		} `json:"identity"`
+		Scope *struct {
+			Project *struct {
+				ID     string    `json:"id"`
+				Name   string    `json:"name"`
+				Domain *v3Domain `json:"domain"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+// validDomain returns true if d is the domain of the server. It is the default domain if d is omitted.
+func (s *Server) validDomain(d *v3Domain) bool {
+	if d == nil {
+		return true
+	}
+	return (d.ID != "" && d.ID == s.DomainID) || (d.Name != "" && d.Name == s.DomainName)
+}
+
+func (s *Server) serveKeystoneV3(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/v3/auth/tokens" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req v3AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity := req.Auth.Identity
+	switch {
+	case identity.Password != nil:
+		user := identity.Password.User
+		if (user.Name != s.Username && user.ID != s.Username) || user.Password != s.Password {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if user.ID == "" && !s.validDomain(user.Domain) {
+			http.Error(w, "Invalid user domain", http.StatusUnauthorized)
+			return
+		}
+	case identity.ApplicationCredential != nil:
+		cred := identity.ApplicationCredential
+		if cred.ID != s.ApplicationCredentialID || cred.Secret != s.ApplicationCredentialSecret {
+			http.Error(w, "Invalid application credential", http.StatusUnauthorized)
+			return
+		}
+		if req.Auth.Scope != nil {
+			http.Error(w, "Application credentials can not request a scope", http.StatusForbidden)
+			return
+		}
+	case identity.Token != nil:
+		if identity.Token.ID != s.Token {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+	default:
+		http.Error(w, "No credentials", http.StatusBadRequest)
+		return
+	}
+
+	if scope := req.Auth.Scope; scope != nil && scope.Project != nil {
+		p := scope.Project
+		if (p.ID != "" && p.ID != s.TenantID) || (p.Name != "" && p.Name != s.TenantName) {
+			http.Error(w, "Invalid project", http.StatusUnauthorized)
+			return
+		}
+		if p.ID == "" && !s.validDomain(p.Domain) {
+			http.Error(w, "Invalid project domain", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("X-Subject-Token", s.Token)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token": map[string]interface{}{
+			"expires_at": s.expires(),
+			"issued_at":  time.Now().UTC().Format(KEYSTONE_TIME_FORMAT),
+			"methods":    identity.Methods,
+			"user": map[string]interface{}{
+				"id":   s.Username,
+				"name": s.Username,
+			},
+			"project": map[string]interface{}{
+				"id":   s.TenantID,
+				"name": s.TenantName,
+			},
+			"catalog": []interface{}{
+				map[string]interface{}{
+					"id":   "swift",
+					"name": "swift",
+					"type": "object-store",
+					"endpoints": []interface{}{
+						map[string]string{"id": "public", "interface": "public", "region": s.Region, "region_id": s.Region, "url": s.StorageURL()},
+						map[string]string{"id": "internal", "interface": "internal", "region": s.Region, "region_id": s.Region, "url": s.StorageURL()},
+						map[string]string{"id": "admin", "interface": "admin", "region": s.Region, "region_id": s.Region, "url": s.StorageURL()},
+					},
+				},
+			},
+		},
+	})
+}
+
+// ----- TempAuth
+
+func (s *Server) serveTempAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Header.Get("X-Auth-User") != s.TenantName+":"+s.Username || r.Header.Get("X-Auth-Key") != s.Password {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("X-Storage-Url", s.StorageURL())
+	w.Header().Set("X-Auth-Token", s.Token)
+	w.Header().Set("X-Storage-Token", s.Token)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,125 @@
+package swifttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An entry of the SLO manifest that is stored in the server.
+type sloSegment struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+// parseManifest creates a manifest object from the request of "PUT ?multipart-manifest=put".
+func (s *Server) parseManifest(r *http.Request) (*object, error) {
+	var manifest []struct {
+		Path      string `json:"path"`
+		Etag      string `json:"etag"`
+		SizeBytes int64  `json:"size_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("Manifest must have at least one segment")
+	}
+
+	obj := &object{
+		contentType: r.Header.Get("Content-Type"),
+		headers:     http.Header{},
+		slo:         make([]sloSegment, 0, len(manifest)),
+	}
+	if obj.contentType == "" {
+		obj.contentType = "application/octet-stream"
+	}
+	obj.headers.Set("X-Static-Large-Object", "True")
+
+	for _, m := range manifest {
+		seg, ok := s.lookup(m.Path)
+		if !ok {
+			return nil, fmt.Errorf("Segment %s not found", m.Path)
+		}
+		if m.Etag != "" && strings.Trim(m.Etag, "\"") != s.etag(seg) {
+			return nil, fmt.Errorf("Etag of segment %s does not match", m.Path)
+		}
+		if m.SizeBytes != 0 && m.SizeBytes != s.size(seg) {
+			return nil, fmt.Errorf("Size of segment %s does not match", m.Path)
+		}
+
+		obj.slo = append(obj.slo, sloSegment{
+			Name:  m.Path,
+			Hash:  s.etag(seg),
+			Bytes: s.size(seg),
+		})
+	}
+	return obj, nil
+}
+
+// serveManifest responds to "GET ?multipart-manifest=get".
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, obj *object) {
+	w.Header().Set("X-Static-Large-Object", "True")
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj.slo)
+}
+
+func (s *Server) deleteSegments(obj *object) {
+	for _, seg := range obj.slo {
+		parts := strings.SplitN(strings.TrimPrefix(seg.Name, "/"), "/", 2)
+		if c, ok := s.containers[parts[0]]; ok && len(parts) == 2 {
+			delete(c.objects, parts[1])
+		}
+	}
+}
+
+// PutDynamicLargeObject stores a DLO manifest. The manifest is "container/prefix" of the segments.
+func (s *Server) PutDynamicLargeObject(containerName string, name string, manifest string) {
+	s.PutObject(containerName, name, []byte{}, "application/octet-stream")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj := s.containers[containerName].objects[name]
+	obj.dlo = manifest
+	obj.headers.Set("X-Object-Manifest", manifest)
+	obj.lastModified = time.Now().UTC()
+}
+
+// dloContent concatenates the objects that X-Object-Manifest refers to.
+func (s *Server) dloContent(obj *object) []byte {
+	manifest, err := url.QueryUnescape(obj.dlo)
+	if err != nil {
+		return []byte{}
+	}
+
+	parts := strings.SplitN(manifest, "/", 2)
+	c, ok := s.containers[parts[0]]
+	if !ok || len(parts) != 2 {
+		return []byte{}
+	}
+
+	names := []string{}
+	for name := range c.objects {
+		if strings.HasPrefix(name, parts[1]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	data := []byte{}
+	for _, name := range names {
+		if seg := c.objects[name]; seg.dlo == "" {
+			data = append(data, s.content(seg)...)
+		}
+	}
+	return data
+}
@@ -0,0 +1,137 @@
+// Package swifttest provides a local HTTP server which speaks enough of the Keystone v2/v3
+// token API and the Swift v1 API to drive openstack.Swift in tests without a real cloud.
+package swifttest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_USERNAME    = "swifttest"
+	DEFAULT_PASSWORD    = "swifttest"
+	DEFAULT_TENANT_ID   = "tenant-id"
+	DEFAULT_TENANT_NAME = "swifttest"
+	DEFAULT_REGION      = "RegionOne"
+	DEFAULT_DOMAIN_ID   = "default"
+	DEFAULT_DOMAIN_NAME = "Default"
+
+	DEFAULT_APPLICATION_CREDENTIAL_ID     = "app-cred-id"
+	DEFAULT_APPLICATION_CREDENTIAL_SECRET = "app-cred-secret"
+
+	// Same as container_listing_limit of Swift.
+	DEFAULT_LISTING_LIMIT = 10000
+)
+
+type Server struct {
+	// Base URL of the server, e.g. http://127.0.0.1:12345
+	URL string
+
+	// Credentials that the identity API accepts.
+	Username   string
+	Password   string
+	TenantID   string
+	TenantName string
+	Region     string
+
+	// The domain of the user and tenant (Keystone v3 only).
+	DomainID   string
+	DomainName string
+
+	// Application credential that Keystone v3 accepts.
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+
+	// Token issued by the identity API. Swift API accepts this token only.
+	Token string
+
+	// Value of X-Account-Meta-Quota-Bytes header. 0 means the header is not returned.
+	AccountQuota uint64
+
+	// Max number of objects in a page of the container listing. See SetListingLimit().
+	listingLimit int
+
+	containers map[string]*container
+	httpServer *httptest.Server
+	lock       sync.Mutex
+}
+
+// NewServer starts a server. Close() should be called after use.
+func NewServer() *Server {
+	s := &Server{
+		Username:     DEFAULT_USERNAME,
+		Password:     DEFAULT_PASSWORD,
+		TenantID:     DEFAULT_TENANT_ID,
+		TenantName:   DEFAULT_TENANT_NAME,
+		Region:       DEFAULT_REGION,
+		Token:        "swifttest-token",
+		listingLimit: DEFAULT_LISTING_LIMIT,
+		containers:   map[string]*container{},
+
+		DomainID:                    DEFAULT_DOMAIN_ID,
+		DomainName:                  DEFAULT_DOMAIN_NAME,
+		ApplicationCredentialID:     DEFAULT_APPLICATION_CREDENTIAL_ID,
+		ApplicationCredentialSecret: DEFAULT_APPLICATION_CREDENTIAL_SECRET,
+	}
+
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.httpServer.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// SetListingLimit changes the max number of objects in a page of the container listing.
+func (s *Server) SetListingLimit(limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listingLimit = limit
+}
+
+// AuthURL returns the URL of Keystone v2 API.
+func (s *Server) AuthURL() string {
+	return s.URL + "/v2.0"
+}
+
+// AuthURLv3 returns the URL of Keystone v3 API.
+func (s *Server) AuthURLv3() string {
+	return s.URL + "/v3"
+}
+
+// AuthURLv1 returns the URL of TempAuth (v1.0). The user is "TenantName:Username" and the key is Password.
+func (s *Server) AuthURLv1() string {
+	return s.URL + "/auth/v1.0"
+}
+
+// StorageURL returns the URL of the Swift account.
+func (s *Server) StorageURL() string {
+	return fmt.Sprintf("%s/v1/AUTH_%s", s.URL, s.TenantID)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+
+	switch {
+	case p == "/" || p == "":
+		s.serveVersions(w, r)
+	case strings.HasPrefix(p, "/v2.0/"):
+		s.serveKeystoneV2(w, r)
+	case strings.HasPrefix(p, "/v3/"):
+		s.serveKeystoneV3(w, r)
+	case p == "/auth/v1.0":
+		s.serveTempAuth(w, r)
+	case strings.HasPrefix(p, "/v1/"):
+		if r.Header.Get("X-Auth-Token") != s.Token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.serveSwift(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
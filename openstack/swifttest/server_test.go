@@ -0,0 +1,359 @@
+package swifttest
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func request(t *testing.T, s *Server, method string, path string, body string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, s.StorageURL()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	req.Header.Set("X-Auth-Token", s.Token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return resp
+}
+
+func TestKeystoneV2(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	body := `{"auth": {"passwordCredentials": {"username": "swifttest", "password": "swifttest"}, "tenantName": "swifttest"}}`
+	resp, err := http.Post(s.AuthURL()+"/tokens", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid status code %d", resp.StatusCode)
+	}
+
+	var access struct {
+		Access struct {
+			Token struct {
+				ID string `json:"id"`
+			} `json:"token"`
+		} `json:"access"`
+	}
+	json.NewDecoder(resp.Body).Decode(&access)
+	if access.Access.Token.ID != s.Token {
+		t.Errorf("Invalid token %s", access.Access.Token.ID)
+	}
+
+	body = `{"auth": {"passwordCredentials": {"username": "swifttest", "password": "wrong"}}}`
+	resp, _ = http.Post(s.AuthURL()+"/tokens", "application/json", strings.NewReader(body))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Invalid status code %d for wrong password", resp.StatusCode)
+	}
+}
+
+func TestKeystoneV3(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	body := `{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "swifttest", "password": "swifttest"}}}}}`
+	resp, err := http.Post(s.AuthURLv3()+"/auth/tokens", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Invalid status code %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Subject-Token") != s.Token {
+		t.Errorf("Invalid token %s", resp.Header.Get("X-Subject-Token"))
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	resp, err := http.Get(s.StorageURL())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Invalid status code %d", resp.StatusCode)
+	}
+}
+
+func TestObjects(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	if resp := request(t, s, "PUT", "/test", "", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Container creation failed %d", resp.StatusCode)
+	}
+
+	if resp := request(t, s, "PUT", "/test/dir/obj", "hogehoge", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Upload failed %d", resp.StatusCode)
+	}
+
+	resp := request(t, s, "COPY", "/test/dir/obj", "", map[string]string{"Destination": "test/copied"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Copy failed %d", resp.StatusCode)
+	}
+
+	resp = request(t, s, "GET", "/test/copied", "", nil)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hogehoge" {
+		t.Errorf("Invalid object data %s", data)
+	}
+
+	resp = request(t, s, "HEAD", "/test", "", nil)
+	if resp.Header.Get("X-Container-Bytes-Used") != "16" || resp.Header.Get("X-Container-Object-Count") != "2" {
+		t.Errorf("Invalid container headers %v", resp.Header)
+	}
+
+	if resp := request(t, s, "DELETE", "/test", "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Deleting non-empty container should fail %d", resp.StatusCode)
+	}
+
+	if resp := request(t, s, "DELETE", "/test/copied", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Delete failed %d", resp.StatusCode)
+	}
+	if resp := request(t, s, "GET", "/test/copied", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Deleted object still exists %d", resp.StatusCode)
+	}
+}
+
+func TestListing(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetListingLimit(2)
+
+	for _, name := range []string{"a", "b", "c", "d/e"} {
+		s.PutObject("test", name, []byte(name), "text/plain")
+	}
+
+	var names []string
+	marker := ""
+	for {
+		resp := request(t, s, "GET", "/test?format=json&marker="+marker, "", nil)
+		var list []struct {
+			Name  string `json:"name"`
+			Bytes int64  `json:"bytes"`
+		}
+		json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+
+		if len(list) == 0 {
+			break
+		} else if len(list) > 2 {
+			t.Fatalf("Listing limit was not applied (%d)", len(list))
+		}
+		for _, e := range list {
+			names = append(names, e.Name)
+		}
+		marker = list[len(list)-1].Name
+	}
+
+	if strings.Join(names, ",") != "a,b,c,d/e" {
+		t.Errorf("Invalid listing %v", names)
+	}
+
+	s.SetListingLimit(DEFAULT_LISTING_LIMIT)
+	resp := request(t, s, "GET", "/test?delimiter=/", "", nil)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "a\nb\nc\nd/\n" {
+		t.Errorf("Invalid listing with delimiter %q", data)
+	}
+}
+
+func TestStaticLargeObject(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.PutObject("test", "dummy", []byte{}, "text/plain")
+	s.PutObject("test_segments", "large/00", []byte("hoge"), "application/octet-stream")
+	s.PutObject("test_segments", "large/01", []byte("fuga"), "application/octet-stream")
+
+	manifest := `[{"path": "/test_segments/large/00", "size_bytes": 4}, {"path": "/test_segments/large/01", "size_bytes": 4}]`
+	resp := request(t, s, "PUT", "/test/large?multipart-manifest=put", manifest, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Manifest creation failed %d", resp.StatusCode)
+	}
+
+	// Etag of the large object is the MD5 of the concatenated segment Etags.
+	etag := fmt.Sprintf("\"%x\"", md5.Sum([]byte(fmt.Sprintf("%x%x", md5.Sum([]byte("hoge")), md5.Sum([]byte("fuga"))))))
+	if resp.Header.Get("Etag") != etag {
+		t.Errorf("Invalid Etag of the manifest PUT %s", resp.Header.Get("Etag"))
+	}
+
+	headers := map[string]string{"Etag": fmt.Sprintf("%x", md5.Sum([]byte(manifest)))}
+	if resp := request(t, s, "PUT", "/test/large?multipart-manifest=put", manifest, headers); resp.StatusCode != 422 {
+		t.Errorf("Manifest PUT with the MD5 of the manifest should be rejected %d", resp.StatusCode)
+	}
+
+	resp = request(t, s, "GET", "/test/large", "", nil)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hogefuga" {
+		t.Errorf("Invalid object data %s", data)
+	}
+	if resp.Header.Get("X-Static-Large-Object") != "True" {
+		t.Errorf("X-Static-Large-Object header was not returned")
+	}
+
+	resp = request(t, s, "GET", "/test?format=json&prefix=large", "", nil)
+	var list []struct {
+		Bytes int64 `json:"bytes"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].Bytes != 8 {
+		t.Errorf("Invalid listing %v", list)
+	}
+
+	manifest = `[{"path": "/test_segments/not-exists"}]`
+	if resp := request(t, s, "PUT", "/test/invalid?multipart-manifest=put", manifest, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Manifest with missing segments should be rejected %d", resp.StatusCode)
+	}
+
+	request(t, s, "DELETE", "/test/large?multipart-manifest=delete", "", nil)
+	if _, ok := s.Object("test_segments", "large/00"); ok {
+		t.Errorf("Segments still exist")
+	}
+}
+
+func TestDynamicLargeObject(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.PutObject("test", "segments/00", []byte("hoge"), "text/plain")
+	s.PutObject("test", "segments/01", []byte("fuga"), "text/plain")
+
+	resp := request(t, s, "PUT", "/test/large", "", map[string]string{"X-Object-Manifest": "test/segments/"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Manifest creation failed %d", resp.StatusCode)
+	}
+
+	resp = request(t, s, "HEAD", "/test/large", "", nil)
+	if resp.Header.Get("Content-Length") != "8" || resp.Header.Get("X-Object-Manifest") != "test/segments/" {
+		t.Errorf("Invalid headers of DLO %v", resp.Header)
+	}
+
+	resp = request(t, s, "GET", "/test/large", "", nil)
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hogefuga" {
+		t.Errorf("Invalid object data %s", data)
+	}
+
+	resp = request(t, s, "GET", "/test?format=json&prefix=large", "", nil)
+	var list []struct {
+		Bytes int64 `json:"bytes"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].Bytes != 0 {
+		t.Errorf("Listing should report the size of the manifest itself %v", list)
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.PutObject("test", "obj", []byte("0123456789"), "text/plain")
+
+	tests := map[string]string{
+		"bytes=0-3":  "0123",
+		"bytes=7-":   "789",
+		"bytes=-2":   "89",
+		"bytes=8-99": "89",
+	}
+	for rng, expected := range tests {
+		resp := request(t, s, "GET", "/test/obj", "", map[string]string{"Range": rng})
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Errorf("Invalid status code %d (%s)", resp.StatusCode, rng)
+		}
+		if string(data) != expected {
+			t.Errorf("Invalid data %s (%s)", data, rng)
+		}
+	}
+
+	resp := request(t, s, "GET", "/test/obj", "", map[string]string{"Range": "bytes=10-"})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Invalid status code %d", resp.StatusCode)
+	}
+}
+
+func TestKeystoneV3Domains(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "swifttest", "domain": {"name": "Default"}, "password": "swifttest"}}},
+			"scope": {"project": {"name": "swifttest", "domain": {"id": "default"}}}}}`, http.StatusCreated},
+		{`{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "swifttest", "domain": {"name": "Other"}, "password": "swifttest"}}}}}`, http.StatusUnauthorized},
+		{`{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "swifttest", "password": "swifttest"}}},
+			"scope": {"project": {"name": "swifttest", "domain": {"name": "Other"}}}}}`, http.StatusUnauthorized},
+		{`{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "app-cred-id", "secret": "app-cred-secret"}}}}`, http.StatusCreated},
+		{`{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "app-cred-id", "secret": "wrong"}}}}`, http.StatusUnauthorized},
+	}
+
+	for i, test := range tests {
+		resp, err := http.Post(s.AuthURLv3()+"/auth/tokens", "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("Invalid status code %d of request %d", resp.StatusCode, i)
+		}
+	}
+}
+
+func TestTempAuth(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", s.AuthURLv1(), nil)
+	req.Header.Set("X-Auth-User", s.TenantName+":"+s.Username)
+	req.Header.Set("X-Auth-Key", s.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid status code %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Auth-Token") != s.Token || resp.Header.Get("X-Storage-Url") != s.StorageURL() {
+		t.Errorf("Invalid token %s or storage URL %s", resp.Header.Get("X-Auth-Token"), resp.Header.Get("X-Storage-Url"))
+	}
+
+	req.Header.Set("X-Auth-Key", "wrong")
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Invalid status code %d for wrong key", resp.StatusCode)
+	}
+}
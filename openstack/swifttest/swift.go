@@ -0,0 +1,582 @@
+package swifttest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Same format as "last_modified" in the container listing of Swift.
+const LAST_MODIFIED_FORMAT = "2006-01-02T15:04:05.000000"
+
+type object struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+
+	// Metadata headers (X-Object-Meta-*) stored with the object.
+	headers http.Header
+
+	// Segments of Static Large Object. nil if the object is not a manifest.
+	slo []sloSegment
+
+	// X-Object-Manifest of Dynamic Large Object. Empty if the object is not a manifest.
+	dlo string
+}
+
+func (o *object) hash() string {
+	sum := md5.Sum(o.data)
+	return hex.EncodeToString(sum[:])
+}
+
+// content returns the data of the object. Segments are concatenated if the object is a manifest.
+func (s *Server) content(obj *object) []byte {
+	if obj.dlo != "" {
+		return s.dloContent(obj)
+	} else if obj.slo == nil {
+		return obj.data
+	}
+
+	data := make([]byte, 0, s.size(obj))
+	for _, seg := range obj.slo {
+		if o, ok := s.lookup(seg.Name); ok {
+			data = append(data, s.content(o)...)
+		}
+	}
+	return data
+}
+
+func (s *Server) size(obj *object) int64 {
+	if obj.dlo != "" {
+		return int64(len(s.dloContent(obj)))
+	} else if obj.slo == nil {
+		return int64(len(obj.data))
+	}
+
+	var size int64
+	for _, seg := range obj.slo {
+		size += seg.Bytes
+	}
+	return size
+}
+
+func (s *Server) etag(obj *object) string {
+	if obj.slo == nil {
+		return obj.hash()
+	}
+
+	h := md5.New()
+	for _, seg := range obj.slo {
+		h.Write([]byte(seg.Hash))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// etagHeader returns the value of Etag header. Same as Swift, it is quoted if the object is SLO.
+func (s *Server) etagHeader(obj *object) string {
+	if obj.slo == nil {
+		return s.etag(obj)
+	}
+	return fmt.Sprintf("\"%s\"", s.etag(obj))
+}
+
+type container struct {
+	objects map[string]*object
+}
+
+func (c *container) bytesUsed() (used uint64) {
+	for _, obj := range c.objects {
+		used += uint64(len(obj.data))
+	}
+	return used
+}
+
+// PutObject stores an object directly. The container is created if it does not exist.
+func (s *Server) PutObject(containerName string, name string, data []byte, contentType string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.containers[containerName]
+	if !ok {
+		c = &container{objects: map[string]*object{}}
+		s.containers[containerName] = c
+	}
+	c.objects[name] = &object{
+		data:         data,
+		contentType:  contentType,
+		lastModified: time.Now().UTC(),
+		headers:      http.Header{},
+	}
+}
+
+// Object returns a copy of the object data.
+func (s *Server) Object(containerName string, name string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.containers[containerName]
+	if !ok {
+		return nil, false
+	}
+	obj, ok := c.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, obj.data...), true
+}
+
+// ContainerExists returns true if the container exists.
+func (s *Server) ContainerExists(containerName string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.containers[containerName]
+	return ok
+}
+
+// splitPath splits the path "/v1/AUTH_xxx/container/object" into its components.
+func splitPath(p string) (account string, containerName string, objectName string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/v1/"), "/", 3)
+	account = parts[0]
+	if len(parts) > 1 {
+		containerName = parts[1]
+	}
+	if len(parts) > 2 {
+		objectName = parts[2]
+	}
+	return account, containerName, objectName
+}
+
+func (s *Server) serveSwift(w http.ResponseWriter, r *http.Request) {
+	account, containerName, objectName := splitPath(r.URL.Path)
+	if account != "AUTH_"+s.TenantID {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case containerName == "":
+		s.serveAccount(w, r)
+	case objectName == "":
+		s.serveContainer(w, r, containerName)
+	default:
+		s.serveObject(w, r, containerName, objectName)
+	}
+}
+
+// ----- Account
+
+func (s *Server) serveAccount(w http.ResponseWriter, r *http.Request) {
+	var used, count uint64
+	names := make([]string, 0, len(s.containers))
+	for name, c := range s.containers {
+		names = append(names, name)
+		used += c.bytesUsed()
+		count += uint64(len(c.objects))
+	}
+	sort.Strings(names)
+
+	h := w.Header()
+	h.Set("X-Account-Container-Count", strconv.Itoa(len(s.containers)))
+	h.Set("X-Account-Object-Count", strconv.FormatUint(count, 10))
+	h.Set("X-Account-Bytes-Used", strconv.FormatUint(used, 10))
+	if s.AccountQuota > 0 {
+		h.Set("X-Account-Meta-Quota-Bytes", strconv.FormatUint(s.AccountQuota, 10))
+	}
+
+	switch r.Method {
+	case "HEAD":
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		list := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			c := s.containers[name]
+			list = append(list, map[string]interface{}{
+				"name":  name,
+				"count": len(c.objects),
+				"bytes": c.bytesUsed(),
+			})
+		}
+		writeJSON(w, http.StatusOK, list)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ----- Container
+
+func (s *Server) serveContainer(w http.ResponseWriter, r *http.Request, name string) {
+	c, exists := s.containers[name]
+
+	if r.Method == "PUT" {
+		if exists {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			s.containers[name] = &container{objects: map[string]*object{}}
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Container-Object-Count", strconv.Itoa(len(c.objects)))
+	w.Header().Set("X-Container-Bytes-Used", strconv.FormatUint(c.bytesUsed(), 10))
+
+	switch r.Method {
+	case "HEAD":
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		s.serveListing(w, r, c)
+	case "DELETE":
+		if len(c.objects) > 0 {
+			http.Error(w, "There was a conflict when trying to complete your request.", http.StatusConflict)
+			return
+		}
+		delete(s.containers, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "POST":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveListing(w http.ResponseWriter, r *http.Request, c *container) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	marker := q.Get("marker")
+	endMarker := q.Get("end_marker")
+
+	limit := s.listingLimit
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+
+	names := make([]string, 0, len(c.objects))
+	for name := range c.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type entry struct {
+		Name         string `json:"name,omitempty"`
+		Subdir       string `json:"subdir,omitempty"`
+		Hash         string `json:"hash,omitempty"`
+		Bytes        int64  `json:"bytes"`
+		ContentType  string `json:"content_type,omitempty"`
+		LastModified string `json:"last_modified,omitempty"`
+	}
+
+	list := make([]entry, 0, limit)
+	for _, name := range names {
+		if len(list) >= limit {
+			break
+		}
+		if !strings.HasPrefix(name, prefix) || (marker != "" && name <= marker) || (endMarker != "" && name >= endMarker) {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				subdir := name[:len(prefix)+i+len(delimiter)]
+				if len(list) == 0 || list[len(list)-1].Subdir != subdir {
+					list = append(list, entry{Subdir: subdir})
+				}
+				continue
+			}
+		}
+
+		// Same as Swift, the listing reports the size of the DLO manifest itself.
+		obj := c.objects[name]
+		size := s.size(obj)
+		if obj.dlo != "" {
+			size = int64(len(obj.data))
+		}
+
+		list = append(list, entry{
+			Name:         name,
+			Hash:         s.etag(obj),
+			Bytes:        size,
+			ContentType:  obj.contentType,
+			LastModified: obj.lastModified.Format(LAST_MODIFIED_FORMAT),
+		})
+	}
+
+	if q.Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	if len(list) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range list {
+		if e.Subdir != "" {
+			fmt.Fprintln(w, e.Subdir)
+		} else {
+			fmt.Fprintln(w, e.Name)
+		}
+	}
+}
+
+// ----- Object
+
+// lookup returns the object referred by "container/object" path, e.g. X-Copy-From header.
+func (s *Server) lookup(p string) (*object, bool) {
+	p, err := url.QueryUnescape(strings.TrimPrefix(p, "/"))
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	c, ok := s.containers[parts[0]]
+	if !ok {
+		return nil, false
+	}
+	obj, ok := c.objects[parts[1]]
+	return obj, ok
+}
+
+func (s *Server) store(containerName string, name string, obj *object) bool {
+	c, ok := s.containers[containerName]
+	if !ok {
+		return false
+	}
+	obj.lastModified = time.Now().UTC()
+	c.objects[name] = obj
+	return true
+}
+
+// copyObject returns a copy of the object. Manifests are copied as the concatenated data.
+func (s *Server) copyObject(obj *object) *object {
+	headers := http.Header{}
+	for k, v := range obj.headers {
+		if k != "X-Static-Large-Object" && k != "X-Object-Manifest" {
+			headers[k] = v
+		}
+	}
+	return &object{
+		data:        append([]byte{}, s.content(obj)...),
+		contentType: obj.contentType,
+		headers:     headers,
+	}
+}
+
+func (s *Server) writeObjectHeaders(w http.ResponseWriter, obj *object) {
+	h := w.Header()
+	for k, v := range obj.headers {
+		h[k] = v
+	}
+	h.Set("Content-Type", obj.contentType)
+	h.Set("Etag", s.etagHeader(obj))
+	h.Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	h.Set("X-Timestamp", fmt.Sprintf("%d.00000", obj.lastModified.Unix()))
+	h.Set("Accept-Ranges", "bytes")
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, containerName string, name string) {
+	if _, ok := s.containers[containerName]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	obj, exists := s.containers[containerName].objects[name]
+
+	switch r.Method {
+	case "PUT":
+		s.putObject(w, r, containerName, name)
+
+	case "COPY":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		dest := strings.SplitN(strings.TrimPrefix(r.Header.Get("Destination"), "/"), "/", 2)
+		if len(dest) != 2 {
+			http.Error(w, "Invalid Destination", http.StatusPreconditionFailed)
+			return
+		}
+		destName, _ := url.QueryUnescape(dest[1])
+		if !s.store(dest[0], destName, s.copyObject(obj)) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case "GET", "HEAD":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.URL.Query().Get("multipart-manifest") == "get" {
+			if obj.slo != nil {
+				s.serveManifest(w, r, obj)
+				return
+			} else if obj.dlo != "" {
+				w.Header().Set("X-Object-Manifest", obj.dlo)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		data := s.content(obj)
+		s.writeObjectHeaders(w, obj)
+
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseRange(rng, int64(len(data)))
+			if !ok {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+			data = data[start:end]
+			status = http.StatusPartialContent
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+
+	case "DELETE":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if obj.slo != nil && r.URL.Query().Get("multipart-manifest") == "delete" {
+			s.deleteSegments(obj)
+		}
+		delete(s.containers[containerName].objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, containerName string, name string) {
+	var obj *object
+
+	if r.URL.Query().Get("multipart-manifest") == "put" {
+		var err error
+		if obj, err = s.parseManifest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Same as Swift, Etag of the manifest PUT is the Etag of the large object, not the MD5 of the manifest.
+		if etag := r.Header.Get("Etag"); etag != "" && strings.Trim(etag, "\"") != s.etag(obj) {
+			http.Error(w, "Unprocessable Entity", 422)
+			return
+		}
+
+	} else if from := r.Header.Get("X-Copy-From"); from != "" {
+		src, ok := s.lookup(from)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		obj = s.copyObject(src)
+
+	} else {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		obj = &object{
+			data:        data,
+			contentType: r.Header.Get("Content-Type"),
+			headers:     http.Header{},
+		}
+		if obj.contentType == "" {
+			obj.contentType = "application/octet-stream"
+		}
+
+		if etag := r.Header.Get("Etag"); etag != "" && etag != obj.hash() {
+			http.Error(w, "Unprocessable Entity", 422)
+			return
+		}
+	}
+
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			obj.headers[k] = v
+		}
+	}
+
+	if manifest := r.Header.Get("X-Object-Manifest"); manifest != "" {
+		obj.dlo = manifest
+		obj.headers.Set("X-Object-Manifest", manifest)
+	}
+
+	s.store(containerName, name, obj)
+	w.Header().Set("Etag", s.etagHeader(obj))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// parseRange parses the Range header that has a single range, e.g. "bytes=0-99", "bytes=100-" or "bytes=-100".
+// It returns the range as [start, end).
+func parseRange(rng string, size int64) (start int64, end int64, ok bool) {
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return 0, 0, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	var err error
+	if parts[0] == "" {
+		// suffix range
+		var n int64
+		if n, err = strconv.ParseInt(parts[1], 10, 64); err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, size > 0
+	}
+
+	if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end = size
+	if parts[1] != "" {
+		var last int64
+		if last, err = strconv.ParseInt(parts[1], 10, 64); err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < size {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
@@ -1,21 +1,105 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/hironobu-s/swiftfs/config"
+	"github.com/hironobu-s/swiftfs/mapper"
 	"github.com/hironobu-s/swiftfs/openstack"
+	"github.com/hironobu-s/swiftfs/openstack/swifttest"
 )
 
+const (
+	TEST_CONTAINER_NAME = "swiftfs-e2e-test"
+)
+
+var server *swifttest.Server
+
+// Local files of the tests are in the temporary directory.
+var testDir string
+
 func TestMain(m *testing.M) {
+	server = swifttest.NewServer()
+
+	// NewSwift() prefers auth parameters in ENV.
+	for _, name := range []string{"OS_AUTH_URL", "OS_USERNAME", "OS_USERID", "OS_PASSWORD", "OS_TENANT_ID", "OS_TENANT_NAME"} {
+		os.Unsetenv(name)
+	}
+
+	testDir, _ = ioutil.TempDir("", "swiftfs-e2e")
+
+	code := m.Run()
+	server.Close()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+func newConfig() *config.Config {
 	c := config.NewConfig()
 	c.CreateContainer = true
 	c.Debug = true
 	c.NoDaemon = true
+	c.ContainerName = TEST_CONTAINER_NAME
+	c.CacheDirectory = testDir
+	c.IdentityEndpoint = server.AuthURL()
+	c.Username = server.Username
+	c.Password = server.Password
+	c.TenantName = server.TenantName
+	return c
+}
+
+func TestEndToEnd(t *testing.T) {
+	c := newConfig()
 
 	swift := openstack.NewSwift(c)
 	if err := swift.Auth(); err != nil {
 		log.Errorf("%v", err)
+		t.Fatalf("%v", err)
+	}
+
+	// objects uploaded before mounting, over some pages of the listing
+	server.SetListingLimit(5)
+	defer server.SetListingLimit(swifttest.DEFAULT_LISTING_LIMIT)
+	for i := 0; i < 12; i++ {
+		server.PutObject(TEST_CONTAINER_NAME, fmt.Sprintf("dir/object%02d", i), []byte("hogehoge"), "text/plain")
+	}
+	server.PutObject(TEST_CONTAINER_NAME, "dir", []byte{}, "application/directory")
+
+	m, err := mapper.NewObjectMapper(c, swift)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if n := len(m.OpenDir("dir")); n != 12 {
+		t.Errorf("Number of objects in the directory is %d, expected 12", n)
+	}
+
+	obj, ok := m.Get("dir/object00")
+	if !ok {
+		t.Fatalf("Object not found")
+	} else if obj.Size != uint64(len("hogehoge")) {
+		t.Errorf("Invalid size %d", obj.Size)
+	}
+
+	if err = m.Rename("dir/object00", "renamed"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if data, ok := server.Object(TEST_CONTAINER_NAME, "renamed"); !ok || string(data) != "hogehoge" {
+		t.Errorf("Renamed object does not exist on object storage")
+	}
+	if _, ok := server.Object(TEST_CONTAINER_NAME, "dir/object00"); ok {
+		t.Errorf("Old object still exists on object storage")
+	}
+
+	container, err := m.Stat()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if container.Count != 13 {
+		t.Errorf("Invalid object count %d", container.Count)
 	}
 }